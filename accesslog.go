@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLog writes one line per request in the Combined Log Format, with the
+// request duration in seconds appended, once the request is over. For a
+// listener that's when they disconnect, so the byte count is what they heard.
+type AccessLog struct {
+	mu   sync.Mutex
+	path string // "-" for stdout
+	out  io.Writer
+	file *os.File // nil for stdout
+}
+
+// OpenAccessLog appends to the file at path, or writes to stdout for "-"
+func OpenAccessLog(path string) (*AccessLog, error) {
+	log := &AccessLog{path: path, out: os.Stdout}
+	if path == "-" {
+		return log, nil
+	}
+	if err := log.Reopen(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// Reopen closes and reopens the log file, so that it can be rotated by
+// moving it out of the way and sending SIGHUP
+func (l *AccessLog) Reopen() error {
+	if l.path == "-" {
+		return nil
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, l.out = file, file
+	return nil
+}
+
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// wrap logs every request next serves. A nil AccessLog logs nothing.
+func (l *AccessLog) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+		next(recorder, r)
+		l.write(r, recorder, started)
+	}
+}
+
+func (l *AccessLog) write(r *http.Request, recorder *responseRecorder, started time.Time) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user, _, ok := r.BasicAuth()
+	if !ok || user == "" {
+		user = "-"
+	}
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK // Nothing written at all still goes out as a 200
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %s %d %d %s %s %.3f\n",
+		host,
+		user,
+		started.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto),
+		status,
+		recorder.bytes,
+		quoteOrDash(r.Referer()),
+		quoteOrDash(r.UserAgent()),
+		time.Since(started).Seconds(),
+	)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// responseRecorder counts the bytes written through it and remembers the
+// status. It passes flushes through, and Unwrap lets ResponseController reach
+// the connection for write deadlines.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
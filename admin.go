@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SKIPTIMEOUT is how long /admin/skip waits for the next track to start
+const SKIPTIMEOUT = 10 * time.Second
+
+// requireAdmin guards the admin API. Unlike requireAuth it fails closed:
+// without admin credentials configured every request is refused.
+func requireAdmin(credentials Credentials, next http.HandlerFunc) http.HandlerFunc {
+	if !credentials.enabled() {
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "The admin API needs -admin-user and -admin-pass", http.StatusForbidden)
+		}
+	}
+	return requireAuth(credentials, next)
+}
+
+// adminStation picks the station an admin request is for, the first one
+// unless ?station= names another. It writes the error response itself and
+// returns nil if the station can't be controlled.
+func adminStation(w http.ResponseWriter, r *http.Request, stations []*Station) *Station {
+	station := stations[0]
+	if key := r.URL.Query().Get("station"); key != "" {
+		if station = findStation(stations, key); station == nil {
+			http.Error(w, "Unknown station", http.StatusNotFound)
+			return nil
+		}
+	}
+	if station.playlist == nil || station.onDemand {
+		http.Error(w, "Only broadcast playlist stations can be controlled", http.StatusConflict)
+		return nil
+	}
+	return station
+}
+
+type SkipResult struct {
+	Station string `json:"station"`
+	Mount   string `json:"mount"`
+	Track   string `json:"track"` // title of the track that started in place of the skipped one
+}
+
+// skipHandler abandons a station's current track and responds once the next
+// one has started. Listeners stay connected throughout.
+func skipHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		station := adminStation(w, r, stations)
+		if station == nil {
+			return
+		}
+		if !station.streaming.Load() || station.offline.Load() || station.ended.Load() {
+			http.Error(w, "No track is playing", http.StatusConflict)
+			return
+		}
+
+		started := make(chan string, 1)
+		select {
+		case station.skip <- started:
+		default:
+			http.Error(w, "A skip is already in progress", http.StatusConflict)
+			return
+		}
+		slog.Info("skip requested", "station", station.Name, "remote_addr", r.RemoteAddr)
+		for _, variant := range station.variants {
+			select {
+			case variant.skip <- make(chan string, 1): // Nobody waits for the variant's next track
+			default:
+			}
+		}
+
+		var track string
+		select {
+		case title, ok := <-started:
+			if !ok {
+				http.Error(w, "No track is playing", http.StatusConflict)
+				return
+			}
+			track = title
+		case <-time.After(SKIPTIMEOUT):
+			station.withdrawSkip(started)
+			http.Error(w, "Skipped, but the next track hasn't started yet", http.StatusGatewayTimeout)
+			return
+		case <-r.Context().Done():
+			station.withdrawSkip(started)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		body := SkipResult{Station: station.Name, Mount: station.Mount, Track: track}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			slog.Error("could not write skip result", "error", err)
+		}
+	}
+}
+
+// withdrawSkip takes back a skip request nobody has picked up, so it
+// neither blocks every later one nor skips a track long after it was asked
+// for. One picked up already can't be taken back.
+func (s *Station) withdrawSkip(request chan string) {
+	select {
+	case pending := <-s.skip:
+		if pending != request {
+			select {
+			case s.skip <- pending: // Another request's, made after ours was picked up
+			default:
+			}
+		}
+	default:
+	}
+}
+
+type PauseState struct {
+	Station string `json:"station"`
+	Mount   string `json:"mount"`
+	Paused  bool   `json:"paused"`
+}
+
+// pauseHandler pauses a station's broadcast, or resumes it if pause is false
+func pauseHandler(stations []*Station, pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		station := adminStation(w, r, stations)
+		if station == nil {
+			return
+		}
+
+		for _, station := range append([]*Station{station}, station.variants...) {
+			if pause {
+				station.Pause()
+			} else {
+				station.Resume()
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		body := PauseState{Station: station.Name, Mount: station.Mount, Paused: station.paused.Load()}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			slog.Error("could not write pause state", "error", err)
+		}
+	}
+}
+
+type PlaylistReload struct {
+	Station string `json:"station"`
+	Mount   string `json:"mount"`
+	Tracks  int    `json:"tracks"`
+}
+
+// reloadPlaylistHandler re-reads a station's playlist, which is played from
+// the next track on. Listeners stay connected and the current track plays
+// to the end. A playlist that doesn't load is reported and the old one kept.
+func reloadPlaylistHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		station := adminStation(w, r, stations)
+		if station == nil {
+			return
+		}
+
+		slog.Info("playlist reload requested", "station", station.Name, "remote_addr", r.RemoteAddr)
+		tracks, err := station.ReloadPlaylist(r.Context())
+		if err != nil {
+			slog.Warn("could not reload playlist, keeping the old one", "station", station.Name, "source", station.source, "error", err)
+			http.Error(w, fmt.Sprintf("Could not reload the playlist, the old one is still playing: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		body := PlaylistReload{Station: station.Name, Mount: station.Mount, Tracks: tracks}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			slog.Error("could not write playlist reload", "error", err)
+		}
+	}
+}
+
+type StationListeners struct {
+	Station   string          `json:"station"`
+	Mount     string          `json:"mount"`
+	Listeners []ListenerStats `json:"listeners"`
+}
+
+// listenersHandler lists everyone connected to every station
+func listenersHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := []StationListeners{}
+		for _, station := range stations {
+			listeners := StationListeners{Station: station.Name, Mount: station.Mount, Listeners: []ListenerStats{}}
+			for _, connection := range station.pool.Connections() {
+				listeners.Listeners = append(listeners.Listeners, connection.stats())
+			}
+			body = append(body, listeners)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			slog.Error("could not write listeners", "error", err)
+		}
+	}
+}
+
+// kickHandler disconnects the listener whose id is given in the form or
+// query value "id", as listed by /admin/listeners
+func kickHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id must be a listener id from /admin/listeners", http.StatusBadRequest)
+			return
+		}
+
+		for _, station := range stations {
+			if station.pool.Kick(id) {
+				slog.Info("listener kicked", "station", station.Name, "id", id, "remote_addr", r.RemoteAddr)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "No such listener", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor polls until done reports true, failing the test after a second
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !done(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func postSkip(station *Station) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	skipHandler([]*Station{station})(w, httptest.NewRequest(http.MethodPost, "/admin/skip", nil))
+	return w
+}
+
+func TestSkipHandler(t *testing.T) {
+	options := testOptions()
+	options.Bitrate = 128000 // Plays in real time, nothing ends on its own
+	station, err := NewStation("test", "/stream", silenceFile(t, "playlist.mp3", 30*time.Second), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first.mp3", "second.mp3"} {
+		if err := station.queue.Push(silenceFile(t, name, 30*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runStation(t, station)
+	waitFor(t, "the first queued track", func() bool { return station.NowPlaying().File == "first.mp3" })
+
+	w := postSkip(station)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var result SkipResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Track != "second" || station.NowPlaying().File != "second.mp3" {
+		t.Errorf("skipped to %q, now playing %q, want the second queued track", result.Track, station.NowPlaying().File)
+	}
+}
+
+// With no track playing nothing picks a skip up, which has to be refused
+// rather than left to block every skip after it
+func TestSkipWithoutTrack(t *testing.T) {
+	tests := []struct {
+		name  string
+		onEOF string
+		state func(*Station) bool
+	}{
+		{"holding", EOFHOLD, func(s *Station) bool { return s.ended.Load() }},
+		{"finished", EOFEXIT, func(s *Station) bool {
+			select {
+			case <-s.stopped:
+				return true
+			default:
+				return false
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := testOptions()
+			options.OnEOF = test.onEOF
+			station, err := NewStation("test", "/stream", silenceFile(t, "short.mp3", 100*time.Millisecond), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runStation(t, station)
+			waitFor(t, "the playlist to end", func() bool { return test.state(station) })
+
+			for i := 0; i < 2; i++ {
+				if w := postSkip(station); w.Code != http.StatusConflict {
+					t.Fatalf("skip %d: status = %d, want %d", i, w.Code, http.StatusConflict)
+				}
+			}
+			if len(station.skip) != 0 {
+				t.Error("a skip request was left pending")
+			}
+		})
+	}
+}
+
+// A skip that gets in just as the playlist ends is answered by the hold
+func TestHoldRefusesSkip(t *testing.T) {
+	options := testOptions()
+	options.OnEOF = EOFHOLD
+	station, err := NewStation("test", "/stream", silenceFile(t, "short.mp3", 100*time.Millisecond), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	waitFor(t, "the hold", station.ended.Load)
+
+	request := make(chan string, 1)
+	station.skip <- request
+	select {
+	case _, ok := <-request:
+		if ok {
+			t.Error("hold reported a track starting")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("skip request never answered")
+	}
+}
+
+// A skip of the last track there is, with nothing to play after it, is
+// answered straight away rather than left to time out
+func TestSkipLastTrack(t *testing.T) {
+	tests := []struct {
+		name     string
+		onEOF    string
+		draining bool
+	}{
+		{"finished", EOFEXIT, false},
+		{"holding", EOFHOLD, false},
+		{"draining", EOFLOOP, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := testOptions()
+			options.OnEOF = test.onEOF
+			options.Bitrate = 128000 // Plays in real time, so it's still on when skipped
+			station, err := NewStation("test", "/stream", silenceFile(t, "long.mp3", 30*time.Second), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runStation(t, station)
+			waitFor(t, "the track", func() bool { return station.NowPlaying().File == "long.mp3" })
+			station.draining.Store(test.draining)
+
+			start := time.Now()
+			if w := postSkip(station); w.Code != http.StatusConflict {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("skip answered after %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestWithdrawSkip(t *testing.T) {
+	station := newStation("test", "/stream", testOptions())
+	ours, theirs := make(chan string, 1), make(chan string, 1)
+
+	station.skip <- ours
+	station.withdrawSkip(ours)
+	if len(station.skip) != 0 {
+		t.Error("request still pending after withdrawing it")
+	}
+
+	station.skip <- theirs // Ours was picked up, this came after
+	station.withdrawSkip(ours)
+	if pending := <-station.skip; pending != theirs {
+		t.Error("withdrew another request")
+	}
+}
+
+func postReload(station *Station) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	reloadPlaylistHandler([]*Station{station})(w, httptest.NewRequest(http.MethodPost, "/admin/reload-playlist", nil))
+	return w
+}
+
+// An edited playlist is played from the track after the current one, and
+// one that doesn't load leaves the old one playing
+func TestReloadPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"old.mp3", "new.mp3"} {
+		if err := writeSilence(filepath.Join(dir, name), 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other.ogg"), []byte("OggS\x00\x02"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	playlist := filepath.Join(dir, "playlist.m3u")
+	edit := func(tracks string) {
+		t.Helper()
+		if err := os.WriteFile(playlist, []byte(tracks), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edit("old.mp3\n")
+	station, err := NewStation("test", "/stream", playlist, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	waitFor(t, "the old playlist", func() bool { return station.NowPlaying().File == "old.mp3" })
+
+	for _, broken := range []string{"missing.mp3\n", "other.ogg\n"} {
+		edit(broken)
+		if w := postReload(station); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("reloading %q: status = %d, want %d", broken, w.Code, http.StatusUnprocessableEntity)
+		}
+	}
+	if station.pending.Load() != nil {
+		t.Fatal("a broken playlist was swapped in")
+	}
+
+	edit("new.mp3\nold.mp3\n")
+	w := postReload(station)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var result PlaylistReload
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Tracks != 2 || result.Mount != "/stream" {
+		t.Errorf("reload = %+v, want 2 tracks on /stream", result)
+	}
+	waitFor(t, "the new playlist", func() bool { return station.NowPlaying().File == "new.mp3" })
+}
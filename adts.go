@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// adtsCarry is the end of the previous AAC track, held back from the
+// broadcast so it can go out together with the start of the next one
+type adtsCarry struct {
+	frames []byte
+	header frameHeader // of the track the frames came from
+}
+
+// adtsFramer cuts an ADTS stream into whole frames, dropping whatever isn't
+// one, such as an ID3 tag or a frame the file was truncated in. Tracks with
+// the same sample rate and channels then join up seamlessly: the short last
+// chunk of a track isn't broadcast with a tick to itself, which listeners
+// would hear as a gap, but carried over to fill up the first chunk of the
+// next. Tracks that differ are kept apart, so the change falls between two
+// chunks.
+type adtsFramer struct {
+	r      *bufio.Reader
+	chunk  []byte
+	next   []byte // frame read ahead, to start the next chunk with
+	debt   int    // bytes owed to, or if negative ahead of, the pacing
+	header frameHeader
+	chunks int        // handed out so far
+	carry  *adtsCarry // shared by the station's tracks, stream goroutine only
+
+	unread  []byte // rest of a chunk handed out by Read
+	readErr error
+}
+
+func newADTSFramer(r io.Reader, carry *adtsCarry) *adtsFramer {
+	return &adtsFramer{r: bufio.NewReader(r), carry: carry}
+}
+
+// nextChunk returns whole frames adding up to size bytes on average, the
+// previous track's end first
+func (f *adtsFramer) nextChunk(size int) ([]byte, error) {
+	if f.chunks == 0 && len(f.carry.frames) > 0 {
+		return f.joinCarry(size)
+	}
+	target := size + f.debt
+	f.chunk = append(f.chunk[:0], f.next...)
+	f.next = nil
+	return f.fill(target, size)
+}
+
+// joinCarry starts the track with the previous one's end, in the same chunk
+// when the two match
+func (f *adtsFramer) joinCarry(size int) ([]byte, error) {
+	carry := *f.carry
+	*f.carry = adtsCarry{}
+	f.chunks++
+	frame, err := f.readFrame()
+	if err == io.EOF {
+		return carry.frames, nil // Nothing to join, the carry still goes out
+	} else if err != nil {
+		return carry.frames, err
+	}
+
+	if frame.header.sampleRate != carry.header.sampleRate || frame.header.channels != carry.header.channels {
+		slog.Info("AAC format changes between tracks, players may pause as they adjust",
+			"from_rate", carry.header.sampleRate, "to_rate", frame.header.sampleRate,
+			"from_channels", carry.header.channels, "to_channels", frame.header.channels)
+		f.next = frame.data
+		return carry.frames, nil
+	}
+
+	f.chunk = append(append(f.chunk[:0], carry.frames...), frame.data...)
+	return f.fill(size, size)
+}
+
+// fill reads frames onto the chunk until it reaches target. At the end of
+// the track a short chunk is carried over to the next track rather than
+// returned, unless it's all the track had, so the track isn't taken to be
+// empty.
+func (f *adtsFramer) fill(target, size int) ([]byte, error) {
+	for len(f.chunk) == 0 || len(f.chunk) < target {
+		frame, err := f.readFrame()
+		if err != nil {
+			f.debt = 0
+			if len(f.chunk) > 0 && f.chunks > 0 && err == io.EOF {
+				*f.carry = adtsCarry{frames: append([]byte{}, f.chunk...), header: f.header}
+				return nil, err
+			}
+			f.chunks++
+			return f.chunk, err
+		}
+		f.chunk = append(f.chunk, frame.data...)
+	}
+	f.debt = max(-size, min(target-len(f.chunk), size))
+	f.chunks++
+	return f.chunk, nil
+}
+
+type adtsFrame struct {
+	data   []byte
+	header frameHeader
+}
+
+// readFrame returns the next frame, skipping an ID3 tag and anything else
+// between frames. A truncated last frame is dropped and reported as the end
+// of the track. Read errors other than EOF are returned as they are.
+func (f *adtsFramer) readFrame() (adtsFrame, error) {
+	if f.header.length == 0 { // Nothing read yet
+		if head, _ := f.r.Peek(10); id3v2Size(head) > 0 {
+			f.r.Discard(id3v2Size(head))
+		}
+	}
+
+	skipped := 0
+	for {
+		b, err := f.r.Peek(adtsHeaderSize)
+		if err == io.EOF && len(b) > 0 {
+			slog.Debug("dropped bytes after the last ADTS frame", "bytes", skipped+len(b))
+		}
+		if err != nil {
+			return adtsFrame{}, err
+		}
+		header, ok := parseADTSHeader(b)
+		if !ok {
+			f.r.Discard(1)
+			skipped++
+			continue
+		}
+		if skipped > 0 {
+			slog.Debug("skipped bytes between ADTS frames", "bytes", skipped)
+		}
+
+		data := make([]byte, header.length)
+		if n, err := io.ReadFull(f.r, data); err == io.ErrUnexpectedEOF {
+			slog.Warn("dropped truncated last ADTS frame", "bytes", n, "frame_length", header.length)
+			return adtsFrame{}, io.EOF
+		} else if err != nil {
+			return adtsFrame{}, err
+		}
+		if f.header.length == 0 {
+			f.header = header
+		}
+		return adtsFrame{data: data, header: header}, nil
+	}
+}
+
+// Read makes the framer a plain reader too, for callers that don't care
+// where chunks start
+func (f *adtsFramer) Read(b []byte) (int, error) {
+	if len(f.unread) == 0 {
+		if f.readErr != nil {
+			return 0, f.readErr
+		}
+		f.unread, f.readErr = f.nextChunk(len(b))
+	}
+	n := copy(b, f.unread)
+	f.unread = f.unread[n:]
+	if len(f.unread) == 0 {
+		return n, f.readErr
+	}
+	return n, nil
+}
+
+// flushADTSCarry broadcasts the end of the last AAC track, held back for a
+// next track that isn't coming because the playlist has been played, and
+// waits a tick for it like any other chunk
+func (s *Station) flushADTSCarry(ctx context.Context, ticker *time.Ticker) {
+	frames := s.adtsCarry.frames
+	if len(frames) == 0 {
+		return
+	}
+	s.adtsCarry = adtsCarry{}
+	s.pool.Broadcast(frames)
+	s.lastBroadcast.Store(time.Now().UnixNano())
+	select {
+	case <-ticker.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// chunks reads a track through a framer the way streamTrack does, until it
+// ends
+func chunks(t *testing.T, track []byte, carry *adtsCarry, size int) [][]byte {
+	t.Helper()
+	framer := newADTSFramer(bytes.NewReader(track), carry)
+	var chunks [][]byte
+	for {
+		chunk, err := framer.nextChunk(size)
+		if len(chunk) > 0 {
+			chunks = append(chunks, append([]byte{}, chunk...))
+		}
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func lengths(chunks [][]byte) []int {
+	var lengths []int
+	for _, chunk := range chunks {
+		lengths = append(lengths, len(chunk))
+	}
+	return lengths
+}
+
+// at48k is an ADTS frame like silentADTS but at 48kHz
+func at48k(length int) []byte {
+	frame := silentADTS(length)
+	frame[2] = 0x4C
+	return frame
+}
+
+func TestADTSFramer(t *testing.T) {
+	tests := []struct {
+		name  string
+		track []byte
+		size  int
+		want  []int
+		carry int // bytes held back for the next track
+	}{
+		{"whole frames", bytes.Repeat(silentADTS(100), 7), 300, []int{300, 300}, 100},
+		{"pacing evens out", bytes.Repeat(silentADTS(200), 6), 250, []int{400, 200, 200, 200}, 200}, // 250 a chunk on average
+		{"all the track had", silentADTS(100), 300, []int{100}, 0},
+		{"id3 and garbage skipped", bytes.Join([][]byte{id3Tag(50), silentADTS(100), []byte("junk"), silentADTS(100), silentADTS(100)}, nil), 300, []int{300}, 0},
+		{"truncated last frame", append(bytes.Repeat(silentADTS(100), 3), silentADTS(100)[:60]...), 300, []int{300}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var carry adtsCarry
+			got := chunks(t, test.track, &carry, test.size)
+			if !slices.Equal(lengths(got), test.want) {
+				t.Errorf("chunks of %v bytes, want %v", lengths(got), test.want)
+			}
+			for i, chunk := range got {
+				if _, ok := parseADTSHeader(chunk); !ok {
+					t.Errorf("chunk %d doesn't start on a frame", i)
+				}
+			}
+			if len(carry.frames) != test.carry {
+				t.Errorf("%d bytes carried over, want %d", len(carry.frames), test.carry)
+			}
+		})
+	}
+}
+
+// Two tracks of the same format play as one: the first's short last chunk
+// fills up the second's first, so only the end of the last track is short.
+// A change of format falls between chunks instead.
+func TestADTSFramerJoinsTracks(t *testing.T) {
+	first := bytes.Repeat(silentADTS(100), 5)
+	tests := []struct {
+		name   string
+		second []byte
+		want   []int
+	}{
+		{"same format", bytes.Repeat(silentADTS(100), 5), []int{300, 300, 300, 100}},
+		{"sample rate changes", bytes.Repeat(at48k(100), 5), []int{300, 200, 300, 200}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var carry adtsCarry
+			got := append(chunks(t, first, &carry, 300), chunks(t, test.second, &carry, 300)...)
+			if len(carry.frames) > 0 {
+				got = append(got, carry.frames) // What the last track held back
+			}
+			if !slices.Equal(lengths(got), test.want) {
+				t.Errorf("chunks of %v bytes, want %v", lengths(got), test.want)
+			}
+			if !bytes.Equal(bytes.Join(got, nil), append(first, test.second...)) {
+				t.Error("the tracks didn't come out whole and in order")
+			}
+		})
+	}
+}
+
+// errorAfter reads r, then fails instead of ending
+type errorAfter struct {
+	r   io.Reader
+	err error
+}
+
+func (e errorAfter) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		return n, e.err
+	}
+	return n, err
+}
+
+// A read error isn't mistaken for the end of the track, whose end would be
+// carried over as though the next one could follow on
+func TestADTSFramerReadError(t *testing.T) {
+	broken := errors.New("disk gone")
+	var carry adtsCarry
+	framer := newADTSFramer(errorAfter{bytes.NewReader(bytes.Repeat(silentADTS(100), 4)), broken}, &carry)
+	var err error
+	for err == nil {
+		_, err = framer.nextChunk(300)
+	}
+	if err != broken {
+		t.Errorf("nextChunk() = %v, want %v", err, broken)
+	}
+	if len(carry.frames) != 0 {
+		t.Errorf("%d bytes carried over from a track that failed", len(carry.frames))
+	}
+}
+
+// The end held back from an AAC playlist's last track still goes out once
+// the playlist has been played
+func TestADTSCarryFlushedAtEnd(t *testing.T) {
+	track := silenceFile(t, "silence.aac", 3*time.Second) // Two whole chunks and part of another
+	options := testOptions()
+	options.OnEOF = EOFEXIT
+	options.Bitrate = 10_000_000 // Rather than the real time of a few bytes a frame
+	station, err := NewStation("test", "/stream", track, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newTestConnection(16)
+	if err := station.pool.AddConnection(listener); err != nil {
+		t.Fatal(err)
+	}
+	station.stream(context.Background())
+	station.pool.Close()
+
+	var received []byte
+	for chunk := range listener.bufferChannel {
+		received = append(received, chunk.Data...)
+	}
+	want := frameCount(3*time.Second, 1024) * len(silentADTSFrame)
+	if len(received) != want {
+		t.Errorf("broadcast %d bytes of the %d in the track", len(received), want)
+	}
+}
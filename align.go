@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+)
+
+// adtsHeaderSize is the longest frame header parsed, MPEG headers are 4 bytes
+const adtsHeaderSize = 7
+
+// frameReader passes a track through while following its ADTS or MPEG
+// frames, so that a cut made part way through the track can first finish
+// the frame in flight instead of leaving half a frame to pop in players.
+type frameReader struct {
+	r         io.Reader
+	pending   []byte // start of a frame header split across reads
+	remaining int    // bytes left of the current frame after its header
+	synced    bool   // inside frames, false for formats that aren't framed or after garbage
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.track(p[:n])
+	return n, err
+}
+
+// track advances through b frame by frame
+func (f *frameReader) track(b []byte) {
+	for len(b) > 0 {
+		if f.remaining > 0 {
+			k := min(f.remaining, len(b))
+			f.remaining -= k
+			b = b[k:]
+			continue
+		}
+
+		k := min(adtsHeaderSize-len(f.pending), len(b))
+		f.pending = append(f.pending, b[:k]...)
+		b = b[k:]
+		if len(f.pending) < adtsHeaderSize {
+			return
+		}
+
+		header, ok := parseADTSHeader(f.pending)
+		if !ok {
+			header, ok = parseMPEGHeader(f.pending)
+		}
+		if !ok || header.length < len(f.pending) {
+			// Lost sync, look for a header one byte on
+			f.synced = false
+			f.pending = append(f.pending[:0], f.pending[1:]...)
+			continue
+		}
+		f.synced = true
+		f.remaining = header.length - len(f.pending)
+		f.pending = f.pending[:0]
+	}
+}
+
+// frameStart returns the offset of the first frame in b, taken to be the
+// first header followed by another one, or by the end of b. It returns -1
+// if there is no such frame.
+func frameStart(b []byte) int {
+	for i := range b {
+		header, ok := parseADTSHeader(b[i:])
+		if !ok {
+			header, ok = parseMPEGHeader(b[i:])
+		}
+		if !ok {
+			continue
+		}
+
+		next := i + header.length
+		if next == len(b) {
+			return i
+		}
+		if next < len(b) {
+			if _, ok := parseADTSHeader(b[next:]); ok {
+				return i
+			}
+			if _, ok := parseMPEGHeader(b[next:]); ok {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// needed is how many more bytes finish the frame in flight
+func (f *frameReader) needed() int {
+	switch {
+	case !f.synced:
+		return 0
+	case f.remaining > 0:
+		return f.remaining
+	case len(f.pending) > 0:
+		return adtsHeaderSize - len(f.pending)
+	}
+	return 0
+}
+
+// finishFrame broadcasts the rest of the frame in flight, reading at most a
+// buffer's worth, so that the next track starts on a frame boundary. It
+// does nothing unless source is following frames.
+func (s *Station) finishFrame(source io.Reader, buffer []byte) {
+	f, ok := source.(*frameReader)
+	if !ok {
+		return
+	}
+
+	filled := 0
+	for f.needed() > 0 && filled < len(buffer) {
+		n, err := f.Read(buffer[filled:min(filled+f.needed(), len(buffer))])
+		filled += n
+		if err != nil {
+			break // The track ended, so did the frame
+		}
+	}
+	if filled > 0 {
+		slog.Debug("finished frame before cutting", "station", s.Name, "bytes", filled)
+		s.pool.Broadcast(buffer[:filled])
+	}
+}
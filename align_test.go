@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// silentADTS is a silent ADTS frame length bytes long, header included
+func silentADTS(length int) []byte {
+	frame := []byte{0xFF, 0xF1, 0x50, 0x80 | byte(length>>11&0x03), byte(length >> 3), byte(length&0x07)<<5 | 0x1F, 0xFC}
+	return append(frame, make([]byte, length-len(frame))...)
+}
+
+// Wherever a read stops, finishing the frame in flight lands on the next
+// sync word
+func TestFrameReaderSplitsOnSyncWords(t *testing.T) {
+	adts := bytes.Join([][]byte{silentADTS(100), silentADTS(37), silentADTS(512), silentADTS(7), silentADTS(250)}, nil)
+	mp3 := bytes.Repeat(silentMPEGFrame, 4)
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"adts", adts},
+		{"mp3", mp3},
+		{"adts after garbage", append([]byte("junk"), adts...)},
+	} {
+		for _, readSize := range []int{1, 3, 7, 64, 333} {
+			t.Run(fmt.Sprintf("%s/reads=%d", test.name, readSize), func(t *testing.T) {
+				f := &frameReader{r: bytes.NewReader(test.data)}
+				read := 0
+				for {
+					n, err := f.Read(make([]byte, readSize))
+					read += n
+					if err == io.EOF {
+						break
+					}
+					if !f.synced {
+						if f.needed() != 0 {
+							t.Fatalf("needs %d bytes out of sync at %d", f.needed(), read)
+						}
+						continue
+					}
+					// Finish the frame as finishFrame would, on a copy
+					finish := *f
+					finish.pending = append([]byte{}, f.pending...)
+					finish.r = bytes.NewReader(test.data[read:])
+					cut := read
+					for finish.needed() > 0 {
+						n, err := finish.Read(make([]byte, finish.needed()))
+						cut += n
+						if err != nil {
+							break
+						}
+					}
+					if cut != len(test.data) && frameStart(test.data[cut:]) != 0 {
+						t.Fatalf("after %d bytes, the cut at %d isn't on a frame", read, cut)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFrameStart(t *testing.T) {
+	frames := bytes.Repeat(silentADTSFrame, 3)
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"on a frame", frames, 0},
+		{"mid frame", frames[5:], 11},
+		{"false sync in the payload", append([]byte{0xFF, 0xF1, 0x50, 0x80, 0x02, 0x1F}, frames...), 6},
+		{"single whole frame", silentADTSFrame, 0},
+		{"mp3", append([]byte{1, 2, 3}, silentMPEGFrame...), 3},
+		{"none", []byte("no frames in here"), -1},
+		{"header cut short", silentADTSFrame[:5], -1},
+	}
+	for _, test := range tests {
+		if got := frameStart(test.data); got != test.want {
+			t.Errorf("%s: frameStart() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFinishFrame(t *testing.T) {
+	station := newStation("test", "/stream", testOptions())
+	listener := newTestConnection(4)
+	if err := station.pool.AddConnection(listener); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &frameReader{r: bytes.NewReader(bytes.Repeat(silentADTSFrame, 4))}
+	if _, err := f.Read(make([]byte, 20)); err != nil { // A frame and a bit
+		t.Fatal(err)
+	}
+	station.finishFrame(f, make([]byte, 1024))
+	if chunk := <-listener.bufferChannel; len(chunk.Data) != 12 {
+		t.Errorf("finished the frame with %d bytes, want 12", len(chunk.Data))
+	}
+	if f.needed() != 0 {
+		t.Errorf("still %d bytes of the frame to go", f.needed())
+	}
+
+	// Sources that don't follow frames are cut where they are
+	station.finishFrame(bytes.NewReader(silentADTSFrame[:5]), make([]byte, 1024))
+	if len(listener.bufferChannel) != 0 {
+		t.Error("broadcast from a source that isn't following frames")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// imageType sniffs the type of an image, reporting false for anything that
+// isn't one
+func imageType(image []byte) (string, bool) {
+	contentType := http.DetectContentType(image)
+	return contentType, strings.HasPrefix(contentType, "image/")
+}
+
+// loadLogo reads the station logo given with -logo
+func loadLogo(path string) ([]byte, error) {
+	logo, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if contentType, ok := imageType(logo); !ok {
+		return nil, fmt.Errorf("%s isn't an image, it looks like %s", path, contentType)
+	}
+	return logo, nil
+}
+
+// artwork returns the current track's cover art, or the station logo when
+// it has none, or nil if there is neither
+func (s *Station) artwork() []byte {
+	if current := s.nowPlaying.Load(); current != nil && current.artwork != nil {
+		return current.artwork
+	}
+	return s.logo
+}
+
+// artworkHandler serves the picture to show alongside a station: the cover
+// art embedded in the current track, or else the station logo. ?station=
+// picks the station, the first one by default.
+func artworkHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		station := stations[0]
+		if key := r.URL.Query().Get("station"); key != "" {
+			if station = findStation(stations, key); station == nil {
+				http.Error(w, "Unknown station", http.StatusNotFound)
+				return
+			}
+		}
+
+		image := station.artwork()
+		if image == nil {
+			http.Error(w, "No artwork", http.StatusNotFound)
+			return
+		}
+		contentType, _ := imageType(image)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+		w.Header().Set("Cache-Control", "no-cache") // Changes with the track
+		if _, err := w.Write(image); err != nil {
+			slog.Debug("could not write artwork", "remote_addr", r.RemoteAddr, "error", err)
+		}
+	}
+}
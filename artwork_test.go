@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testPNG = append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...)
+
+func TestLoadLogo(t *testing.T) {
+	if logo, err := loadLogo(writeTestFile(t, "logo.png", testPNG)); err != nil || !bytes.Equal(logo, testPNG) {
+		t.Errorf("loadLogo() = %d bytes, %v", len(logo), err)
+	}
+	if _, err := loadLogo(writeTestFile(t, "logo.png", []byte("not a picture"))); err == nil {
+		t.Error("loadLogo() accepted text")
+	}
+}
+
+// A track's own cover art is shown while it plays, the logo otherwise
+func TestArtworkHandler(t *testing.T) {
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	tests := []struct {
+		name        string
+		logo        []byte
+		tag         ID3Tag
+		status      int
+		contentType string
+		body        []byte
+	}{
+		{"cover art", testPNG, ID3Tag{Picture: gif}, http.StatusOK, "image/gif", gif},
+		{"logo", testPNG, ID3Tag{}, http.StatusOK, "image/png", testPNG},
+		{"cover art that isn't a picture", testPNG, ID3Tag{Picture: []byte("text")}, http.StatusOK, "image/png", testPNG},
+		{"neither", nil, ID3Tag{}, http.StatusNotFound, "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := testOptions()
+			options.Logo = test.logo
+			station := newStation("Test", "/test", options)
+			station.setNowPlaying("track.mp3", test.tag)
+
+			w := httptest.NewRecorder()
+			artworkHandler([]*Station{station})(w, httptest.NewRequest(http.MethodGet, "/artwork?station=test", nil))
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, test.contentType)
+			}
+			if !bytes.Equal(w.Body.Bytes(), test.body) {
+				t.Errorf("served %q, want %q", w.Body, test.body)
+			}
+			if got := station.NowPlaying().Artwork; got != (test.contentType == "image/gif") {
+				t.Errorf("has_artwork = %v", got)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	artworkHandler([]*Station{newStation("Test", "/test", testOptions())})(w, httptest.NewRequest(http.MethodGet, "/artwork?station=missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown station: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// Credentials for HTTP Basic Auth. The zero value disables auth.
+type Credentials struct {
+	User     string
+	Password string
+}
+
+func (c Credentials) enabled() bool {
+	return c.User != "" || c.Password != ""
+}
+
+// matches compares in constant time. Both sides are hashed first so the
+// comparison doesn't leak the length of the real credentials either.
+func (c Credentials) matches(user, password string) bool {
+	wantUser, gotUser := sha256.Sum256([]byte(c.User)), sha256.Sum256([]byte(user))
+	wantPass, gotPass := sha256.Sum256([]byte(c.Password)), sha256.Sum256([]byte(password))
+	userOK := subtle.ConstantTimeCompare(wantUser[:], gotUser[:])
+	passOK := subtle.ConstantTimeCompare(wantPass[:], gotPass[:])
+	return userOK&passOK == 1
+}
+
+// requireAuth wraps next so it only runs for requests carrying the right
+// Basic Auth credentials, everyone else gets a 401
+func requireAuth(credentials Credentials, next http.HandlerFunc) http.HandlerFunc {
+	if !credentials.enabled() {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || !credentials.matches(user, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="GoRadio", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
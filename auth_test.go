@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	credentials := Credentials{User: "dj", Password: "secret"}
+	tests := []struct {
+		name           string
+		credentials    Credentials
+		user, password string
+		sendAuth       bool
+		want           int
+	}{
+		{"right", credentials, "dj", "secret", true, http.StatusOK},
+		{"wrong password", credentials, "dj", "guess", true, http.StatusUnauthorized},
+		{"wrong user", credentials, "listener", "secret", true, http.StatusUnauthorized},
+		{"password prefix", credentials, "dj", "secre", true, http.StatusUnauthorized},
+		{"none sent", credentials, "", "", false, http.StatusUnauthorized},
+		{"empty sent", credentials, "", "", true, http.StatusUnauthorized},
+		{"password only", Credentials{Password: "secret"}, "", "secret", true, http.StatusOK},
+		{"disabled", Credentials{}, "", "", false, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := requireAuth(test.credentials, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+			if test.sendAuth {
+				r.SetBasicAuth(test.user, test.password)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != test.want {
+				t.Errorf("status = %d, want %d", w.Code, test.want)
+			}
+			challenged := w.Header().Get("WWW-Authenticate") != ""
+			if challenged != (test.want == http.StatusUnauthorized) {
+				t.Errorf("WWW-Authenticate = %q on a %d", w.Header().Get("WWW-Authenticate"), w.Code)
+			}
+		})
+	}
+}
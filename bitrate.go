@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	bitrateProbeSize   = 64 * 1024 // bytes read from the head of a file to find its bitrate
+	bitrateProbeFrames = 64
+
+	// PACINGTOLERANCE is how far from real time a stream may be paced, as a
+	// fraction, before it is warned about
+	PACINGTOLERANCE = 0.05
+)
+
+// detectBitrate returns the average bitrate of an audio file in bits per
+// second, worked out from its ADTS/MPEG frame headers, WAV format chunk or
+// Vorbis identification header
+func detectBitrate(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	head, err := readProbe(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var bitrate int
+	switch sniffContentType(head) {
+	case "audio/wav":
+		bitrate = wavBitrate(head)
+	case "audio/ogg":
+		bitrate = vorbisBitrate(head)
+	default:
+		if size := id3v2Size(head); size > 0 {
+			// Cover art can make the tag longer than the probe, so the
+			// frames are read from wherever it ends
+			if _, err := file.Seek(int64(size), io.SeekStart); err != nil {
+				return 0, err
+			}
+			if head, err = readProbe(file); err != nil {
+				return 0, err
+			}
+		}
+		bitrate = framesBitrate(head)
+	}
+
+	if bitrate <= 0 {
+		return 0, fmt.Errorf("could not determine the bitrate of %s", path)
+	}
+	return bitrate, nil
+}
+
+// readProbe reads up to bitrateProbeSize bytes from where r is
+func readProbe(r io.Reader) ([]byte, error) {
+	head := make([]byte, bitrateProbeSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// framesBitrate averages the bitrate over the first few ADTS or MPEG frames,
+// which copes with VBR files as well as CBR ones
+func framesBitrate(b []byte) int {
+	var total, frames int
+	var duration float64
+
+	for len(b) > 0 && frames < bitrateProbeFrames {
+		header, ok := parseADTSHeader(b)
+		if !ok {
+			header, ok = parseMPEGHeader(b)
+		}
+		if !ok || header.length > len(b) {
+			if frames > 0 && ok {
+				break // Truncated final frame
+			}
+			b = b[1:] // Resync on the next byte
+			continue
+		}
+
+		total += header.length
+		duration += float64(header.samples) / float64(header.sampleRate)
+		frames++
+		b = b[header.length:]
+	}
+
+	if duration == 0 {
+		return 0
+	}
+	return int(float64(total*8) / duration)
+}
+
+func wavBitrate(b []byte) int {
+	for b = b[12:]; len(b) >= 8; {
+		id, size := string(b[:4]), int(binary.LittleEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if id == "fmt " && len(b) >= 12 {
+			return int(binary.LittleEndian.Uint32(b[8:12])) * 8 // byte rate
+		}
+		if size+size%2 > len(b) {
+			break
+		}
+		b = b[size+size%2:] // Chunks are word aligned
+	}
+	return 0
+}
+
+func vorbisBitrate(b []byte) int {
+	i := bytes.Index(b, []byte("\x01vorbis"))
+	if i < 0 || len(b) < i+28 {
+		return 0
+	}
+
+	nominal := int32(binary.LittleEndian.Uint32(b[i+20 : i+24]))
+	if nominal > 0 {
+		return int(nominal)
+	}
+	return int(int32(binary.LittleEndian.Uint32(b[i+16 : i+20]))) // maximum
+}
+
+// tickInterval is how long bufferSize bytes last at the given bitrate
+func tickInterval(bufferSize, bitrate int) time.Duration {
+	return time.Duration(bufferSize*8) * time.Second / time.Duration(bitrate)
+}
+
+// trackInterval picks the pacing for a track. An override bitrate always
+// wins, otherwise it is detected, falling back to the fixed delay. It also
+// returns the real-time factor that gives, see realTimeFactor.
+func (s *Station) trackInterval(track string) (time.Duration, float64) {
+	bitrate, err := detectBitrate(track)
+	if s.overrideBitrate > 0 {
+		interval := tickInterval(s.bufferSize, s.overrideBitrate)
+		if err != nil {
+			return interval, 0
+		}
+		return interval, realTimeFactor(s.bufferSize, interval, bitrate)
+	}
+
+	if err != nil {
+		slog.Warn("could not detect bitrate, falling back to fixed ticks", "station", s.Name, "delay", s.delay, "error", err)
+		return s.delay, 0
+	}
+	return tickInterval(s.bufferSize, bitrate), 1
+}
+
+// realTimeFactor is how many seconds of a bitrate bps track are broadcast
+// per second when bufferSize bytes go out every interval: above 1 plays it
+// too fast, below 1 too slow
+func realTimeFactor(bufferSize int, interval time.Duration, bitrate int) float64 {
+	sent := float64(bufferSize*8) / interval.Seconds()
+	return sent / float64(bitrate)
+}
+
+// checkPacing warns at startup if the station's first track would be played
+// noticeably faster or slower than real time, which listeners hear as
+// skipping or as the stream stalling, and suggests what to set instead
+func (s *Station) checkPacing() {
+	if s.playlist == nil || s.onDemand || s.offline.Load() {
+		return
+	}
+	track := s.playlist.CurrentTrack()
+	bitrate, err := detectBitrate(track)
+	switch {
+	case err != nil && s.overrideBitrate == 0:
+		sent := int(float64(s.bufferSize*8) / s.delay.Seconds())
+		slog.Warn("bitrate can't be detected, the stream is paced by -buffer-size and -delay-ms instead, set -bitrate to the track's bitrate if it plays too fast or slow",
+			"station", s.Name, "track", track, "sent_kbps", sent/1000, "error", err)
+	case err != nil:
+		return // -bitrate is all there is to go on
+	default:
+		interval, _ := s.trackInterval(track)
+		factor := realTimeFactor(s.bufferSize, interval, bitrate)
+		if factor < 1-PACINGTOLERANCE || factor > 1+PACINGTOLERANCE {
+			slog.Warn("-bitrate doesn't match the track's, it will play too fast or slow, leave -bitrate out to pace each track to its own",
+				"station", s.Name, "track", track, "bitrate_kbps", s.overrideBitrate/1000, "track_kbps", (bitrate+500)/1000, "real_time_factor", factor)
+		}
+	}
+}
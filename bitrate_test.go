@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// id3Tag is an ID3v2.3 tag padded out to size bytes of frames
+func id3Tag(size int) []byte {
+	tag := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	return append(tag, make([]byte, size)...)
+}
+
+func TestDetectBitrate(t *testing.T) {
+	mp3 := bytes.Repeat(silentMPEGFrame, 100)
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"plain.mp3", mp3, 128000},
+		{"small-tag.mp3", append(id3Tag(1024), mp3...), 128000},
+		{"cover-art.mp3", append(id3Tag(2*bitrateProbeSize), mp3...), 128000}, // The tag alone fills the probe
+		{"silence.wav", append(wavHeader(44100*4), make([]byte, 44100*4)...), 1411200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The silent frames are never padded, a little short of 128 kbps
+			got, err := detectBitrate(writeTestFile(t, test.name, test.data))
+			if err != nil || math.Abs(float64(got-test.want)) > 0.01*float64(test.want) {
+				t.Errorf("detectBitrate() = %d, %v, want about %d", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestDetectBitrateFails(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"garbage.mp3":   bytes.Repeat([]byte("not a frame "), 100),
+		"empty.mp3":     nil,
+		"only-tag.mp3":  id3Tag(1024),
+		"truncated.wav": []byte("RIFF\x00\x00\x00\x00WAVE"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got, err := detectBitrate(writeTestFile(t, name, data)); err == nil {
+				t.Errorf("detectBitrate() = %d, want an error", got)
+			}
+		})
+	}
+}
+
+func TestDetectBitrateMissingFile(t *testing.T) {
+	if _, err := detectBitrate(t.TempDir() + "/missing.mp3"); !os.IsNotExist(err) {
+		t.Errorf("detectBitrate() error = %v, want not exist", err)
+	}
+}
+
+func TestTickInterval(t *testing.T) {
+	tests := []struct {
+		bufferSize, bitrate int
+		want                time.Duration
+	}{
+		{8192, 128000, 512 * time.Millisecond},
+		{8192, 320000, 204800 * time.Microsecond},
+		{1024, 1411200, 1024 * 8 * time.Second / 1411200},
+	}
+	for _, test := range tests {
+		if got := tickInterval(test.bufferSize, test.bitrate); got != test.want {
+			t.Errorf("tickInterval(%d, %d) = %v, want %v", test.bufferSize, test.bitrate, got, test.want)
+		}
+	}
+}
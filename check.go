@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// checkStations goes over stations the way they'd be played, without
+// starting anything: every track must open and be a format that can be
+// streamed, and a TLS pair must load. It writes one line per station and
+// per problem to out, returning the number of problems.
+func checkStations(out io.Writer, stations []*Station, certFile, keyFile string) int {
+	problems := 0
+	report := func(format string, args ...any) {
+		fmt.Fprintf(out, "error: "+format+"\n", args...)
+		problems++
+	}
+
+	summary := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(summary, "MOUNT\tNAME\tSOURCE\tFORMAT\tBITRATE\tTRACKS")
+	for _, station := range stations {
+		source, tracks := station.source, "-"
+		switch {
+		case station.live != nil:
+			source = "stdin"
+		case station.relayURL != "":
+			source = redactURL(station.relayURL)
+		case station.memory != nil:
+			source = "memory"
+		}
+		if station.playlist != nil {
+			tracks = fmt.Sprint(station.playlist.Len())
+		}
+		bitrate := "unknown"
+		if station.bitrate > 0 {
+			bitrate = fmt.Sprintf("%d kbps", (station.bitrate+500)/1000)
+		}
+		fmt.Fprintf(summary, "%s\t%s\t%s\t%s\t%s\t%s\n", station.Mount, station.Name, source, station.responseContentType(), bitrate, tracks)
+	}
+	summary.Flush()
+
+	for _, station := range stations {
+		if station.playlist == nil {
+			continue
+		}
+		for _, track := range station.playlist.Tracks() {
+			if err := checkFile(track); err != nil {
+				report("%s: %v", station.Mount, err)
+				continue
+			}
+			if contentType, err := detectContentType(track); err != nil {
+				if station.overrideType == "" || !errors.Is(err, errUnrecognisedFormat) {
+					report("%s: %v", station.Mount, err)
+				}
+			} else if contentType != station.contentType {
+				report("%s: %s is %s but the stream is %s", station.Mount, track, contentType, station.contentType)
+			}
+		}
+	}
+
+	if certFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			report("TLS: %v", err)
+		}
+	}
+
+	if problems == 0 {
+		fmt.Fprintln(out, "ok")
+	}
+	return problems
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads a YAML config file and applies it to the flags that
+// weren't given on the command line, so flags always win over the file.
+//
+// Keys are flag names. A mapping joins its key to the keys inside it with a
+// dash, so tls: {cert: a.pem} sets -tls-cert. stations is a list of
+// {mount, source} entries, the same as repeating -station. Every problem in
+// the file is returned together rather than just the first.
+func loadConfig(path string, stations *stationFlags) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 { // Empty file
+		return nil
+	}
+
+	// Taken before any setting is applied, flag.Set counts as given too
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var errs []error
+	var values []configValue
+	document := root.Content[0]
+	if document.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping of settings", document.Line)
+	}
+	for i := 0; i < len(document.Content); i += 2 {
+		key, value := document.Content[i], document.Content[i+1]
+		if key.Value == "stations" {
+			entries, err := configStations(value)
+			errs = append(errs, err)
+			if !given["station"] {
+				for _, entry := range entries {
+					// The same checks as -station, e.g. for mounts given twice
+					if err := stations.Set(entry.value); err != nil {
+						errs = append(errs, fmt.Errorf("line %d: %w", entry.line, err))
+					}
+				}
+			}
+			continue
+		}
+		errs = append(errs, flattenConfig(key.Value, value, &values))
+	}
+
+	for _, value := range values {
+		if value.name == "config" || value.name == "station" || flag.Lookup(value.name) == nil {
+			errs = append(errs, fmt.Errorf("line %d: unknown setting %q", value.line, value.name))
+			continue
+		}
+		if given[value.name] {
+			continue
+		}
+		if err := flag.Set(value.name, value.value); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: invalid %s %q: %w", value.line, value.name, value.value, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// configValue is a setting from the config file, named after its flag
+type configValue struct {
+	name  string
+	value string
+	line  int
+}
+
+// flattenConfig collects the scalar settings under node into values, named
+// by their dash joined path
+func flattenConfig(name string, node *yaml.Node, values *[]configValue) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*values = append(*values, configValue{name: name, value: node.Value, line: node.Line})
+		return nil
+	case yaml.MappingNode:
+		var errs []error
+		for i := 0; i < len(node.Content); i += 2 {
+			errs = append(errs, flattenConfig(name+"-"+node.Content[i].Value, node.Content[i+1], values))
+		}
+		return errors.Join(errs...)
+	}
+	return fmt.Errorf("line %d: %s must be a single value", node.Line, name)
+}
+
+// configStations returns the stations entries as mount=source pairs
+func configStations(node *yaml.Node) ([]configValue, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("line %d: stations must be a list of {mount, source}", node.Line)
+	}
+
+	var errs []error
+	var pairs []configValue
+	for _, item := range node.Content {
+		var entry struct {
+			Mount  string `yaml:"mount"`
+			Source string `yaml:"source"`
+		}
+		if err := item.Decode(&entry); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: station: %w", item.Line, err))
+			continue
+		}
+		if entry.Mount == "" || entry.Source == "" {
+			errs = append(errs, fmt.Errorf("line %d: a station needs both mount and source", item.Line))
+			continue
+		}
+		pairs = append(pairs, configValue{name: "station", value: entry.Mount + "=" + entry.Source, line: item.Line})
+	}
+	return pairs, errors.Join(errs...)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withFlags swaps in a fresh command line with a few of main's flags, as
+// loadConfig works on the real one
+func withFlags(t *testing.T, args ...string) (addr, cert *string, listeners *int) {
+	t.Helper()
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("radio", flag.ContinueOnError)
+	addr = flag.String("addr", ":8080", "")
+	cert = flag.String("tls-cert", "", "")
+	listeners = flag.Int("max-listeners", 0, "")
+	flag.String("config", "", "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return addr, cert, listeners
+}
+
+func TestLoadConfig(t *testing.T) {
+	addr, cert, listeners := withFlags(t, "-max-listeners=5")
+	path := writeTestFile(t, "config.yaml", []byte(`
+addr: ":9000"
+tls:
+  cert: cert.pem
+max-listeners: 100 # Given on the command line, which wins
+stations:
+  - mount: /jazz
+    source: jazz.m3u
+  - mount: /rock
+    source: rock.m3u
+`))
+
+	var stations stationFlags
+	if err := loadConfig(path, &stations); err != nil {
+		t.Fatal(err)
+	}
+	if *addr != ":9000" || *cert != "cert.pem" || *listeners != 5 {
+		t.Errorf("addr = %q, tls-cert = %q, max-listeners = %d", *addr, *cert, *listeners)
+	}
+	if want := []string{"/jazz=jazz.m3u", "/rock=rock.m3u"}; !slices.Equal(stations, want) {
+		t.Errorf("stations = %q, want %q", stations, want)
+	}
+}
+
+func TestLoadConfigEmpty(t *testing.T) {
+	addr, _, _ := withFlags(t)
+	var stations stationFlags
+	if err := loadConfig(writeTestFile(t, "config.yaml", nil), &stations); err != nil || *addr != ":8080" || len(stations) != 0 {
+		t.Errorf("loadConfig() = %v, addr %q, stations %q, want nothing changed", err, *addr, stations)
+	}
+}
+
+// Every problem is reported at once, each with its line
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errs   []string
+	}{
+		{"unknown and invalid", "bogus: 1\nmax-listeners: lots\n", []string{`line 1: unknown setting "bogus"`, `line 2: invalid max-listeners "lots"`}},
+		{"not a value", "addr: [a, b]\n", []string{"line 1: addr must be a single value"}},
+		{"incomplete station", "stations:\n  - mount: /jazz\n", []string{"line 2: a station needs both mount and source"}},
+		{"stations not a list", "stations: /jazz\n", []string{"line 1: stations must be a list"}},
+		{"duplicate mount", "stations:\n  - {mount: /jazz, source: a.m3u}\n  - {mount: jazz, source: b.m3u}\n", []string{"line 3: ", "given twice"}},
+		{"reserved mount", "stations:\n  - {mount: /stats, source: a.m3u}\n  - {mount: /admin/x, source: b.m3u}\n", []string{"line 2: ", "/stats endpoint", "line 3: ", "/admin endpoint"}},
+		{"not a mapping", "- a\n- b\n", []string{"line 1: expected a mapping"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFlags(t)
+			var stations stationFlags
+			err := loadConfig(writeTestFile(t, "config.yaml", []byte(test.config)), &stations)
+			if err == nil {
+				t.Fatal("loadConfig() succeeded")
+			}
+			for _, want := range test.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
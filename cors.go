@@ -0,0 +1,28 @@
+package main
+
+import "net/http"
+
+// allowCORS lets browsers on origin fetch next cross-origin, answering
+// preflight requests itself. An empty origin disables CORS.
+func allowCORS(origin string, next http.HandlerFunc) http.HandlerFunc {
+	if origin == "" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Set before next runs so the header goes out with the first flush
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "icy-metaint, icy-name, icy-genre, icy-url, icy-br, X-Resume-Token")
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Icy-MetaData, Range, X-Latency")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAllowCORS(t *testing.T) {
+	tests := []struct {
+		name       string
+		origin     string
+		method     string
+		wantStatus int
+		wantVary   bool
+	}{
+		{"get", "https://player.example", http.MethodGet, http.StatusOK, true},
+		{"preflight", "https://player.example", http.MethodOptions, http.StatusNoContent, true},
+		{"any origin", "*", http.MethodGet, http.StatusOK, false},
+		{"any origin preflight", "*", http.MethodOptions, http.StatusNoContent, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			handler := allowCORS(test.origin, func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(test.method, "/stream", nil))
+
+			if w.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, test.wantStatus)
+			}
+			if preflight := test.method == http.MethodOptions; called == preflight {
+				t.Errorf("stream handler called = %v for %s", called, test.method)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.origin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, test.origin)
+			}
+			if got := w.Header().Get("Access-Control-Expose-Headers"); got == "" {
+				t.Error("icy-* headers not exposed")
+			}
+			if got := w.Header().Get("Vary") == "Origin"; got != test.wantVary {
+				t.Errorf("Vary = %q, want Origin: %v", w.Header().Get("Vary"), test.wantVary)
+			}
+			allowed := w.Header().Get("Access-Control-Allow-Methods")
+			if test.method == http.MethodOptions && allowed != "GET, OPTIONS" {
+				t.Errorf("Access-Control-Allow-Methods = %q on a preflight", allowed)
+			}
+			headers := w.Header().Get("Access-Control-Allow-Headers")
+			if test.method == http.MethodOptions && !strings.Contains(headers, "X-Latency") {
+				t.Errorf("Access-Control-Allow-Headers = %q, players can't ask for a latency", headers)
+			}
+		})
+	}
+}
+
+func TestAllowCORSDisabled(t *testing.T) {
+	handler := allowCORS("", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodOptions, "/stream", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight answered with %d and origin %q while CORS is off", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
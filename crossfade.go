@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Crossfading mixes PCM samples, so it only works for 16-bit PCM WAV tracks.
+// Anything else is played back to back as before. The crossfaded stream is
+// raw PCM: the WAV headers of the individual tracks are left out, as a
+// header in the middle of the stream would be played as noise.
+
+// wavMaxFormatSize caps the fmt chunk read into memory. Real ones are 16
+// to 40 bytes, WAVE_FORMAT_EXTENSIBLE included.
+const wavMaxFormatSize = 1024
+
+type wavFormat struct {
+	audioFormat   int // 1 is integer PCM
+	channels      int
+	sampleRate    int
+	bitsPerSample int
+	blockAlign    int    // bytes per sample frame, all channels
+	dataSize      int64  // bytes of PCM in the data chunk
+	fmtChunk      []byte // body of the fmt chunk as it was read
+}
+
+func (f wavFormat) mixable() bool {
+	return f.audioFormat == 1 && f.bitsPerSample == 16 && f.blockAlign > 0
+}
+
+func (f wavFormat) sameAs(other wavFormat) bool {
+	return f.channels == other.channels && f.sampleRate == other.sampleRate && f.bitsPerSample == other.bitsPerSample
+}
+
+// readWAVHeader reads the RIFF header and every chunk up to the data chunk,
+// leaving r at the first PCM byte
+func readWAVHeader(r io.Reader) (wavFormat, error) {
+	var format wavFormat
+	riff := make([]byte, 12)
+	if _, err := io.ReadFull(r, riff); err != nil {
+		return format, err
+	}
+	if string(riff[:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return format, errors.New("not a WAV file")
+	}
+
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return format, err
+		}
+		id, size := string(chunk[:4]), int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		if id == "data" {
+			format.dataSize = size
+			return format, nil
+		}
+
+		if id != "fmt " || size > wavMaxFormatSize {
+			// Only fmt is needed, anything else, e.g. a LIST of tags or a
+			// huge bogus size, is skipped without holding it in memory
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return format, err
+			}
+			continue
+		}
+
+		body := make([]byte, size+size%2) // Chunks are word aligned
+		if _, err := io.ReadFull(r, body); err != nil {
+			return format, err
+		}
+		if size >= 16 {
+			format.fmtChunk = body[:size]
+			format.audioFormat = int(binary.LittleEndian.Uint16(body[0:]))
+			format.channels = int(binary.LittleEndian.Uint16(body[2:]))
+			format.sampleRate = int(binary.LittleEndian.Uint32(body[4:]))
+			format.blockAlign = int(binary.LittleEndian.Uint16(body[12:]))
+			format.bitsPerSample = int(binary.LittleEndian.Uint16(body[14:]))
+		}
+	}
+}
+
+// crossfadeSource wraps a freshly opened track so that its head is mixed
+// with the tail held back from the previous track, and its own tail is held
+// back in turn for the next one. It runs on the stream goroutine.
+func (s *Station) crossfadeSource(file io.Reader) io.Reader {
+	tail, tailFormat := s.fadeTail, s.fadeFormat
+	s.fadeTail = nil
+
+	source := bufio.NewReader(file)
+	if magic, _ := source.Peek(12); sniffContentType(magic) != "audio/wav" {
+		// Nothing to mix with, play out the held tail first
+		return io.MultiReader(bytes.NewReader(tail), source)
+	}
+
+	format, err := readWAVHeader(source)
+	if err != nil || !format.mixable() {
+		return io.MultiReader(bytes.NewReader(tail), source)
+	}
+
+	fadeLength := int64(s.crossfade.Seconds()*float64(format.sampleRate)) * int64(format.blockAlign)
+	fadeLength = min(fadeLength, format.dataSize/2/int64(format.blockAlign)*int64(format.blockAlign))
+
+	head, consumed := tail, 0
+	if tail != nil && tailFormat.sameAs(format) {
+		incoming := make([]byte, min(int64(len(tail)), format.dataSize-fadeLength))
+		consumed, _ = io.ReadFull(source, incoming)
+		head = mixPCM16(tail, incoming[:consumed])
+	}
+
+	return io.MultiReader(
+		bytes.NewReader(head),
+		io.LimitReader(source, max(format.dataSize-int64(consumed)-fadeLength, 0)),
+		tailReader(func() error {
+			held := make([]byte, fadeLength)
+			n, err := io.ReadFull(source, held)
+			s.fadeTail, s.fadeFormat = held[:n], format
+			if err == io.ErrUnexpectedEOF {
+				err = nil // A short file just gives a shorter fade
+			}
+			return err
+		}),
+	)
+}
+
+// flushFadeTail broadcasts the end of the last crossfaded track, held back
+// to mix into a next track that isn't coming because the playlist has been
+// played, a chunk a tick like the rest of the track
+func (s *Station) flushFadeTail(ctx context.Context, buffer []byte, ticker *time.Ticker) {
+	tail := s.fadeTail
+	s.fadeTail = nil
+	for len(tail) > 0 {
+		n := copy(buffer, tail)
+		tail = tail[n:]
+		s.pool.Broadcast(buffer[:n])
+		s.lastBroadcast.Store(time.Now().UnixNano())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tailReader runs its function once, in place of reading, when a
+// MultiReader reaches it, then reports EOF
+type tailReader func() error
+
+func (t tailReader) Read([]byte) (int, error) {
+	if err := t(); err != nil {
+		return 0, err
+	}
+	return 0, io.EOF
+}
+
+// mixPCM16 mixes outgoing and incoming 16-bit little endian samples with
+// linear gain ramps: outgoing fades from full volume to silence across its
+// length while incoming fades in. incoming may be shorter than outgoing.
+func mixPCM16(outgoing, incoming []byte) []byte {
+	mixed := make([]byte, len(outgoing))
+	samples := len(outgoing) / 2
+	for i := 0; i < samples; i++ {
+		gain := float64(i) / float64(samples)
+		sample := float64(int16(binary.LittleEndian.Uint16(outgoing[2*i:]))) * (1 - gain)
+		if 2*i+1 < len(incoming) {
+			sample += float64(int16(binary.LittleEndian.Uint16(incoming[2*i:]))) * gain
+		}
+		sample = math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(sample)))
+		binary.LittleEndian.PutUint16(mixed[2*i:], uint16(int16(sample)))
+	}
+	return mixed
+}
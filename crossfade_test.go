@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wavChunk is a RIFF chunk claiming size bytes, holding body
+func wavChunk(id string, size uint32, body []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32([]byte(id), size), body...)
+}
+
+func TestReadWAVHeader(t *testing.T) {
+	header := wavHeader(1000)
+	riff, format, data := header[:12], header[12:36], header[36:]
+	tests := []struct {
+		name string
+		wav  []byte
+		ok   bool
+	}{
+		{"plain", header, true},
+		{"list before data", bytes.Join([][]byte{riff, format, wavChunk("LIST", 5, []byte("INFOx\x00")), data}, nil), true}, // Odd sizes are padded
+		{"huge chunk", bytes.Join([][]byte{riff, format, wavChunk("junk", 0xFFFFFFF0, make([]byte, 64))}, nil), false},
+		{"huge fmt", bytes.Join([][]byte{riff, wavChunk("fmt ", 0xFFFFFFF0, make([]byte, 64))}, nil), false},
+		{"no data", bytes.Join([][]byte{riff, format}, nil), false},
+		{"not riff", append([]byte("RIFX"), header[4:]...), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readWAVHeader(bytes.NewReader(test.wav))
+			if !test.ok {
+				if err == nil {
+					t.Errorf("readWAVHeader() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.mixable() || got.channels != silenceChannels || got.sampleRate != silenceSampleRate || got.dataSize != 1000 {
+				t.Errorf("readWAVHeader() = %+v", got)
+			}
+		})
+	}
+}
+
+// pcmWAV is a 16-bit stereo WAV at the silence sample rate, every sample
+// set to value
+func pcmWAV(duration time.Duration, value int16) []byte {
+	samples := int(duration.Seconds() * silenceSampleRate * silenceChannels)
+	wav := wavHeader(2 * samples)
+	for range samples {
+		wav = binary.LittleEndian.AppendUint16(wav, uint16(value))
+	}
+	return wav
+}
+
+func sampleAt(pcm []byte, i int) int16 {
+	return int16(binary.LittleEndian.Uint16(pcm[2*i:]))
+}
+
+func TestCrossfadeSource(t *testing.T) {
+	const byteRate = silenceSampleRate * silenceChannels * 2
+	tests := []struct {
+		name      string
+		crossfade time.Duration
+		track     time.Duration
+		fade      int // bytes
+	}{
+		{"short fade", 100 * time.Millisecond, 500 * time.Millisecond, byteRate / 10},
+		{"half a track at most", time.Second, 500 * time.Millisecond, byteRate / 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := testOptions()
+			options.Crossfade = test.crossfade
+			station := newStation("Test", "/test", options)
+
+			first, err := io.ReadAll(station.crossfadeSource(bytes.NewReader(pcmWAV(test.track, 10000))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := io.ReadAll(station.crossfadeSource(bytes.NewReader(pcmWAV(test.track, -10000))))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Every track is shortened by the fade it shares with the next
+			want := int(test.track.Seconds()*byteRate) - test.fade
+			if len(first) != want || len(second) != want {
+				t.Fatalf("tracks are %d and %d bytes, want %d", len(first), len(second), want)
+			}
+			if len(station.fadeTail) != test.fade {
+				t.Errorf("%d bytes held back for the next fade, want %d", len(station.fadeTail), test.fade)
+			}
+			if first[0] != 0x10 || sampleAt(first, 0) != 10000 {
+				t.Errorf("first track starts at %d, nothing to fade from", sampleAt(first, 0))
+			}
+
+			// The second track ramps from the first's samples to its own
+			samples := test.fade / 2
+			for i, want := range map[int]int16{0: 10000, samples / 2: 0, samples - 1: -10000, len(second)/2 - 1: -10000} {
+				if got := sampleAt(second, i); got < want-2 || got > want+2 {
+					t.Errorf("sample %d of the second track = %d, want about %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Pacing follows the bytes broadcast, so a second of crossfaded audio takes
+// a second to arrive however many fades it spans, behind one streaming WAV
+// header
+func TestCrossfadePacing(t *testing.T) {
+	const byteRate = silenceSampleRate * silenceChannels * 2
+	var playlist []byte
+	for _, value := range []int16{1000, -1000} {
+		track := writeTestFile(t, "track.wav", pcmWAV(300*time.Millisecond, value))
+		playlist = append(playlist, track+"\n"...)
+	}
+	options := testOptions()
+	options.BufferSize = byteRate / 10
+	options.Crossfade = 100 * time.Millisecond
+	station, err := NewStation("Test", "/test", writeTestFile(t, "fades.m3u", playlist), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	for deadline := time.Now().Add(time.Second); station.wavHeader.Load() == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no streaming WAV header for the first track")
+		}
+	}
+
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if got := response.Header.Get("Content-Type"); got != "audio/wav" {
+		t.Errorf("Content-Type = %q, want audio/wav", got)
+	}
+
+	header := make([]byte, 44)
+	if _, err := io.ReadFull(response.Body, header); err != nil {
+		t.Fatal(err)
+	}
+	if string(header[:4]) != "RIFF" || binary.LittleEndian.Uint32(header[40:]) != WAVSTREAMSIZE {
+		t.Fatalf("stream starts with %q, want a streaming WAV header", header)
+	}
+
+	start := time.Now()
+	audio := make([]byte, byteRate)
+	if _, err := io.ReadFull(response.Body, audio); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond || elapsed > 1300*time.Millisecond {
+		t.Errorf("a second of audio, across 5 fades, took %v", elapsed)
+	}
+	if bytes.Contains(audio, []byte("RIFF")) {
+		t.Error("a track's WAV header was broadcast as audio")
+	}
+}
+
+// The tail held back for a next track still goes out once a playlist that
+// doesn't loop has been played, so only the overlaps are shorter
+func TestCrossfadeTailFlushedAtEnd(t *testing.T) {
+	const byteRate = silenceSampleRate * silenceChannels * 2
+	var playlist []byte
+	for _, value := range []int16{1000, -1000} {
+		track := writeTestFile(t, "track.wav", pcmWAV(300*time.Millisecond, value))
+		playlist = append(playlist, track+"\n"...)
+	}
+	options := testOptions()
+	options.BufferSize = byteRate / 10
+	options.Crossfade = 100 * time.Millisecond
+	options.OnEOF = EOFEXIT
+	options.Bitrate = 100_000_000 // Rather than in real time
+	station, err := NewStation("Test", "/test", writeTestFile(t, "fades.m3u", playlist), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newTestConnection(32)
+	if err := station.pool.AddConnection(listener); err != nil {
+		t.Fatal(err)
+	}
+	station.stream(context.Background())
+	station.pool.Close()
+
+	var received []byte
+	for chunk := range listener.bufferChannel {
+		received = append(received, chunk.Data...)
+	}
+	track, fade := 3*byteRate/10, byteRate/10
+	if want := 2*track - fade; len(received) != want {
+		t.Fatalf("broadcast %d bytes of PCM, want %d", len(received), want)
+	}
+	if got := sampleAt(received, len(received)/2-1); got != -1000 {
+		t.Errorf("stream ends on sample %d, want the last track's own %d", got, -1000)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+// playedTrack returns the path of the track playing, or of one in the
+// history, by file name as /nowplaying and /history show it. An empty name
+// is the track playing.
+func (s *Station) playedTrack(file string) (string, bool) {
+	if current := s.nowPlaying.Load(); current != nil && (file == "" || current.File == file) {
+		return current.path, true
+	}
+	if file == "" {
+		return "", false
+	}
+	for _, entry := range s.history.Entries() {
+		if entry.File == file && entry.path != "" {
+			return entry.path, true
+		}
+	}
+	return "", false
+}
+
+// downloadHandler serves the track playing, or one recently played with
+// ?track=file name, as a download. Only tracks the station has played can
+// be fetched, and only from inside mediaRoot, so downloads are refused when
+// no root is configured. ?station= picks the station, the first one by
+// default.
+func downloadHandler(stations []*Station, mediaRoot string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if mediaRoot == "" {
+			http.Error(w, "Downloading tracks needs -media-root", http.StatusForbidden)
+			return
+		}
+		station := stations[0]
+		if key := r.URL.Query().Get("station"); key != "" {
+			if station = findStation(stations, key); station == nil {
+				http.Error(w, "Unknown station", http.StatusNotFound)
+				return
+			}
+		}
+
+		track, ok := station.playedTrack(r.URL.Query().Get("track"))
+		if !ok {
+			http.Error(w, "No such track", http.StatusNotFound)
+			return
+		}
+		path, err := resolveLocalPath(mediaRoot, track)
+		if err != nil {
+			slog.Info("refused download from outside the media root", "station", station.Name, "track", track, "remote_addr", r.RemoteAddr)
+			http.Error(w, "No such track", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+		serveTrack(w, r, station, path)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadHandler(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{"past.mp3": "past track", "current.mp3": "current track"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside := writeTestFile(t, "outside.mp3", []byte("outside the root"))
+	station := newStation("test", "/stream", testOptions())
+	station.setNowPlaying(outside, ID3Tag{})
+	station.finishTrack()
+	station.setNowPlaying(filepath.Join(root, "past.mp3"), ID3Tag{})
+	station.finishTrack()
+	station.setNowPlaying(filepath.Join(root, "current.mp3"), ID3Tag{})
+	stations := []*Station{station}
+
+	tests := []struct {
+		name, root, query string
+		status            int
+		body              string
+	}{
+		{"the track playing", root, "", http.StatusOK, "current track"},
+		{"a past track", root, "?track=past.mp3", http.StatusOK, "past track"},
+		{"by station", root, "?station=test&track=current.mp3", http.StatusOK, "current track"},
+		{"never played", root, "?track=other.mp3", http.StatusNotFound, ""},
+		{"a path", root, "?track=../outside.mp3", http.StatusNotFound, ""},
+		{"outside the media root", root, "?track=outside.mp3", http.StatusNotFound, ""},
+		{"unknown station", root, "?station=other", http.StatusNotFound, ""},
+		{"no media root", "", "", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			downloadHandler(stations, test.root)(w, httptest.NewRequest(http.MethodGet, "/download"+test.query, nil))
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			if got := w.Body.String(); got != test.body {
+				t.Errorf("body %q, want %q", got, test.body)
+			}
+			if got := w.Header().Get("Content-Disposition"); got == "" {
+				t.Error("not sent as an attachment")
+			}
+		})
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "current.mp3")
+	if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	station := newStation("test", "/stream", testOptions())
+	station.setNowPlaying(path, ID3Tag{})
+
+	r := httptest.NewRequest(http.MethodGet, "/download", nil)
+	r.Header.Set("Range", "bytes=2-5")
+	w := httptest.NewRecorder()
+	downloadHandler([]*Station{station}, root)(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+		t.Errorf("Range answered %d %q, want 206 \"2345\"", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename=current.mp3`; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// drainable reports whether the station is playing tracks that have an end
+// to wait for. Live, relayed and offline stations just stop, as do those
+// holding listeners once their playlist has ended, which never finish.
+func (s *Station) drainable() bool {
+	return s.playlist != nil && s.live == nil && s.relayURL == "" && !s.offline.Load() && !s.ended.Load() && !s.onDemand
+}
+
+// drainStations has every station stop once its current track has been
+// broadcast, for -drain-on-shutdown, and waits for those with a track
+// playing to get there, or for timeout. A paused station only finishes its
+// track if it's resumed in time.
+func drainStations(stations []*Station, timeout time.Duration) {
+	var waiting []*Station
+	for _, station := range stations {
+		station.draining.Store(true)
+		if station.drainable() {
+			waiting = append(waiting, station)
+		}
+	}
+	if len(waiting) == 0 {
+		return
+	}
+	slog.Info("finishing the current tracks before shutting down", "stations", len(waiting), "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, station := range waiting {
+		select {
+		case <-station.stopped:
+		case <-ctx.Done():
+			slog.Warn("not every track finished in time, cutting them off", "station", station.Name, "timeout", timeout)
+			return
+		}
+	}
+	slog.Info("current tracks finished")
+}
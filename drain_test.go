@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Listeners already connected when the drain starts hear the rest of the
+// track, then the stream ends rather than going round again
+func TestDrainFinishesTrack(t *testing.T) {
+	track := bytes.Repeat(silentMPEGFrame, 20) // About half a second at 128kbps
+	for i := range track {
+		if i%len(silentMPEGFrame) >= 4 {
+			track[i] = byte(i)
+		}
+	}
+	station, err := NewStation("test", "/stream", writeTestFile(t, "track.mp3", track), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	received := make([]byte, 100)
+	if _, err := io.ReadFull(resp.Body, received); err != nil {
+		t.Fatal(err)
+	}
+
+	drainStations([]*Station{station}, 5*time.Second)
+	select {
+	case <-station.stopped:
+	default:
+		t.Fatal("drainStations() returned before the track finished")
+	}
+	station.pool.Close()
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream didn't end cleanly: %v", err)
+	}
+	received = append(received, rest...)
+	if !bytes.HasSuffix(track, received) || len(received) < len(track)/2 {
+		t.Errorf("listener got %d bytes, want the rest of the %d byte track and no more", len(received), len(track))
+	}
+}
+
+// A station that can't finish its track, here a paused one, is cut off
+// after the timeout
+func TestDrainTimeout(t *testing.T) {
+	station, err := NewStation("test", "/stream", silenceFile(t, "silence.mp3", time.Second), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	station.paused.Store(true)
+	runStation(t, station)
+
+	start := time.Now()
+	drainStations([]*Station{station}, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("drainStations() took %v, want the 100ms timeout", elapsed)
+	}
+	if !station.draining.Load() {
+		t.Error("station wasn't told to stop after its track")
+	}
+}
+
+// A station holding listeners after its playlist has no track to finish, so
+// shutting down doesn't wait out the timeout for it
+func TestDrainHeldStation(t *testing.T) {
+	options := testOptions()
+	options.OnEOF = EOFHOLD
+	options.OfflineAudio = []byte("offline")
+	station, err := NewStation("test", "/stream", writeTestFile(t, "track.mp3", append(silentMPEGFrame[:4:4], "track"...)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	waitFor(t, "the playlist to end", station.ended.Load)
+
+	start := time.Now()
+	drainStations([]*Station{station}, 5*time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drainStations() waited %v for a held station", elapsed)
+	}
+}
+
+// Stations without tracks to finish aren't waited for
+func TestDrainNothingToFinish(t *testing.T) {
+	station := newStation("live", "/live", testOptions())
+	start := time.Now()
+	drainStations([]*Station{station}, time.Second)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("drainStations() waited %v for a station without a playlist", elapsed)
+	}
+	if !station.draining.Load() {
+		t.Error("station wasn't told to stop")
+	}
+}
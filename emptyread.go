@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	EMPTYREADS       = 3 // reads in a row that may return nothing before the source is waited on
+	EMPTYREADMINWAIT = time.Millisecond
+	EMPTYREADMAXWAIT = 100 * time.Millisecond
+)
+
+// emptyReads keeps a source whose reads return neither data nor an error
+// from spinning the loop reading it. io.Reader allows the odd empty read,
+// so the first few are retried straight away, without broadcasting anything
+// or waiting for a tick. After that each one backs off a little longer.
+type emptyReads struct {
+	count int
+	wait  *backoff
+}
+
+func newEmptyReads() *emptyReads {
+	return &emptyReads{wait: newBackoff(EMPTYREADMINWAIT, EMPTYREADMAXWAIT)}
+}
+
+// record notes a read of n bytes, waiting if it was one empty read too
+// many. It returns ctx's error if ctx is cancelled while waiting.
+func (e *emptyReads) record(ctx context.Context, n int) error {
+	if n > 0 {
+		if e.count > 0 {
+			e.count = 0
+			e.wait.reset()
+		}
+		return nil
+	}
+	e.count++
+	if e.count <= EMPTYREADS {
+		return nil
+	}
+	select {
+	case <-time.After(e.wait.next()):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestEmptyReads(t *testing.T) {
+	idle := newEmptyReads()
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < EMPTYREADS; i++ {
+		idle.record(ctx, 0)
+	}
+	if elapsed := time.Since(start); elapsed >= EMPTYREADMINWAIT/2 {
+		t.Errorf("the first %d empty reads waited %v", EMPTYREADS, elapsed)
+	}
+	start = time.Now()
+	idle.record(ctx, 0)
+	if elapsed := time.Since(start); elapsed < EMPTYREADMINWAIT/2 {
+		t.Errorf("empty read %d waited %v, want a backoff", EMPTYREADS+1, elapsed)
+	}
+
+	idle.record(ctx, 10) // Data starts the count again
+	if idle.count != 0 {
+		t.Errorf("count = %d after a read with data", idle.count)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	idle.count = EMPTYREADS
+	if err := idle.record(cancelled, 0); err != context.Canceled {
+		t.Errorf("record() = %v once cancelled, want %v", err, context.Canceled)
+	}
+}
+
+// emptyReader returns nothing, and no error, from every other read
+type emptyReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (e *emptyReader) Read(p []byte) (int, error) {
+	e.reads++
+	if e.reads%2 == 1 {
+		return 0, nil
+	}
+	return e.r.Read(p)
+}
+
+// Empty reads are neither broadcast nor waited a tick for
+func TestStreamTrackEmptyReads(t *testing.T) {
+	audio := bytes.Repeat([]byte("0123456789"), 100)
+	options := testOptions()
+	options.BufferSize = 100
+	station := newStation("test", "/stream", options)
+	listener := newTestConnection(len(audio))
+	if err := station.pool.AddConnection(listener); err != nil {
+		t.Fatal(err)
+	}
+	ticker := time.NewTicker(options.Delay)
+	defer ticker.Stop()
+
+	if err := station.streamTrack(context.Background(), &emptyReader{r: bytes.NewReader(audio)}, make([]byte, options.BufferSize), ticker, options.Delay, nil); err != nil {
+		t.Fatal(err)
+	}
+	station.pool.Close()
+	var received []byte
+	for chunk := range listener.bufferChannel {
+		if len(chunk.Data) == 0 {
+			t.Error("an empty chunk was broadcast")
+		}
+		received = append(received, chunk.Data...)
+	}
+	if !bytes.Equal(received, audio) {
+		t.Errorf("received %d bytes, want the %d read", len(received), len(audio))
+	}
+}
+
+// stalledReader never returns anything, counting how often it's asked
+type stalledReader struct{ reads int }
+
+func (s *stalledReader) Read(p []byte) (int, error) {
+	s.reads++
+	return 0, nil
+}
+
+// A source stuck returning nothing is backed off from rather than spun on
+func TestStreamTrackDoesNotSpin(t *testing.T) {
+	options := testOptions()
+	station := newStation("test", "/stream", options)
+	ticker := time.NewTicker(options.Delay)
+	defer ticker.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	source := &stalledReader{}
+	if err := station.streamTrack(ctx, source, make([]byte, options.BufferSize), ticker, options.Delay, nil); err != context.DeadlineExceeded {
+		t.Fatalf("streamTrack() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if source.reads > 20 { // Backing off to EMPTYREADMAXWAIT takes about ten
+		t.Errorf("read a stalled source %d times in 300ms", source.reads)
+	}
+}
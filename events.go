@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EVENTBUFFER    = 16               // events queued per subscriber before it misses some
+	EVENTKEEPALIVE = 15 * time.Second // comment sent to idle /events clients so proxies keep them open
+)
+
+// Event is a change to a station pushed to /events clients
+type Event struct {
+	Type       string      `json:"type"` // "track" or "listeners"
+	Station    string      `json:"station"`
+	Mount      string      `json:"mount"`
+	NowPlaying *NowPlaying `json:"now_playing,omitempty"`
+	Listeners  int         `json:"listeners"`
+}
+
+// EventBus fans station events out to every subscriber. A subscriber that
+// isn't keeping up misses events rather than holding up the station. A nil
+// bus drops everything.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel of every event published from now on, until
+// Unsubscribe is called with it. The channel is closed when the bus is.
+func (b *EventBus) Subscribe() chan Event {
+	events := make(chan Event, EVENTBUFFER)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(events)
+		return events
+	}
+	b.subscribers[events] = struct{}{}
+	return events
+}
+
+func (b *EventBus) Unsubscribe(events chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, events)
+}
+
+// Close ends every subscription, for shutdown
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for events := range b.subscribers {
+		close(events)
+		delete(b.subscribers, events)
+	}
+}
+
+// Publish sends event to every subscriber without blocking
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// trackEvent describes the station's current track
+func (s *Station) trackEvent() Event {
+	nowPlaying := s.NowPlaying()
+	return Event{Type: "track", Station: s.Name, Mount: s.Mount, NowPlaying: &nowPlaying, Listeners: s.pool.Count()}
+}
+
+// eventsHandler streams station events as Server-Sent Events, one JSON
+// object per data: line, so a player page can update without polling
+// /nowplaying. Every station's current track is sent first. ?station= only
+// streams that station's events.
+func eventsHandler(stations []*Station, bus *EventBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		controller := http.NewResponseController(w)
+		if !flushable(w) {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		var only *Station
+		if key := r.URL.Query().Get("station"); key != "" {
+			if only = findStation(stations, key); only == nil {
+				http.Error(w, "Unknown station", http.StatusNotFound)
+				return
+			}
+		}
+
+		// Subscribed before the current state is sent, so no change can
+		// fall between the two
+		events := bus.Subscribe()
+		defer bus.Unsubscribe(events)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		send := func(event Event) error {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return err
+			}
+			return controller.Flush()
+		}
+
+		for _, station := range stations {
+			if only == nil || station == only {
+				if err := send(station.trackEvent()); err != nil {
+					return
+				}
+			}
+		}
+
+		keepalive := time.NewTicker(EVENTKEEPALIVE)
+		defer keepalive.Stop()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok { // Shutting down
+					return
+				}
+				if only != nil && event.Mount != only.Mount {
+					continue
+				}
+				if err := send(event); err != nil {
+					slog.Debug("events client disconnected", "remote_addr", r.RemoteAddr, "error", err)
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				if err := controller.Flush(); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
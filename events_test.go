@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func subscribers(bus *EventBus) int {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return len(bus.subscribers)
+}
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	first, second := bus.Subscribe(), bus.Subscribe()
+	bus.Publish(Event{Type: "listeners", Mount: "/stream", Listeners: 1})
+	for _, events := range []chan Event{first, second} {
+		if event := <-events; event.Listeners != 1 {
+			t.Errorf("received %+v", event)
+		}
+	}
+
+	// A subscriber that isn't reading misses events, without holding up
+	// the one that is
+	for i := 0; i < EVENTBUFFER+5; i++ {
+		bus.Publish(Event{Type: "listeners", Listeners: i})
+		<-second
+	}
+	if len(first) != EVENTBUFFER {
+		t.Errorf("%d events queued, want %d", len(first), EVENTBUFFER)
+	}
+
+	bus.Unsubscribe(second)
+	if subscribers(bus) != 1 {
+		t.Errorf("%d subscribers after unsubscribing, want 1", subscribers(bus))
+	}
+	bus.Close()
+	for range first {
+	}
+	if _, ok := <-bus.Subscribe(); ok {
+		t.Error("subscribing to a closed bus gave an open channel")
+	}
+
+	var none *EventBus
+	none.Publish(Event{Type: "track"}) // Dropped
+}
+
+// A client sees each station's current track, then the change when the
+// next one starts, and leaves the bus when it hangs up
+func TestEventsStream(t *testing.T) {
+	bus := NewEventBus()
+	options := testOptions()
+	options.Events = bus
+	options.Bitrate = 128000 // Plays in real time
+	station, err := NewStation("Test", "/test", silenceFile(t, "playing.mp3", 30*time.Second), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(eventsHandler([]*Station{station}, bus))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() Event {
+		t.Helper()
+		for lines.Scan() {
+			if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+				var event Event
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					t.Fatal(err)
+				}
+				return event
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return Event{}
+	}
+
+	if event := next(); event.Type != "track" || event.Mount != "/test" || event.NowPlaying == nil || event.NowPlaying.File != "" {
+		t.Errorf("first event = %+v, want the station with nothing playing yet", event)
+	}
+	runStation(t, station)
+	for {
+		event := next()
+		if event.Type != "track" {
+			continue // Listener counts
+		}
+		if event.NowPlaying == nil || event.NowPlaying.File != "playing.mp3" || event.Station != "Test" {
+			t.Errorf("track event = %+v, want playing.mp3 on Test", event)
+		}
+		break
+	}
+
+	cancel()
+	waitFor(t, "the client to unsubscribe", func() bool { return subscribers(bus) == 0 })
+}
+
+func TestEventsUnknownStation(t *testing.T) {
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, testOptions())
+	w := httptest.NewRecorder()
+	eventsHandler([]*Station{station}, NewEventBus())(w, httptest.NewRequest(http.MethodGet, "/events?station=missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
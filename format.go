@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errUnrecognisedFormat = errors.New("unrecognised audio format")
+
+var extensionContentTypes = map[string]string{
+	".aac": "audio/aac",
+	".mp3": "audio/mpeg",
+	".ogg": "audio/ogg",
+	".oga": "audio/ogg",
+	".wav": "audio/wav",
+}
+
+// detectContentType sniffs the audio format from the file's magic bytes,
+// falling back to its extension when the header isn't recognised
+func detectContentType(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 12)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	if contentType := sniffContentType(header[:n]); contentType != "" {
+		return contentType, nil
+	}
+	if contentType, ok := extensionContentTypes[strings.ToLower(filepath.Ext(path))]; ok {
+		return contentType, nil
+	}
+	return "", fmt.Errorf("%w: %s", errUnrecognisedFormat, path)
+}
+
+func sniffContentType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return "audio/mpeg"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return "audio/ogg"
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return "audio/wav"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xF6 == 0xF0:
+		return "audio/aac" // ADTS sync word with layer 00
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		return "audio/mpeg" // MPEG audio frame sync
+	}
+	return ""
+}
+
+// playlistContentType returns the content type of the first readable track.
+// A connection can't change type mid-stream, so later tracks that differ are
+// only warned about.
+func playlistContentType(playlist *Playlist) (string, error) {
+	var contentType string
+	var firstErr error
+	for _, track := range playlist.Tracks() {
+		other, err := detectContentType(track)
+		switch {
+		case err != nil:
+			firstErr = cmp.Or(firstErr, err)
+		case contentType == "":
+			contentType = other
+		case other != contentType:
+			slog.Warn("track format differs from the stream", "track", track, "format", other, "stream_format", contentType)
+		}
+	}
+
+	if contentType == "" {
+		return "", firstErr
+	}
+	return contentType, nil
+}
+
+// streamFormat is playlistContentType for a station that may have a
+// -content-type override. With an override, tracks in a format that isn't recognised
+// are no error: they're broadcast as they are, without the handling the
+// formats GoRadio knows get, such as trimming to a frame boundary.
+func streamFormat(playlist *Playlist, override string) (string, error) {
+	contentType, err := playlistContentType(playlist)
+	if err != nil && override != "" && errors.Is(err, errUnrecognisedFormat) {
+		return "", nil
+	}
+	return contentType, err
+}
+
+// validContentType checks value is a MIME type such as audio/flac, with
+// parameters if need be, so a typo doesn't leave players guessing
+func validContentType(value string) error {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return err
+	}
+	if kind, subtype, ok := strings.Cut(mediaType, "/"); !ok || kind == "" || subtype == "" {
+		return fmt.Errorf("%q isn't type/subtype", value)
+	}
+	return nil
+}
+
+// responseContentType is the Content-Type listeners are sent: -content-type
+// verbatim if given, the detected format otherwise
+func (s *Station) responseContentType() string {
+	return cmp.Or(s.overrideType, s.contentType)
+}
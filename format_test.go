@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"id3.mp3", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), "audio/mpeg"},
+		{"frame.mp3", []byte{0xFF, 0xFB, 0x90, 0x64}, "audio/mpeg"},
+		{"adts.aac", []byte{0xFF, 0xF1, 0x50, 0x80}, "audio/aac"},
+		{"page.ogg", []byte("OggS\x00\x02"), "audio/ogg"},
+		{"riff.wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "audio/wav"},
+		{"mislabelled.mp3", []byte("OggS\x00\x02"), "audio/ogg"}, // The bytes win over the extension
+		{"unknown.aac", []byte("not audio"), "audio/aac"},        // Then the extension
+		{"empty.oga", nil, "audio/ogg"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := detectContentType(writeTestFile(t, test.name, test.header))
+			if err != nil || got != test.want {
+				t.Errorf("detectContentType() = %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestDetectContentTypeUnrecognised(t *testing.T) {
+	_, err := detectContentType(writeTestFile(t, "notes.txt", []byte("not audio")))
+	if !errors.Is(err, errUnrecognisedFormat) {
+		t.Errorf("detectContentType() error = %v, want %v", err, errUnrecognisedFormat)
+	}
+}
+
+func TestPlaylistContentTypeFirstTrackWins(t *testing.T) {
+	playlist := NewPlaylist(
+		writeTestFile(t, "first.mp3", []byte("ID3\x04")),
+		writeTestFile(t, "second.ogg", []byte("OggS\x00")),
+	)
+	if got, err := playlistContentType(playlist); err != nil || got != "audio/mpeg" {
+		t.Errorf("playlistContentType() = %q, %v, want audio/mpeg", got, err)
+	}
+}
+
+func TestValidContentType(t *testing.T) {
+	for value, valid := range map[string]bool{
+		"audio/flac":             true,
+		"audio/ogg; codecs=opus": true,
+		"audio":                  false,
+		"audio/":                 false,
+		"/flac":                  false,
+		"audio/flac; codecs":     false,
+		"":                       false,
+	} {
+		if err := validContentType(value); (err == nil) != valid {
+			t.Errorf("validContentType(%q) = %v, want valid %v", value, err, valid)
+		}
+	}
+}
+
+// -content-type is sent verbatim in place of what was detected, to plain
+// and framed listeners alike, even for tracks that couldn't be detected
+func TestContentTypeOverride(t *testing.T) {
+	const override = "audio/x-custom; codecs=foo"
+	for name, audio := range map[string][]byte{"track.mp3": silentMPEGFrame, "track.bin": []byte("not audio we know")} {
+		t.Run(name, func(t *testing.T) {
+			options := testOptions()
+			options.ContentType = override
+			options.Framed = true
+			station, err := NewStation("test", "/stream", writeTestFile(t, name, audio), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runStation(t, station)
+			server := httptest.NewServer(streamHandler(station))
+			defer server.Close()
+
+			for query, header := range map[string]string{"": "Content-Type", "?framed=1": "X-Audio-Content-Type"} {
+				resp, err := http.Get(server.URL + query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if got := resp.Header.Get(header); got != override {
+					t.Errorf("%s%s = %q, want %q", query, header, got, override)
+				}
+			}
+		})
+	}
+}
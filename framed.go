@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// FRAMEHEADERSIZE is the length of the header in front of every chunk in
+// the framed protocol: an 8 byte sequence number then a 4 byte length, both
+// big endian. Sequence numbers count broadcasts, so a jump of more than one
+// means the chunks in between were dropped for this client. Data sent
+// outside the broadcast, such as OGG headers, has sequence number 0.
+const FRAMEHEADERSIZE = 12
+
+// writeFramed writes chunk to w with its framing header, returning the
+// bytes written including the header
+func writeFramed(w io.Writer, chunk Chunk) (int, error) {
+	var header [FRAMEHEADERSIZE]byte
+	binary.BigEndian.PutUint64(header[:8], chunk.Seq)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(chunk.Data)))
+
+	n, err := w.Write(header[:])
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(chunk.Data)
+	return n + m, err
+}
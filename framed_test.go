@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteFramed(t *testing.T) {
+	var out bytes.Buffer
+	n, err := writeFramed(&out, Chunk{Data: []byte("audio"), Seq: 0x0102030405060708})
+	if err != nil || n != FRAMEHEADERSIZE+5 {
+		t.Fatalf("writeFramed() = %d, %v, want %d", n, err, FRAMEHEADERSIZE+5)
+	}
+	want := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 5, 'a', 'u', 'd', 'i', 'o'}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("wrote %x, want %x", out.Bytes(), want)
+	}
+}
+
+// A framed client reads every broadcast as one frame, numbered one up from
+// the last, with as much data as the header says
+func TestFramedStream(t *testing.T) {
+	options := testOptions()
+	options.Framed = true
+	audio := append(silentMPEGFrame[:4:4], bytes.Repeat([]byte("0123456789"), 150)...) // A buffer and a half
+	station := NewMemoryStation("test", "/stream", audio, options)
+	runStation(t, station)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?framed=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Content-Type = %q, want application/octet-stream", got)
+	}
+	if got := resp.Header.Get("X-Audio-Content-Type"); got != "audio/mpeg" {
+		t.Errorf("X-Audio-Content-Type = %q, want audio/mpeg", got)
+	}
+
+	var seq uint64
+	var data []byte
+	header := make([]byte, FRAMEHEADERSIZE)
+	for i := 0; i < 6; i++ {
+		if _, err := io.ReadFull(resp.Body, header); err != nil {
+			t.Fatal(err)
+		}
+		next, length := binary.BigEndian.Uint64(header), binary.BigEndian.Uint32(header[8:])
+		if seq != 0 && next != seq+1 {
+			t.Errorf("frame %d has sequence number %d after %d", i, next, seq)
+		}
+		seq = next
+		if length == 0 || length > uint32(options.BufferSize) {
+			t.Fatalf("frame %d claims %d bytes", i, length)
+		}
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(resp.Body, chunk); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, chunk...)
+	}
+	// Whole passes of the source, cut at every buffer and at the end
+	if !bytes.Contains(append(audio, audio...), data[:len(audio)]) {
+		t.Error("frame data isn't the broadcast audio")
+	}
+}
+
+func TestUnframedByDefault(t *testing.T) {
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, testOptions()) // Without -framed
+	runStation(t, station)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?framed=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	start := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, start); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(start, silentMPEGFrame[:4]) {
+		t.Errorf("stream starts %x, want bare audio", start)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+// frameHeader describes a single ADTS (AAC) or MPEG audio (MP3) frame
+type frameHeader struct {
+	length     int // bytes, including the header
+	samples    int // per channel
+	sampleRate int
+	channels   int
+}
+
+var adtsSampleRates = [...]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// parseADTSHeader parses the 7-byte ADTS header at the start of b
+func parseADTSHeader(b []byte) (frameHeader, bool) {
+	if len(b) < 7 || b[0] != 0xFF || b[1]&0xF6 != 0xF0 {
+		return frameHeader{}, false
+	}
+
+	rateIndex := int(b[2]>>2) & 0x0F
+	if rateIndex >= len(adtsSampleRates) {
+		return frameHeader{}, false
+	}
+
+	length := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5]>>5)
+	if length < 7 {
+		return frameHeader{}, false
+	}
+
+	return frameHeader{
+		length:     length,
+		samples:    1024 * (int(b[6]&0x03) + 1),
+		sampleRate: adtsSampleRates[rateIndex],
+		channels:   int(b[2]&0x01)<<2 | int(b[3]>>6),
+	}, true
+}
+
+// MPEG audio bitrates in kbps, indexed by [MPEG1?0:1][layer-1][index]
+var mpegBitrates = [2][3][15]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+// MPEG audio sample rates indexed by [version bits][index]
+var mpegSampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG 2.5
+	{},                    // reserved
+	{22050, 24000, 16000}, // MPEG 2
+	{44100, 48000, 32000}, // MPEG 1
+}
+
+// parseMPEGHeader parses the 4-byte MPEG audio frame header at the start of b
+func parseMPEGHeader(b []byte) (frameHeader, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return frameHeader{}, false
+	}
+
+	version := int(b[1]>>3) & 0x03
+	layer := 4 - int(b[1]>>1)&0x03 // 1, 2 or 3
+	bitrateIndex := int(b[2] >> 4)
+	rateIndex := int(b[2]>>2) & 0x03
+	if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return frameHeader{}, false // reserved or free format
+	}
+
+	mpeg1 := version == 3
+	table := 1
+	if mpeg1 {
+		table = 0
+	}
+	bitrate := mpegBitrates[table][layer-1][bitrateIndex] * 1000
+	sampleRate := mpegSampleRates[version][rateIndex]
+	padding := int(b[2]>>1) & 0x01
+
+	header := frameHeader{sampleRate: sampleRate, channels: 2}
+	if b[3]>>6 == 3 {
+		header.channels = 1
+	}
+	switch {
+	case layer == 1:
+		header.samples = 384
+		header.length = (12*bitrate/sampleRate + padding) * 4
+	case layer == 3 && !mpeg1:
+		header.samples = 576
+		header.length = 72*bitrate/sampleRate + padding
+	default:
+		header.samples = 1152
+		header.length = 144*bitrate/sampleRate + padding
+	}
+	return header, true
+}
+
+// id3v2Size returns the number of bytes taken by an ID3v2 tag at the start
+// of b, or 0 if there is none
+func id3v2Size(b []byte) int {
+	if len(b) < 10 || string(b[:3]) != "ID3" {
+		return 0
+	}
+
+	size := synchsafe(b[6:10]) + 10
+	if b[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	return size
+}
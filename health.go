@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+type Health struct {
+	Status   string          `json:"status"` // ok or unavailable
+	Stations []StationHealth `json:"stations"`
+}
+
+type StationHealth struct {
+	Mount          string     `json:"mount"`
+	Streaming      bool       `json:"streaming"`
+	SourceReadable bool       `json:"source_readable"`
+	LastBroadcast  *time.Time `json:"last_broadcast"` // null until the first chunk goes out
+	DeadAir        bool       `json:"dead_air"`       // nothing broadcast for longer than -dead-air
+	Offline        bool       `json:"offline"`        // the source is missing, offline audio is on air
+}
+
+// health reports whether the stream goroutine is running, the current track
+// can still be opened and the watchdog hasn't seen dead air
+func (s *Station) health() StationHealth {
+	health := StationHealth{
+		Mount:     s.Mount,
+		Streaming: s.streaming.Load(),
+		DeadAir:   s.silent.Load(),
+		Offline:   s.offline.Load(),
+	}
+
+	if s.live != nil || s.memory != nil {
+		health.SourceReadable = health.Streaming // The stream stops once the input is used up
+	} else if s.relayURL != "" {
+		health.SourceReadable = s.relayConnected.Load()
+	} else if file, err := os.Open(s.currentTrack()); err == nil {
+		file.Close()
+		health.SourceReadable = true
+	}
+
+	if last := s.lastBroadcast.Load(); last != 0 {
+		t := time.Unix(0, last)
+		health.LastBroadcast = &t
+	}
+	return health
+}
+
+// healthzHandler is a readiness probe. It never joins a connection pool, so
+// probing doesn't take a listener slot or consume audio.
+func healthzHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := Health{Status: "ok"}
+		status := http.StatusOK
+		for _, station := range stations {
+			stationHealth := station.health()
+			if !(stationHealth.Streaming || station.onDemand) || !stationHealth.SourceReadable || stationHealth.DeadAir {
+				health.Status = "unavailable"
+				status = http.StatusServiceUnavailable
+			}
+			health.Stations = append(health.Stations, stationHealth)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(health); err != nil {
+			slog.Error("could not write health", "error", err)
+		}
+	}
+}
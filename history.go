@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type HistoryEntry struct {
+	File     string    `json:"file"`
+	Title    string    `json:"title"`
+	Artist   string    `json:"artist"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	path string
+}
+
+// History is a fixed-size ring of recently finished tracks, written by the
+// stream goroutine and read by HTTP handlers
+type History struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+	next    int // where the next entry goes
+	full    bool
+}
+
+func NewHistory(size int) *History {
+	return &History{entries: make([]HistoryEntry, size)}
+}
+
+// Add records a finished track, overwriting the oldest once the ring is full
+func (h *History) Add(entry HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	h.full = h.full || h.next == 0
+}
+
+// Entries returns the recorded tracks, most recent first
+func (h *History) Entries() []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.entries)
+	}
+
+	entries := make([]HistoryEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		entries = append(entries, h.entries[(h.next-i+len(h.entries))%len(h.entries)])
+	}
+	return entries
+}
+
+// finishTrack moves the now playing track into the history
+func (s *Station) finishTrack() {
+	current := s.nowPlaying.Load()
+	if current == nil {
+		return
+	}
+	s.history.Add(HistoryEntry{
+		File:     current.File,
+		Title:    current.Title,
+		Artist:   current.Artist,
+		Started:  current.Started,
+		Finished: time.Now(),
+		path:     current.path,
+	})
+}
+
+type StationHistory struct {
+	Station string         `json:"station"`
+	Mount   string         `json:"mount"`
+	Tracks  []HistoryEntry `json:"tracks"`
+}
+
+func (s *Station) History() StationHistory {
+	return StationHistory{Station: s.Name, Mount: s.Mount, Tracks: s.history.Entries()}
+}
+
+// historyHandler returns every station's recently played tracks, or just
+// one station's with ?station=name
+func historyHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body any
+		if key := r.URL.Query().Get("station"); key != "" {
+			station := findStation(stations, key)
+			if station == nil {
+				http.Error(w, "Unknown station", http.StatusNotFound)
+				return
+			}
+			body = station.History()
+		} else {
+			var all []StationHistory
+			for _, station := range stations {
+				all = append(all, station.History())
+			}
+			body = all
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			slog.Error("could not write history", "error", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	ICYMETAINT = 16000 // bytes of audio between metadata blocks
+
+	icyMaxMetadata = 255 * 16 // the length byte counts 16-byte units
+)
+
+// icyWriter interleaves ICY metadata blocks into the audio stream every
+// metaint bytes, for clients that asked for them with Icy-MetaData: 1
+type icyWriter struct {
+	w         io.Writer
+	metaint   int
+	untilMeta int
+	title     func() string
+	lastTitle string
+}
+
+func newIcyWriter(w io.Writer, metaint int, title func() string) *icyWriter {
+	return &icyWriter{w: w, metaint: metaint, untilMeta: metaint, title: title}
+}
+
+func (iw *icyWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), iw.untilMeta)
+		m, err := iw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+
+		iw.untilMeta -= n
+		if iw.untilMeta == 0 {
+			if _, err := iw.w.Write(iw.metadataBlock()); err != nil {
+				return written, err
+			}
+			iw.untilMeta = iw.metaint
+		}
+	}
+	return written, nil
+}
+
+// metadataBlock returns the next metadata block. The title is only repeated
+// when it changes, otherwise an empty block (a single zero byte) is sent.
+func (iw *icyWriter) metadataBlock() []byte {
+	title := iw.title()
+	if title == iw.lastTitle {
+		return []byte{0}
+	}
+	iw.lastTitle = title
+
+	meta := "StreamTitle='" + strings.ReplaceAll(title, "'", "") + "';"
+	if len(meta) > icyMaxMetadata {
+		meta = meta[:icyMaxMetadata]
+	}
+
+	units := (len(meta) + 15) / 16
+	block := make([]byte, 1+units*16) // Zero padded up to the next 16-byte unit
+	block[0] = byte(units)
+	copy(block[1:], meta)
+	return block
+}
+
+// trackTitle derives a display title from a track's filename
+func trackTitle(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// legacyICYClient reports whether r comes from a player that only
+// understands Shoutcast's "ICY 200 OK" status line, going by its
+// User-Agent. Clients that don't send an HTTP version at all never get this
+// far, net/http turns them away first.
+func legacyICYClient(r *http.Request, agents []string) bool {
+	userAgent := strings.ToLower(r.UserAgent())
+	for _, agent := range agents {
+		if agent != "" && strings.Contains(userAgent, strings.ToLower(agent)) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeICYResponse writes a Shoutcast style response head on a hijacked
+// connection, made of the headers already set on the ResponseWriter
+func writeICYResponse(w *bufio.Writer, header http.Header) error {
+	if _, err := io.WriteString(w, "ICY 200 OK\r\n"); err != nil {
+		return err
+	}
+	// Shoutcast servers send icy-* headers in lower case and some players
+	// match them case sensitively
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := key
+		if strings.HasPrefix(key, "Icy-") {
+			name = strings.ToLower(key)
+		}
+		for _, value := range header[key] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", name, value); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := io.WriteString(w, "\r\n"); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not send ICY response: %w", err)
+	}
+	return nil
+}
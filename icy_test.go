@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// splitICY takes an interleaved stream apart again, returning the audio and
+// the text of every metadata block, "" for the empty ones
+func splitICY(t *testing.T, stream []byte, metaint int) (audio []byte, blocks []string) {
+	t.Helper()
+	for len(stream) > metaint {
+		audio = append(audio, stream[:metaint]...)
+		stream = stream[metaint:]
+		size := int(stream[0]) * 16
+		if len(stream) < 1+size {
+			t.Fatalf("metadata block of %d bytes cut short at %d", size, len(stream)-1)
+		}
+		blocks = append(blocks, strings.TrimRight(string(stream[1:1+size]), "\x00"))
+		stream = stream[1+size:]
+	}
+	return append(audio, stream...), blocks
+}
+
+func ones(n int) []int {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = 1
+	}
+	return sizes
+}
+
+func TestIcyWriterFraming(t *testing.T) {
+	audio := make([]byte, 1000)
+	for i := range audio {
+		audio[i] = byte(i)
+	}
+	tests := []struct {
+		name    string
+		metaint int
+		writes  []int // sizes of the writes audio is split into
+		blocks  int
+	}{
+		{"one write", 100, []int{1000}, 10},
+		{"metaint sized", 100, []int{100, 100, 100, 700}, 10},
+		{"straddling", 100, []int{150, 99, 1, 250, 500}, 10},
+		{"bytewise", 7, ones(1000), 142},
+		{"shorter than metaint", 2000, []int{1000}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			iw := newIcyWriter(&out, test.metaint, func() string { return "Title" })
+			rest := audio
+			for _, size := range test.writes {
+				if n, err := iw.Write(rest[:size]); n != size || err != nil {
+					t.Fatalf("Write() = %d, %v, want %d", n, err, size)
+				}
+				rest = rest[size:]
+			}
+
+			got, blocks := splitICY(t, out.Bytes(), test.metaint)
+			if !bytes.Equal(got, audio) {
+				t.Error("audio changed by interleaving")
+			}
+			if len(blocks) != test.blocks {
+				t.Fatalf("%d metadata blocks, want %d", len(blocks), test.blocks)
+			}
+			for i, block := range blocks {
+				want := ""
+				if i == 0 {
+					want = "StreamTitle='Title';" // Only repeated when it changes
+				}
+				if block != want {
+					t.Errorf("block %d = %q, want %q", i, block, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIcyMetadataBlock(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Artist - Title", "StreamTitle='Artist - Title';"},
+		{"Don't Stop", "StreamTitle='Dont Stop';"}, // A quote would end the value
+		{"", "StreamTitle='';"},
+		{strings.Repeat("x", 5000), ("StreamTitle='" + strings.Repeat("x", 5000))[:icyMaxMetadata]},
+	}
+	for _, test := range tests {
+		iw := newIcyWriter(nil, ICYMETAINT, func() string { return test.title })
+		iw.lastTitle = "previous"
+		block := iw.metadataBlock()
+		if (len(block)-1)%16 != 0 || int(block[0])*16 != len(block)-1 {
+			t.Errorf("block for %.20q is %d bytes with length byte %d", test.title, len(block), block[0])
+			continue
+		}
+		if got := strings.TrimRight(string(block[1:]), "\x00"); got != test.want {
+			t.Errorf("block for %.20q = %.40q, want %.40q", test.title, got, test.want)
+		}
+	}
+}
+
+func TestLegacyICYClient(t *testing.T) {
+	agents := []string{"Winamp", "", "nsplayer"}
+	tests := []struct {
+		userAgent string
+		want      bool
+	}{
+		{"WinAmp/5.8", true},
+		{"NSPlayer/12.0", true},
+		{"VLC/3.0.18 LibVLC/3.0.18", false},
+		{"", false}, // The empty agent in the list matches nothing
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		r.Header.Set("User-Agent", test.userAgent)
+		if got := legacyICYClient(r, agents); got != test.want {
+			t.Errorf("legacyICYClient(%q) = %v, want %v", test.userAgent, got, test.want)
+		}
+	}
+}
+
+func TestWriteICYResponse(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "audio/mpeg")
+	header.Set("Icy-Metaint", "16000")
+	header.Set("Icy-Name", "Jazz")
+
+	var out bytes.Buffer
+	if err := writeICYResponse(bufio.NewWriter(&out), header); err != nil {
+		t.Fatal(err)
+	}
+	want := "ICY 200 OK\r\nContent-Type: audio/mpeg\r\nicy-metaint: 16000\r\nicy-name: Jazz\r\n\r\n"
+	if out.String() != want {
+		t.Errorf("response = %q, want %q", out.String(), want)
+	}
+}
+
+// A legacy player gets a Shoutcast status line on the hijacked connection,
+// with the station's details in icy-* headers, then the audio
+func TestLegacyICYResponse(t *testing.T) {
+	options := testOptions()
+	options.Genre = "Jazz"
+	options.URL = "https://radio.example"
+	options.ICYAgents = []string{"OldRadio"}
+	station := NewMemoryStation("Smooth", "/stream", silentMPEGFrame, options)
+	runStation(t, station)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	for _, test := range []struct {
+		userAgent, status string
+	}{
+		{"OldRadio/1.0", "ICY 200 OK"},
+		{"VLC/3.0", "HTTP/1.0 200 OK"},
+	} {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET /stream HTTP/1.0\r\nUser-Agent: %s\r\nIcy-MetaData: 1\r\n\r\n", test.userAgent)
+
+		r := bufio.NewReader(conn)
+		status, err := r.ReadString('\n')
+		if err != nil || status != test.status+"\r\n" {
+			t.Fatalf("%s: status line = %q, %v, want %q", test.userAgent, status, err, test.status)
+		}
+		if test.status != "ICY 200 OK" {
+			continue
+		}
+
+		header := map[string]string{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\r\n" {
+				break
+			}
+			name, value, _ := strings.Cut(strings.TrimSpace(line), ": ")
+			header[name] = value
+		}
+		for name, want := range map[string]string{"icy-name": "Smooth", "icy-genre": "Jazz", "icy-url": "https://radio.example", "Content-Type": "audio/mpeg"} {
+			if header[name] != want {
+				t.Errorf("%s = %q, want %q", name, header[name], want)
+			}
+		}
+		if header["icy-metaint"] == "" {
+			t.Error("no icy-metaint for a client that asked for metadata")
+		}
+		audio := make([]byte, 4)
+		if _, err := io.ReadFull(r, audio); err != nil || !bytes.Equal(audio, silentMPEGFrame[:4]) {
+			t.Errorf("audio starts %x, %v, want a frame", audio, err)
+		}
+	}
+}
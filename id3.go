@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3MaxTagSize caps how much of a tag is read into memory. The size comes
+// from the file, so a corrupt or hostile one could ask for up to 256 MiB.
+// Larger tags are skipped over, only their first id3MaxTagSize bytes are
+// parsed, which is plenty for text frames and most cover art.
+const id3MaxTagSize = 4 << 20
+
+// ID3Tag holds the ID3v2 frames GoRadio cares about
+type ID3Tag struct {
+	Title  string
+	Artist string
+	Album  string
+
+	Gain    float64 // dB, from a replaygain_track_gain TXXX frame
+	HasGain bool
+
+	Picture []byte // embedded cover art from an APIC frame, the front cover if there are several
+}
+
+// id3TextFrames maps v2.3/v2.4 and v2.2 frame IDs to the field they fill
+var id3TextFrames = map[string]func(*ID3Tag) *string{
+	"TIT2": func(t *ID3Tag) *string { return &t.Title },
+	"TPE1": func(t *ID3Tag) *string { return &t.Artist },
+	"TALB": func(t *ID3Tag) *string { return &t.Album },
+	"TT2":  func(t *ID3Tag) *string { return &t.Title },
+	"TP1":  func(t *ID3Tag) *string { return &t.Artist },
+	"TAL":  func(t *ID3Tag) *string { return &t.Album },
+}
+
+// openTrack opens a track positioned at its first audio byte, so an ID3v2
+// tag at the head of the file is never broadcast. A missing or malformed tag
+// just gives an empty ID3Tag.
+func openTrack(path string) (*os.File, ID3Tag, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, ID3Tag{}, err
+	}
+
+	header := make([]byte, 10)
+	n, _ := io.ReadFull(file, header)
+	size := id3v2Size(header[:n])
+	if size == 0 {
+		_, err = file.Seek(0, io.SeekStart)
+		return file, ID3Tag{}, err
+	}
+
+	raw := make([]byte, min(size-10, id3MaxTagSize))
+	n, _ = io.ReadFull(file, raw)
+	tag := parseID3(header, raw[:n])
+
+	_, err = file.Seek(int64(size), io.SeekStart)
+	return file, tag, err
+}
+
+// parseID3 reads the text frames out of a tag body. header is the 10-byte
+// tag header, body everything after it.
+func parseID3(header, body []byte) ID3Tag {
+	var tag ID3Tag
+	version := header[3]
+	flags := header[5]
+
+	if flags&0x40 != 0 && len(body) >= 4 { // extended header
+		size := int(binary.BigEndian.Uint32(body[:4]))
+		if version == 4 {
+			size = synchsafe(body[:4])
+		} else {
+			size += 4 // v2.3 doesn't count the size field itself
+		}
+		body = body[min(size, len(body)):]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for len(body) >= headerLen && body[0] != 0 { // padding starts with a zero byte
+		id := string(body[:idLen])
+		var size int
+		switch version {
+		case 2:
+			size = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 4:
+			size = synchsafe(body[4:8])
+		default:
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+		}
+		body = body[headerLen:]
+		if size > len(body) {
+			break // Malformed, keep whatever was already read
+		}
+
+		if field, ok := id3TextFrames[id]; ok {
+			*field(&tag) = decodeID3Text(body[:size])
+		} else if id == "TXXX" || id == "TXX" {
+			description, value := decodeID3UserText(body[:size])
+			if strings.EqualFold(description, "replaygain_track_gain") {
+				tag.Gain, tag.HasGain = parseReplayGain(value)
+			}
+		} else if id == "APIC" || id == "PIC" {
+			if picture, front := decodeID3Picture(body[:size], version == 2); len(picture) > 0 && (front || tag.Picture == nil) {
+				tag.Picture = picture
+			}
+		}
+		body = body[size:]
+	}
+	return tag
+}
+
+// decodeID3Text decodes a text frame, whose first byte gives its encoding
+func decodeID3Text(frame []byte) string {
+	// v2.4 allows several null separated values, only the first is kept
+	text, _, _ := strings.Cut(decodeID3String(frame), "\x00")
+	return strings.TrimSpace(text)
+}
+
+// decodeID3UserText splits a TXXX frame into its description and value
+func decodeID3UserText(frame []byte) (description, value string) {
+	description, value, _ = strings.Cut(decodeID3String(frame), "\x00")
+	value, _, _ = strings.Cut(value, "\x00")
+	return strings.TrimSpace(description), strings.TrimSpace(strings.TrimPrefix(value, "\ufeff"))
+}
+
+// decodeID3Picture returns the image in an APIC frame, or a v2.2 PIC frame,
+// and whether it is the front cover. The frame's MIME type isn't trusted,
+// the image is sniffed when served instead.
+func decodeID3Picture(frame []byte, v22 bool) (picture []byte, front bool) {
+	if len(frame) < 2 {
+		return nil, false
+	}
+	encoding, data := frame[0], frame[1:]
+	if v22 {
+		if len(data) < 3 {
+			return nil, false
+		}
+		data = data[3:] // Image format, e.g. "JPG"
+	} else {
+		_, after, ok := bytes.Cut(data, []byte{0})
+		if !ok {
+			return nil, false
+		}
+		data = after // After the MIME type
+	}
+	if len(data) < 1 {
+		return nil, false
+	}
+	front = data[0] == 3 // Picture type 3 is "Cover (front)"
+	data = data[1:]
+
+	// The description ends in a null the width of the encoding's characters
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return data[i+2:], front
+			}
+		}
+		return nil, false
+	}
+	_, picture, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return nil, false
+	}
+	return picture, front
+}
+
+// decodeID3String decodes all of a text frame, nulls included
+func decodeID3String(frame []byte) string {
+	if len(frame) == 0 {
+		return ""
+	}
+
+	var text string
+	switch encoding, data := frame[0], frame[1:]; encoding {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		text = decodeUTF16(data, encoding == 2)
+	case 3: // UTF-8
+		text = string(data)
+	default: // ISO-8859-1
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	return text
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	if bytes.HasPrefix(data, []byte{0xFF, 0xFE}) {
+		data, bigEndian = data[2:], false
+	} else if bytes.HasPrefix(data, []byte{0xFE, 0xFF}) {
+		data, bigEndian = data[2:], true
+	}
+
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = binary.BigEndian.Uint16(data[2*i:])
+		} else {
+			units[i] = binary.LittleEndian.Uint16(data[2*i:])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+func synchsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// id3Frame is a v2.3 frame, or a v2.4 one with its size synchsafe
+func id3Frame(version byte, id string, body []byte) []byte {
+	frame := []byte(id)
+	size := len(body)
+	if version == 4 {
+		frame = append(frame, byte(size>>21&0x7F), byte(size>>14&0x7F), byte(size>>7&0x7F), byte(size&0x7F))
+	} else {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(size))
+	}
+	frame = append(frame, 0, 0) // flags
+	return append(frame, body...)
+}
+
+// id3Blob puts frames in a tag of the given version, followed by padding
+func id3Blob(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	body = append(body, make([]byte, 16)...)
+	size := len(body)
+	header := []byte{'I', 'D', '3', version, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	return append(header, body...)
+}
+
+func latin1(text string) []byte { return append([]byte{0}, text...) }
+
+func TestParseID3(t *testing.T) {
+	utf16 := []byte{1, 0xFF, 0xFE, 'C', 0, 'a', 0, 'f', 0, 0xE9, 0} // "Café" with a BOM
+	tests := []struct {
+		name string
+		tag  []byte
+		want ID3Tag
+	}{
+		{"v2.3", id3Blob(3,
+			id3Frame(3, "TIT2", latin1("Title")),
+			id3Frame(3, "TPE1", latin1("Artist")),
+			id3Frame(3, "TALB", latin1("Album")),
+		), ID3Tag{Title: "Title", Artist: "Artist", Album: "Album"}},
+		{"v2.4 utf-8", id3Blob(4,
+			id3Frame(4, "TIT2", append([]byte{3}, "Ünïcode\x00Second value"...)),
+		), ID3Tag{Title: "Ünïcode"}},
+		{"utf-16", id3Blob(3, id3Frame(3, "TPE1", utf16)), ID3Tag{Artist: "Café"}},
+		{"v2.2", append([]byte{'I', 'D', '3', 2, 0, 0, 0, 0, 0, 10}, 'T', 'T', '2', 0, 0, 4, 0, 'A', 'b', 'c'), ID3Tag{Title: "Abc"}},
+		{"replaygain", id3Blob(3,
+			id3Frame(3, "TXXX", latin1("REPLAYGAIN_TRACK_GAIN\x00-6.5 dB")),
+			id3Frame(3, "TXXX", latin1("other\x00ignored")),
+		), ID3Tag{Gain: -6.5, HasGain: true}},
+		{"front cover wins", id3Blob(3,
+			id3Frame(3, "APIC", latin1("image/png\x00\x04back\x00BACK")),
+			id3Frame(3, "APIC", latin1("image/png\x00\x03front\x00FRONT")),
+		), ID3Tag{Picture: []byte("FRONT")}},
+		{"frame longer than tag", id3Blob(3,
+			id3Frame(3, "TIT2", latin1("Kept")),
+			append(id3Frame(3, "TPE1", nil)[:4], 0, 0, 0x10, 0, 0, 0, 'x'),
+		), ID3Tag{Title: "Kept"}},
+		{"no frames", id3Blob(3), ID3Tag{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseID3(test.tag[:10], test.tag[10:])
+			if got.Title != test.want.Title || got.Artist != test.want.Artist || got.Album != test.want.Album ||
+				got.Gain != test.want.Gain || got.HasGain != test.want.HasGain || !bytes.Equal(got.Picture, test.want.Picture) {
+				t.Errorf("parseID3() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeID3Picture(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		v22     bool
+		picture string
+		front   bool
+	}{
+		{"front cover", latin1("image/jpeg\x00\x03Cover\x00JPEG"), false, "JPEG", true},
+		{"other picture", latin1("image/jpeg\x00\x00\x00JPEG"), false, "JPEG", false},
+		{"utf-16 description", append([]byte{1}, "image/png\x00\x03\xFF\xFEA\x00\x00\x00PNG\x00"...), false, "PNG\x00", true}, // A single null ends nothing
+		{"v2.2", latin1("JPG\x03\x00JPEG"), true, "JPEG", true},
+		{"no description end", latin1("image/jpeg\x00\x03Cover"), false, "", false},
+		{"no mime type end", latin1("image/jpeg"), false, "", false},
+		{"empty", nil, false, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			picture, front := decodeID3Picture(test.frame, test.v22)
+			if string(picture) != test.picture || front != test.front {
+				t.Errorf("decodeID3Picture() = %q, %v, want %q, %v", picture, front, test.picture, test.front)
+			}
+		})
+	}
+}
+
+func TestOpenTrack(t *testing.T) {
+	audio := bytes.Repeat(silentMPEGFrame, 3)
+	tag := id3Blob(3, id3Frame(3, "TIT2", latin1("Title")))
+	tests := []struct {
+		name  string
+		data  []byte
+		title string
+		rest  []byte // what's read from the file opened
+	}{
+		{"tagged", append(append([]byte{}, tag...), audio...), "Title", audio},
+		{"untagged", audio, "", audio},
+		{"truncated tag", tag[:20], "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, got, err := openTrack(writeTestFile(t, "track.mp3", test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if got.Title != test.title {
+				t.Errorf("Title = %q, want %q", got.Title, test.title)
+			}
+			if rest, _ := io.ReadAll(file); !bytes.Equal(rest, test.rest) {
+				t.Errorf("read %d bytes after the tag, want %d", len(rest), len(test.rest))
+			}
+		})
+	}
+}
+
+// A tag claiming the maximum size is skipped without reading it all in
+func TestOpenTrackHugeTag(t *testing.T) {
+	frames := id3Frame(3, "TIT2", latin1("Title"))
+	const size = 0x0FFFFFFF // Every synchsafe bit set, 256 MiB
+	header := []byte{'I', 'D', '3', 3, 0, 0, 0x7F, 0x7F, 0x7F, 0x7F}
+	path := writeTestFile(t, "huge.mp3", append(header, frames...))
+	if err := os.Truncate(path, 10+size+int64(len(silentMPEGFrame))); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	file, tag, err := openTrack(path)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2*id3MaxTagSize {
+		t.Errorf("allocated %d bytes opening the track", allocated)
+	}
+	if tag.Title != "Title" {
+		t.Errorf("Title = %q, want the frame at the head of the tag", tag.Title)
+	}
+	if position, _ := file.Seek(0, io.SeekCurrent); position != 10+size {
+		t.Errorf("positioned at %d, want %d, past the tag", position, 10+size)
+	}
+}
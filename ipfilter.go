@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// cidrFlags collects networks from repeated or comma separated flags, e.g.
+// -allow-cidr 10.0.0.0/8,fd00::/8. A bare address is a network of one.
+type cidrFlags []netip.Prefix
+
+func (f *cidrFlags) String() string {
+	networks := make([]string, len(*f))
+	for i, prefix := range *f {
+		networks[i] = prefix.String()
+	}
+	return strings.Join(networks, ",")
+}
+
+func (f *cidrFlags) Set(value string) error {
+	for _, network := range strings.Split(value, ",") {
+		network = strings.TrimSpace(network)
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(network)
+			if addrErr != nil {
+				return fmt.Errorf("expected a CIDR network or an address, got %q", network)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		*f = append(*f, prefix.Masked())
+	}
+	return nil
+}
+
+// containsAddr reports whether addr is in any of the networks
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address a request came from. Requests from a
+// trusted proxy are taken to be from the rightmost X-Forwarded-For entry
+// that isn't a trusted proxy too: each proxy appends the address it got the
+// request from, but a client can put anything it likes in front, so nothing
+// further left can be believed. Peers on a Unix socket are local, so they
+// are trusted as soon as any proxy is. ok is false if the address can't be
+// told.
+func clientAddr(r *http.Request, proxies []netip.Prefix) (addr netip.Addr, ok bool) {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err == nil {
+		addr = peer.Addr().Unmap()
+		if !containsAddr(proxies, addr) {
+			return addr, true
+		}
+	} else if len(proxies) == 0 {
+		return netip.Addr{}, false
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseForwardedAddr(hops[i])
+		if !ok {
+			break // Garbage, so whoever sent it is as far back as can be trusted
+		}
+		addr = hop
+		if !containsAddr(proxies, hop) {
+			break
+		}
+	}
+	return addr, addr.IsValid()
+}
+
+// parseForwardedAddr parses one X-Forwarded-For entry, which some proxies
+// write with a port
+func parseForwardedAddr(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// IPFilter decides by address who may listen. Denied networks always lose,
+// and once any network is allowed, only addresses in one get through. A nil
+// IPFilter lets everyone in.
+type IPFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewIPFilter returns nil, filtering nothing, unless some network is allowed
+// or denied
+func NewIPFilter(allow, deny []netip.Prefix) *IPFilter {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return &IPFilter{allow: allow, deny: deny}
+}
+
+// Allowed reports whether addr may listen. An address that couldn't be told
+// only gets in when nothing is allowed explicitly.
+func (f *IPFilter) Allowed(addr netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+	if !addr.IsValid() {
+		return len(f.allow) == 0
+	}
+	if containsAddr(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsAddr(f.allow, addr)
+}
+
+// requireIP wraps next so only requests from allowed addresses reach it,
+// everyone else gets a 403. Proxied requests are judged by the client's
+// address once trustProxies has put it in RemoteAddr.
+func requireIP(filter *IPFilter, next http.HandlerFunc) http.HandlerFunc {
+	if filter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, _ := netip.ParseAddr(remoteIP(r.RemoteAddr))
+		if !filter.Allowed(addr.Unmap()) {
+			slog.Info("client refused by address", "remote_addr", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// trustProxies wraps next so that requests forwarded by a trusted proxy
+// carry the client's address, without a port, as their RemoteAddr. Logs,
+// per IP limits, the access log and address filters all then see the client
+// rather than the proxy. Requests from anyone else are left as they are,
+// whatever X-Forwarded-For they send.
+func trustProxies(proxies []netip.Prefix, next http.Handler) http.Handler {
+	if len(proxies) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := clientAddr(r, proxies); ok && addr.String() != remoteIP(r.RemoteAddr) {
+			r = r.WithContext(r.Context()) // A copy, the original belongs to the server
+			r.RemoteAddr = addr.String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// networks parses CIDR flag values, failing the test on a bad one
+func networks(t *testing.T, values ...string) []netip.Prefix {
+	t.Helper()
+	var flags cidrFlags
+	for _, value := range values {
+		if err := flags.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return flags
+}
+
+func TestCIDRFlags(t *testing.T) {
+	got := cidrFlags(networks(t, "10.1.2.3/8, fd00::/8", "192.0.2.1", "2001:db8::1"))
+	if want := "10.0.0.0/8,fd00::/8,192.0.2.1/32,2001:db8::1/128"; got.String() != want {
+		t.Errorf("parsed %s, want %s", got.String(), want)
+	}
+
+	var flags cidrFlags
+	for _, value := range []string{"10.0.0.0/33", "example.com", "10.0.0.0/8,"} {
+		if err := flags.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded", value)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		addr        string
+		want        bool
+	}{
+		{"allowed", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"not allowed", []string{"10.0.0.0/8"}, nil, "192.0.2.1", false},
+		{"denied", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"not denied", nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{"deny wins", []string{"10.0.0.0/8"}, []string{"10.6.0.0/16"}, "10.6.0.1", false},
+		{"ipv6 allowed", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"ipv6 denied", nil, []string{"2001:db8::/32"}, "2001:db8:1::1", false},
+		{"ipv4 mapped", nil, []string{"192.0.2.0/24"}, "::ffff:192.0.2.1", false},
+		{"unknown, nothing allowed", nil, []string{"192.0.2.0/24"}, "", true},
+		{"unknown, some allowed", []string{"10.0.0.0/8"}, nil, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := NewIPFilter(networks(t, test.allow...), networks(t, test.deny...))
+			addr, _ := netip.ParseAddr(test.addr)
+			if got := filter.Allowed(addr); got != test.want {
+				t.Errorf("Allowed(%s) = %v, want %v", test.addr, got, test.want)
+			}
+		})
+	}
+
+	open := NewIPFilter(nil, nil)
+	if open != nil || !open.Allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("a filter with no networks refused someone")
+	}
+}
+
+func TestRequireIP(t *testing.T) {
+	filter := NewIPFilter(nil, networks(t, "192.0.2.0/24", "2001:db8::/32"))
+	handler := requireIP(filter, func(w http.ResponseWriter, r *http.Request) {})
+	for remoteAddr, want := range map[string]int{
+		"192.0.2.1:5000":     http.StatusForbidden,
+		"[2001:db8::1]:5000": http.StatusForbidden,
+		"198.51.100.1:5000":  http.StatusOK,
+		"[2001:db9::1]:5000": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != want {
+			t.Errorf("request from %s: status = %d, want %d", remoteAddr, w.Code, want)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	proxies := []string{"10.0.0.0/8", "fd00::/8"}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string // X-Forwarded-For headers
+		want       string   // "" if it can't be told
+	}{
+		{"direct", "192.0.2.1:5000", nil, "192.0.2.1"},
+		{"direct ignores forwarding", "192.0.2.1:5000", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"through a proxy", "10.0.0.1:5000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"through two proxies", "10.0.0.1:5000", []string{"198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"spoofed entry in front", "10.0.0.1:5000", []string{"203.0.113.66, 198.51.100.7"}, "198.51.100.7"},
+		{"spoofed trusted entry in front", "10.0.0.1:5000", []string{"10.9.9.9, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"split over headers", "10.0.0.1:5000", []string{"203.0.113.66", "198.51.100.7"}, "198.51.100.7"},
+		{"with a port", "10.0.0.1:5000", []string{"198.51.100.7:4711"}, "198.51.100.7"},
+		{"ipv6", "[fd00::1]:5000", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"garbage stops the walk", "10.0.0.1:5000", []string{"198.51.100.7, bogus, 10.0.0.2"}, "10.0.0.2"},
+		{"nothing forwarded", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"all proxies", "10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"unix socket", "@", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"unix socket, nothing forwarded", "@", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			addr, ok := clientAddr(r, networks(t, proxies...))
+			if got := map[bool]string{true: addr.String(), false: ""}[ok]; got != test.want {
+				t.Errorf("clientAddr() = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// Without trusted proxies a Unix socket peer can't be told at all
+	r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	r.RemoteAddr = "@"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if addr, ok := clientAddr(r, nil); ok {
+		t.Errorf("clientAddr() = %s with no proxies trusted", addr)
+	}
+}
+
+// Handlers behind trustProxies see the client's address, but only when a
+// trusted proxy passed the request on
+func TestTrustProxies(t *testing.T) {
+	var seen string
+	handler := trustProxies(networks(t, "10.0.0.0/8"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	}))
+	for _, test := range []struct{ remoteAddr, want string }{
+		{"10.0.0.1:5000", "198.51.100.7"},
+		{"192.0.2.1:5000", "192.0.2.1:5000"}, // Spoofing from outside changes nothing
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", "198.51.100.7")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if seen != test.want {
+			t.Errorf("request from %s seen as %s, want %s", test.remoteAddr, seen, test.want)
+		}
+	}
+}
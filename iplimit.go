@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// IPLimiter caps how many streams a single IP address can have open at
+// once, across every station. A nil IPLimiter allows any number.
+type IPLimiter struct {
+	mu     sync.Mutex
+	counts map[string]int
+	max    int
+}
+
+// NewIPLimiter allows max concurrent streams per IP, or returns nil for no
+// limit if max isn't positive
+func NewIPLimiter(max int) *IPLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &IPLimiter{counts: make(map[string]int), max: max}
+}
+
+// Acquire takes a slot for ip, reporting false if it already has max
+func (l *IPLimiter) Acquire(ip string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip] >= l.max {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// Release gives back a slot taken by Acquire
+func (l *IPLimiter) Release(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[ip]--; l.counts[ip] <= 0 {
+		delete(l.counts, ip) // Don't keep every address ever seen
+	}
+}
+
+// remoteIP is the address part of a request's RemoteAddr
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
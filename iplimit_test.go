@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPLimiter(t *testing.T) {
+	limiter := NewIPLimiter(2)
+	steps := []struct {
+		acquire bool // Release otherwise
+		ip      string
+		want    bool
+	}{
+		{true, "10.0.0.1", true},
+		{true, "10.0.0.1", true},
+		{true, "10.0.0.1", false},
+		{true, "10.0.0.2", true}, // Every address has its own slots
+		{false, "10.0.0.1", true},
+		{true, "10.0.0.1", true},
+		{true, "10.0.0.1", false},
+	}
+	for i, step := range steps {
+		if !step.acquire {
+			limiter.Release(step.ip)
+			continue
+		}
+		if got := limiter.Acquire(step.ip); got != step.want {
+			t.Errorf("step %d: Acquire(%s) = %v, want %v", i, step.ip, got, step.want)
+		}
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		limiter.Release(ip)
+	}
+	if len(limiter.counts) != 0 {
+		t.Errorf("addresses without streams still counted: %v", limiter.counts)
+	}
+}
+
+func TestIPLimiterDisabled(t *testing.T) {
+	limiter := NewIPLimiter(0)
+	if limiter != nil {
+		t.Fatal("NewIPLimiter(0) should give no limit")
+	}
+	for i := 0; i < 100; i++ {
+		if !limiter.Acquire("10.0.0.1") {
+			t.Fatal("nil limiter refused a stream")
+		}
+	}
+	limiter.Release("10.0.0.1")
+}
+
+func TestRemoteIP(t *testing.T) {
+	for remoteAddr, want := range map[string]string{
+		"10.0.0.1:5000":    "10.0.0.1",
+		"[2001:db8::1]:80": "2001:db8::1",
+		"10.0.0.1":         "10.0.0.1", // No port to take off
+	} {
+		if got := remoteIP(remoteAddr); got != want {
+			t.Errorf("remoteIP(%q) = %q, want %q", remoteAddr, got, want)
+		}
+	}
+}
+
+// With -max-per-ip N, the N+1th stream from one address is turned away
+// until one of the others hangs up
+func TestMaxPerIP(t *testing.T) {
+	const limit = 3
+	options := testOptions()
+	options.IPLimiter = NewIPLimiter(limit)
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, options)
+	runStation(t, station)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	get := func() *http.Response {
+		t.Helper()
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	var streams []*http.Response
+	for i := 0; i < limit; i++ {
+		resp := get()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("stream %d: status = %d", i, resp.StatusCode)
+		}
+		defer resp.Body.Close()
+		streams = append(streams, resp)
+	}
+
+	resp := get()
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("stream %d: status = %d, Retry-After %q, want %d", limit+1, resp.StatusCode, resp.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	streams[0].Body.Close()
+	waitFor(t, "the closed stream's slot", func() bool {
+		options.IPLimiter.mu.Lock()
+		defer options.IPLimiter.mu.Unlock()
+		return options.IPLimiter.counts["127.0.0.1"] == limit-1
+	})
+	resp = get()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d after a stream closed, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
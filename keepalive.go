@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Silent frames broadcast to keep idle connections busy. Players decode
+// them as a moment of silence, so they can go anywhere between frames.
+var (
+	// MPEG-1 Layer III, 128 kbps, 44.1 kHz stereo, with no main data
+	silentMPEGFrame = append([]byte{0xFF, 0xFB, 0x90, 0x00}, make([]byte, 413)...)
+	// AAC-LC, 44.1 kHz stereo
+	silentADTSFrame = []byte{0xFF, 0xF1, 0x50, 0x80, 0x02, 0x1F, 0xFC, 0x21, 0x00, 0x49, 0x90, 0x02, 0x19, 0x00, 0x23, 0x80}
+)
+
+// silentFrame returns a frame of silence in the given format, or nil for
+// formats where one can't be dropped into the middle of the stream
+func silentFrame(contentType string) []byte {
+	switch contentType {
+	case "audio/mpeg":
+		return silentMPEGFrame
+	case "audio/aac":
+		return silentADTSFrame
+	}
+	return nil
+}
+
+// keepalive broadcasts a silent frame whenever nothing has been broadcast
+// for interval, e.g. while paused, so that proxies between the server and
+// its listeners don't close connections that look idle. The watchdog still
+// counts this as dead air.
+func (s *Station) keepalive(ctx context.Context, interval time.Duration) {
+	frame := silentFrame(s.contentType)
+	if frame == nil {
+		slog.Warn("no silent frame for this format, keep-alives disabled", "station", s.Name, "format", s.contentType)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastSent := time.Now().UnixNano()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		last := max(s.lastBroadcast.Load(), lastSent)
+		if time.Since(time.Unix(0, last)) >= interval {
+			s.pool.Broadcast(frame)
+			lastSent = time.Now().UnixNano()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	LATENCYLOW  = "low"
+	LATENCYHIGH = "high"
+
+	LOWLATENCYCLIENTBUFFER  = 1  // chunks queued for a low latency listener, at most
+	HIGHLATENCYCLIENTBUFFER = 16 // chunks queued for a high latency listener, at least
+	HIGHLATENCYPREBUFFER    = 8  // recent chunks sent to a high latency listener on joining, at least
+)
+
+// requestedLatency returns the latency mode a listener asked for with
+// ?latency= or an X-Latency header, "" for the station's defaults
+func requestedLatency(r *http.Request) (string, error) {
+	mode := r.URL.Query().Get("latency")
+	if mode == "" {
+		mode = r.Header.Get("X-Latency")
+	}
+	switch mode {
+	case "", LATENCYLOW, LATENCYHIGH:
+		return mode, nil
+	}
+	return "", fmt.Errorf("latency must be %s or %s, got %q", LATENCYLOW, LATENCYHIGH, mode)
+}
+
+// latencyDepths returns how many chunks to queue for a listener in mode, and
+// how many recent ones to send it on joining. Low latency joins at the live
+// edge, with no prebuffer, and keeps the queue shallow so the listener is
+// never more than a chunk behind, at the cost of dropping audio on any
+// hiccup. High latency starts further back and queues more, so the network
+// can stall for longer before anything is dropped. Neither goes past the
+// station's own settings in the other direction.
+func (s *Station) latencyDepths(mode string) (clientBuffer, prebuffer int) {
+	switch mode {
+	case LATENCYLOW:
+		return min(s.clientBuffer, LOWLATENCYCLIENTBUFFER), 0
+	case LATENCYHIGH:
+		return max(s.clientBuffer, HIGHLATENCYCLIENTBUFFER), max(s.pool.prebuffer, HIGHLATENCYPREBUFFER)
+	}
+	return s.clientBuffer, s.pool.prebuffer
+}
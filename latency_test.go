@@ -0,0 +1,115 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestedLatency(t *testing.T) {
+	tests := []struct {
+		query, header string
+		want          string
+		err           bool
+	}{
+		{"", "", "", false},
+		{"?latency=low", "", LATENCYLOW, false},
+		{"", LATENCYHIGH, LATENCYHIGH, false},
+		{"?latency=low", LATENCYHIGH, LATENCYLOW, false}, // The query wins
+		{"?latency=medium", "", "", true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/stream"+test.query, nil)
+		if test.header != "" {
+			r.Header.Set("X-Latency", test.header)
+		}
+		got, err := requestedLatency(r)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("requestedLatency(%q, X-Latency %q) = %q, %v, want %q", test.query, test.header, got, err, test.want)
+		}
+	}
+}
+
+func TestLatencyDepths(t *testing.T) {
+	tests := []struct {
+		clientBuffer, prebuffer int
+		mode                    string
+		wantBuffer, wantPre     int
+	}{
+		{4, 2, "", 4, 2},
+		{4, 2, LATENCYLOW, LOWLATENCYCLIENTBUFFER, 0},
+		{4, 2, LATENCYHIGH, HIGHLATENCYCLIENTBUFFER, HIGHLATENCYPREBUFFER},
+		{0, 2, LATENCYLOW, 0, 0},      // Never deeper than the station's
+		{32, 20, LATENCYHIGH, 32, 20}, // Never shallower
+	}
+	for _, test := range tests {
+		options := testOptions()
+		options.ClientBuffer, options.Prebuffer = test.clientBuffer, test.prebuffer
+		station := newStation("test", "/stream", options)
+		buffer, prebuffer := station.latencyDepths(test.mode)
+		if buffer != test.wantBuffer || prebuffer != test.wantPre {
+			t.Errorf("client buffer %d, prebuffer %d, %q latency: got %d and %d, want %d and %d",
+				test.clientBuffer, test.prebuffer, test.mode, buffer, prebuffer, test.wantBuffer, test.wantPre)
+		}
+	}
+}
+
+// Each mode gets its own queue depth and as many recent chunks as its
+// prebuffer allows
+func TestLatencyModes(t *testing.T) {
+	options := testOptions()
+	options.Prebuffer = 2
+	station := newStation("test", "/stream", options)
+	for i := 0; i < HIGHLATENCYPREBUFFER*2; i++ {
+		station.pool.Broadcast([]byte("chunk"))
+	}
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	tests := []struct {
+		query               string
+		buffer, prebuffered int
+	}{
+		{"", options.ClientBuffer, options.Prebuffer},
+		{"?latency=low", LOWLATENCYCLIENTBUFFER, 0},
+		{"?latency=high", HIGHLATENCYCLIENTBUFFER, HIGHLATENCYPREBUFFER},
+	}
+	for _, test := range tests {
+		t.Run(cmp.Or(test.query, "default"), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+test.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				if resp, err := http.DefaultClient.Do(r); err == nil {
+					resp.Body.Close()
+				}
+			}()
+			waitFor(t, "the listener", func() bool { return station.pool.Count() == 1 })
+			connection := station.pool.Connections()[0]
+			if got := cap(connection.bufferChannel); got != test.buffer {
+				t.Errorf("queue of %d chunks, want %d", got, test.buffer)
+			}
+			if connection.prebufferChunks != test.prebuffered {
+				t.Errorf("prebuffer of %d chunks, want %d", connection.prebufferChunks, test.prebuffered)
+			}
+			cancel()
+			<-done
+			waitFor(t, "the listener to leave", func() bool { return station.pool.Count() == 0 })
+		})
+	}
+
+	resp, err := http.Get(server.URL + "?latency=medium")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("?latency=medium answered %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
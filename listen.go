@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// validateAddr checks that addr is a host:port a TCP listener can bind and
+// returns its port
+func validateAddr(addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("port %q is not a number between 0 and 65535", port)
+	}
+	return port, nil
+}
+
+// flagGiven reports whether the named flag was set on the command line, as
+// opposed to left at its default
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// listen opens the socket the server accepts listeners on: a Unix domain
+// socket at socketPath if one is given, otherwise TCP on addr
+func listen(socketPath, addr string) (net.Listener, error) {
+	if socketPath == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by a server that didn't shut down cleanly would
+	// make Listen fail, but anything that isn't a socket is left alone
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// The listener unlinks the socket file when the server closes it
+	return net.Listen("unix", socketPath)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// NewLiveStation creates a station that rebroadcasts r, e.g. an encoder
+// piped into stdin, as its data arrives. The encoder already produces audio
+// in real time, so there's no ticker pacing and no looping at EOF.
+func NewLiveStation(name, mount string, r io.Reader, contentType string, options StationOptions) *Station {
+	station := newStation(name, mount, options)
+	station.live = r
+	station.contentType = contentType
+	station.bitrate = options.Bitrate
+	return station
+}
+
+// streamLive broadcasts chunks from the live input until it closes or ctx is
+// cancelled
+func (s *Station) streamLive(ctx context.Context) {
+	chunks := make(chan []byte)
+	readErr := make(chan error, 1)
+
+	// Reads block until the encoder produces data, so they happen on their
+	// own goroutine to keep shutdown from waiting on them
+	go func() {
+		idle := newEmptyReads()
+		for {
+			buffer := s.pool.getBuffer()
+			n, err := s.live.Read(buffer)
+			if n > 0 {
+				select {
+				case chunks <- buffer[:n]:
+				case <-ctx.Done():
+					return
+				}
+			} else {
+				s.pool.putBuffer(buffer)
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if idle.record(ctx, n) != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case chunk := <-chunks:
+			s.pool.Broadcast(chunk)
+			s.lastBroadcast.Store(time.Now().UnixNano())
+			s.pool.putBuffer(chunk)
+		case err := <-readErr:
+			if err != io.EOF {
+				slog.Error("could not read live input", "station", s.Name, "error", err)
+			}
+			slog.Info("live input closed", "station", s.Name)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,136 +1,997 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"flag"
-	"io"
-	"log"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
 	BUFFERSIZE = 8192
 	DELAY      = 150 // ms
+
+	SHUTDOWNTIMEOUT = 5 * time.Second
+	RETRYAFTER      = 30 // seconds, sent with 503s when a station is full
+)
+
+var (
+	ErrPoolFull   = errors.New("station is full")
+	ErrPoolClosed = errors.New("station is shutting down")
 )
 
+// Chunk is one broadcast as handed to a connection
+type Chunk struct {
+	Data []byte
+	Seq  uint64 // counts broadcasts from 1, so a gap means chunks were dropped
+}
+
 type Connection struct {
-	bufferChannel chan []byte
+	id            uint64 // unique across every station, assigned when joining a pool
+	bufferChannel chan Chunk
+
+	// Broadcast sends without holding the pool's lock, so sending and
+	// closing bufferChannel are serialized by the connection's own
+	mu     sync.Mutex
+	closed bool // bufferChannel is closed, guarded by mu
+	drops  int  // consecutive buffers skipped because the client wasn't keeping up, guarded by mu
+
+	remoteAddr string
+	userAgent  string
+	connected  time.Time
+	bytesSent  atomic.Int64 // written by the connection's handler only, read by /stats without the pool lock
+
+	latency         string  // mode the listener asked for, see latencyDepths
+	prebufferChunks int     // how many recent chunks a new listener is sent on joining
+	prebuffer       []Chunk // the most recent chunks as of joining, to send before anything else
+	resumeAfter     uint64  // Seq of the last chunk sent over the listener's previous connection, 0 for a new listener
 }
 
+// send queues chunk for the connection without blocking, reporting whether
+// it was queued and, if its queue was full, how many chunks in a row it has
+// now missed. Nothing is queued, or counted as missed, once the channel has
+// been closed.
+func (c *Connection) send(chunk Chunk) (queued bool, drops int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false, 0
+	}
+	select {
+	case c.bufferChannel <- chunk:
+		c.drops = 0
+		return true, 0
+	default:
+		c.drops++
+		return false, c.drops
+	}
+}
+
+// close closes bufferChannel, which ends the connection's handler once it
+// has written what is already queued. Closing twice does nothing.
+func (c *Connection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.bufferChannel)
+	}
+}
+
+// connectionIDs hands out Connection ids
+var connectionIDs atomic.Uint64
+
 type ConnectionPool struct {
 	mu          sync.Mutex
 	connections map[*Connection]struct{}
+	closed      bool
 	bufferPool  sync.Pool
+	bufferSize  int
+	idleBuffers chan []byte // bounded stand in for bufferPool with -max-idle-buffers, nil to use bufferPool
+
+	buffersAllocated atomic.Uint64
+	buffersReused    atomic.Uint64
+	buffersDropped   atomic.Uint64 // handed back while idleBuffers was full
+
+	maxConnections int // 0 for no limit
+	maxDrops       int // consecutive drops before a slow client is evicted, 0 to never evict
+
+	recent    *ChunkRing // the last chunks broadcast, sent to new listeners
+	prebuffer int        // how many of recent a new listener is sent by default, the rest are for resuming and high latency ones
+	sequence  uint64     // Seq of the last broadcast, guarded by mu
+
+	bytesBroadcast atomic.Uint64 // Kept outside mu so /stats never contends with Broadcast
+	metrics        poolMetrics
+
+	onCountChange func(listeners int) // called with mu held when a listener joins or leaves, may be nil
 }
 
-func NewConnectionPool() *ConnectionPool {
+// NewConnectionPool creates an empty pool of bufferSize byte buffers,
+// labelling its metrics with station
+func NewConnectionPool(station string, bufferSize int) *ConnectionPool {
 	return &ConnectionPool{
 		connections: make(map[*Connection]struct{}),
-		bufferPool: sync.Pool{
-			New: func() interface{} {
-				return make([]byte, BUFFERSIZE)
-			},
-		},
+		metrics:     newPoolMetrics(station),
+		bufferSize:  bufferSize,
 	}
 }
 
-func (cp *ConnectionPool) AddConnection(connection *Connection) {
+// limitIdleBuffers keeps at most max buffers waiting to be reused, in place
+// of a sync.Pool. The garbage collector empties a sync.Pool every other
+// cycle, so under load buffers are allocated again and again; a fixed list
+// keeps them, and lets go of whatever doesn't fit. Call it before the pool
+// is used. 0 keeps the sync.Pool.
+func (cp *ConnectionPool) limitIdleBuffers(max int) {
+	if max > 0 {
+		cp.idleBuffers = make(chan []byte, max)
+	}
+}
+
+// AddConnection joins connection to the pool, failing if the pool is full or
+// closed. The cap is checked under the same lock as the insert so concurrent
+// connects can't overshoot it. The prebuffer is taken under it too, so it
+// runs seamlessly into the first chunk the connection is sent.
+func (cp *ConnectionPool) AddConnection(connection *Connection) error {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
+	if cp.closed {
+		return ErrPoolClosed
+	}
+	if cp.maxConnections > 0 && len(cp.connections) >= cp.maxConnections {
+		return ErrPoolFull
+	}
+	connection.id = connectionIDs.Add(1)
+	if connection.resumeAfter > 0 {
+		connection.prebuffer = cp.recent.After(connection.resumeAfter)
+	} else {
+		connection.prebuffer = cp.recent.Last(connection.prebufferChunks)
+	}
 	cp.connections[connection] = struct{}{}
+	cp.metrics.listeners.Inc()
+	cp.countChanged()
+	return nil
 }
 
 func (cp *ConnectionPool) DeleteConnection(connection *Connection) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
+	if _, ok := cp.connections[connection]; ok { // It may already have been evicted
+		delete(cp.connections, connection)
+		cp.metrics.listeners.Dec()
+		cp.countChanged()
+	}
+}
+
+// countChanged reports the number of listeners to onCountChange, with mu held
+func (cp *ConnectionPool) countChanged() {
+	if cp.onCountChange != nil {
+		cp.onCountChange(len(cp.connections))
+	}
+}
+
+// Count returns the number of connected listeners
+func (cp *ConnectionPool) Count() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return len(cp.connections)
+}
+
+// Kick disconnects the listener with the given id by closing its buffer
+// channel, reporting whether it was in this pool
+func (cp *ConnectionPool) Kick(id uint64) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for connection := range cp.connections {
+		if connection.id == id {
+			cp.remove(connection)
+			cp.countChanged()
+			return true
+		}
+	}
+	return false
+}
+
+// remove takes connection out of the pool and closes its channel, with mu
+// held
+func (cp *ConnectionPool) remove(connection *Connection) {
 	delete(cp.connections, connection)
+	cp.metrics.listeners.Dec()
+	connection.close()
 }
 
-func (cp *ConnectionPool) Broadcast(buffer []byte) {
+// Connections returns the listeners connected right now
+func (cp *ConnectionPool) Connections() []*Connection {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
+	connections := make([]*Connection, 0, len(cp.connections))
+	for connection := range cp.connections {
+		connections = append(connections, connection)
+	}
+	return connections
+}
 
+// Close disconnects every listener by closing its buffer channel. Anything
+// already queued on a channel is still delivered before the handler exits.
+func (cp *ConnectionPool) Close() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.closed = true
 	for connection := range cp.connections {
+		cp.remove(connection)
+	}
+}
+
+// getBuffer returns a bufferSize buffer from the pool. Nothing else should
+// call bufferPool.Get, so the pool only ever holds what putBuffer let in.
+func (cp *ConnectionPool) getBuffer() []byte {
+	if cp.idleBuffers != nil {
 		select {
-		case connection.bufferChannel <- buffer:
-		default: // If the buffer is full, we skip sending to avoid blocking
+		case buffer := <-cp.idleBuffers:
+			cp.buffersReused.Add(1)
+			cp.metrics.buffersReused.Inc()
+			return buffer
+		default:
 		}
+	} else if buffer, ok := cp.bufferPool.Get().([]byte); ok && cap(buffer) == cp.bufferSize {
+		cp.buffersReused.Add(1)
+		cp.metrics.buffersReused.Inc()
+		return buffer[:cp.bufferSize]
 	}
+	cp.buffersAllocated.Add(1)
+	cp.metrics.buffersAllocated.Inc()
+	return make([]byte, cp.bufferSize)
 }
 
-func stream(connectionPool *ConnectionPool, content []byte) {
-	tempfile := bytes.NewReader(content)
-	buffer := connectionPool.bufferPool.Get().([]byte) // Get a buffer from the pool
-	defer connectionPool.bufferPool.Put(buffer)        // Ensure it's put back after use
+// putBuffer hands a buffer, e.g. a broadcast chunk once it's been written,
+// back to the pool. Oversized ones are left to the garbage collector so
+// every pooled buffer stays bufferSize. The caller mustn't touch it again.
+func (cp *ConnectionPool) putBuffer(buffer []byte) {
+	if cap(buffer) != cp.bufferSize {
+		return
+	}
+	if cp.idleBuffers == nil {
+		cp.bufferPool.Put(buffer[:cp.bufferSize])
+		return
+	}
+	select {
+	case cp.idleBuffers <- buffer[:cp.bufferSize]:
+	default:
+		cp.buffersDropped.Add(1)
+	}
+}
 
-	ticker := time.NewTicker(time.Millisecond * DELAY)
-	defer ticker.Stop()
+// BufferStats show how well buffers are being reused. Allocations that keep
+// growing with a steady number of listeners mean buffers aren't coming back
+// in time, e.g. -max-idle-buffers is too low for -client-buffer.
+type BufferStats struct {
+	Size           int    `json:"size"`
+	Allocated      uint64 `json:"allocated"`
+	AllocatedBytes uint64 `json:"allocated_bytes"`
+	Reused         uint64 `json:"reused"`
+	Dropped        uint64 `json:"dropped"` // handed back when -max-idle-buffers were already waiting
+}
 
-	for {
-		// Read data into the buffer
-		n, err := tempfile.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Error reading from tempfile: %v", err)
+func (cp *ConnectionPool) bufferStats() BufferStats {
+	allocated := cp.buffersAllocated.Load()
+	return BufferStats{
+		Size:           cp.bufferSize,
+		Allocated:      allocated,
+		AllocatedBytes: allocated * uint64(cp.bufferSize),
+		Reused:         cp.buffersReused.Load(),
+		Dropped:        cp.buffersDropped.Load(),
+	}
+}
+
+// Broadcast hands every listener its own copy of buffer. The lock is only
+// held to number the chunk and take a snapshot of who is connected, so
+// listeners joining or leaving never wait on the sends. Anyone who joins
+// after the snapshot has the chunk in their prebuffer instead.
+//
+// Listeners are sent to round robin: in the order they joined, starting one
+// further along with every chunk. Whoever is sent to last has had the most
+// time to empty their queue, so under load every listener is first, and
+// last, equally often, rather than as the map's random order falls.
+func (cp *ConnectionPool) Broadcast(buffer []byte) {
+	cp.bytesBroadcast.Add(uint64(len(buffer)))
+	cp.metrics.bytesBroadcast.Add(float64(len(buffer)))
+
+	cp.mu.Lock()
+	cp.sequence++
+	sequence := cp.sequence
+	cp.recent.Push(buffer, sequence)
+	connections := make([]*Connection, 0, len(cp.connections))
+	for connection := range cp.connections { // Empty once closed
+		connections = append(connections, connection)
+	}
+	cp.mu.Unlock()
+
+	slices.SortFunc(connections, func(a, b *Connection) int { return cmp.Compare(a.id, b.id) })
+	var first int
+	if len(connections) > 0 {
+		first = int(sequence % uint64(len(connections)))
+	}
+
+	var evicted []*Connection
+	for i := range connections {
+		connection := connections[(first+i)%len(connections)]
+		// Every connection gets its own copy so the caller can reuse buffer
+		// and no two goroutines ever share a live backing array
+		chunk := cp.getBuffer()
+		if cap(chunk) < len(buffer) { // An OGG chunk carrying a long page
+			cp.putBuffer(chunk)
+			chunk = make([]byte, len(buffer))
+		}
+		chunk = chunk[:len(buffer)]
+		copy(chunk, buffer)
+
+		queued, drops := connection.send(Chunk{Data: chunk, Seq: sequence})
+		if queued {
 			continue
 		}
+		cp.putBuffer(chunk)
+		if drops == 0 { // It left since the snapshot
+			continue
+		}
+		// The listener's queue is full, skip it rather than block everyone else
+		cp.metrics.bufferDrops.Inc()
+
+		// A client that keeps missing chunks hears nothing but glitches, so cut it loose
+		if cp.maxDrops > 0 && drops >= cp.maxDrops {
+			evicted = append(evicted, connection)
+		}
+	}
+
+	if len(evicted) > 0 {
+		cp.mu.Lock()
+		defer cp.mu.Unlock()
+		for _, connection := range evicted {
+			if _, ok := cp.connections[connection]; ok { // It may have left meanwhile
+				cp.remove(connection)
+				cp.countChanged()
+			}
+		}
+	}
+}
+
+// stationFlags collects repeated -station mount=source flags
+type stationFlags []string
+
+func (f *stationFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stationFlags) Set(value string) error {
+	mount, _, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected mount=source, got %q", value)
+	}
+	if err := checkMount(mount, *f); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// reservedMounts are the paths of the built in endpoints, which a station
+// can't be mounted at. /stream can, it's the default station's mount.
+var reservedMounts = []string{"/ws", "/stats", "/healthz", "/version", "/nowplaying", "/history", "/artwork", "/events", "/queue", "/download", "/metrics", "/admin"}
+
+// normalizeMount returns mount with one leading slash and no trailing one
+func normalizeMount(mount string) string {
+	return "/" + strings.Trim(mount, "/")
+}
+
+// checkMount reports why a station can't be mounted at mount when others,
+// mount=source pairs, already are, rather than have net/http panic when the
+// routes are registered
+func checkMount(mount string, others []string) error {
+	mount = normalizeMount(mount)
+	if mount == "/" {
+		return errors.New("a mount needs a name, e.g. /jazz")
+	}
+	for _, c := range mount {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./", c)) {
+			return fmt.Errorf("mount %s can only have letters, digits and - _ . /", mount)
+		}
+	}
+	for _, reserved := range reservedMounts {
+		if mount == reserved || strings.HasPrefix(mount, reserved+"/") {
+			return fmt.Errorf("mount %s is taken by the %s endpoint", mount, reserved)
+		}
+	}
+	for _, other := range others {
+		if otherMount, _, _ := strings.Cut(other, "="); normalizeMount(otherMount) == mount {
+			return fmt.Errorf("mount %s is given twice", mount)
+		}
+	}
+	return nil
+}
+
+// headerFlags collects repeated -header "Name: value" flags
+type headerFlags []string
+
+func (f *headerFlags) String() string {
+	return strings.Join(*f, ", ")
+}
 
-		// Broadcast the read buffer (only the portion that was read)
-		connectionPool.Broadcast(buffer[:n])
-		<-ticker.C // Wait for the ticker to tick before continuing
+func (f *headerFlags) Set(value string) error {
+	if name, _, ok := strings.Cut(value, ":"); !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("expected Name: value, got %q", value)
 	}
+	*f = append(*f, value)
+	return nil
+}
+
+// defaultStreamHeaders stop caches, CDNs and nginx from holding on to a live
+// stream. Without X-Accel-Buffering nginx buffers audio and listeners hear
+// nothing.
+var defaultStreamHeaders = http.Header{
+	"Cache-Control":     {"no-cache, no-store"},
+	"Pragma":            {"no-cache"},
+	"X-Accel-Buffering": {"no"},
+}
+
+// streamHeaders applies -header flags over the defaults. An empty value
+// leaves the header out.
+func streamHeaders(flags headerFlags) http.Header {
+	headers := defaultStreamHeaders.Clone()
+	for _, header := range flags {
+		name, value, _ := strings.Cut(header, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if value == "" {
+			headers.Del(name)
+		} else {
+			headers.Set(name, value)
+		}
+	}
+	return headers
 }
 
 func main() {
 	fname := flag.String("filename", "file.aac", "path of the audio file")
+	playlistPath := flag.String("playlist", "", "path of an M3U or PLS playlist, overrides -filename")
+	dir := flag.String("dir", "", "directory whose audio files are played in name order, rescanned for new and deleted files each time round, overrides -filename and -playlist")
+	recursive := flag.Bool("recursive", false, "include the subdirectories of -dir")
+	name := flag.String("name", "GoRadio", "station name sent to ICY clients")
+	bitrate := flag.Int("bitrate", 0, "bitrate in kbps used to pace the stream, for files whose bitrate can't be detected")
+	contentType := flag.String("content-type", "", "Content-Type sent with every stream instead of the detected one, e.g. audio/flac for a format GoRadio doesn't recognise")
+	maxListeners := flag.Int("max-listeners", 0, "maximum listeners per station, 0 for no limit")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "how long a write to a listener may block before it is disconnected, 0 for no limit")
+	maxDrops := flag.Int("max-drops", 20, "consecutive dropped buffers before a slow listener is disconnected, 0 to never disconnect")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, serves HTTPS when set with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file, serves HTTPS when set with -tls-cert")
+	autocertDomains := flag.String("autocert-domain", "", "get HTTPS certificates for these comma separated domains from Let's Encrypt, serving HTTPS on :443 unless -addr says otherwise and the challenges on :80")
+	autocertCache := flag.String("autocert-cache", "autocert-cache", "directory -autocert-domain keeps its certificates and account key in")
+	autocertEmail := flag.String("autocert-email", "", "address Let's Encrypt may send expiry warnings to, with -autocert-domain")
+	redirectHTTP := flag.Bool("redirect-http", false, "also listen on port 80 and redirect plain HTTP requests to HTTPS")
+	authUser := flag.String("auth-user", "", "require HTTP Basic Auth with this user name to listen")
+	authPass := flag.String("auth-pass", "", "require HTTP Basic Auth with this password to listen")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false, "log as JSON instead of human readable text")
+	fromStdin := flag.Bool("stdin", false, "broadcast live audio piped into stdin instead of -filename, stopping when stdin closes")
+	sourceURL := flag.String("source-url", "", "relay the stream at this http(s) URL, e.g. an Icecast mount, instead of -filename, reconnecting whenever it drops")
+	allowOrigin := flag.String("allow-origin", "*", "origin allowed to fetch streams cross-origin, empty to disable CORS")
+	allowDownload := flag.Bool("allow-download", false, "let listeners download the track playing or one in the history at /download, from inside -media-root only; check the licence allows it")
+	historySize := flag.Int("history-size", 10, "number of recently played tracks listed at /history")
+	shuffle := flag.Bool("shuffle", false, "play playlist tracks in random order")
+	seed := flag.Uint64("seed", 0, "shuffle seed for a reproducible order, 0 picks one at random")
+	mediaRoot := flag.String("media-root", "", "directory that every played or queued track must be inside, queueing is disabled when unset")
+	crossfade := flag.Float64("crossfade", 0, "seconds to overlap consecutive tracks, 16-bit PCM WAV only, streamed as raw PCM behind a streaming header as with -wav-header")
+	normalize := flag.Bool("normalize", false, "bring tracks to a consistent loudness using their ReplayGain tag or RMS level, 16-bit PCM WAV only")
+	mode := flag.String("mode", "live", "live to broadcast to every listener at once, ondemand to serve each track as a seekable file")
+	bufferSize := flag.Int("buffer-size", BUFFERSIZE, "bytes broadcast per tick. Ticks are paced to the track's bitrate, so one tick lasts buffer-size*8/bitrate seconds")
+	delayMs := flag.Int("delay-ms", DELAY, "milliseconds between ticks when a track's bitrate can't be detected and -bitrate isn't set, giving an effective bitrate of buffer-size*8000/delay-ms bps")
+	noLoop := flag.Bool("no-loop", false, "same as -on-eof exit")
+	onEOF := flag.String("on-eof", EOFLOOP, "what to do once the playlist has been played: loop to start again, hold to keep listeners connected with the offline audio, exit to shut the server down")
+	deadAir := flag.Duration("dead-air", 10*time.Second, "how long a station may broadcast nothing before it is reported as dead air, 0 to disable the watchdog")
+	fallback := flag.String("fallback", "", "file broadcast on repeat during dead air until the station recovers")
+	addr := flag.String("addr", ":8080", "host:port to listen on, e.g. 127.0.0.1:9000 or [::1]:8080")
+	unixSocket := flag.String("unix-socket", "", "path of a Unix domain socket to serve on instead of -addr, e.g. behind a reverse proxy")
+	accessLogPath := flag.String("access-log", "", "append a Combined Log Format line per listener to this file, - for stdout. SIGHUP reopens it for rotation")
+	adminUser := flag.String("admin-user", "", "user name for the /admin API, which is disabled unless set with -admin-pass")
+	adminPass := flag.String("admin-pass", "", "password for the /admin API")
+	maxInMemory := flag.Int64("max-inmemory-bytes", 100<<20, "largest file held in memory whole, the -offline-file or a track mapped with -mmap; anything bigger is read from disk as it plays, 0 for no limit")
+	useMmap := flag.Bool("mmap", false, "memory map tracks and keep the mappings while they're unchanged, so every loop reads them from the page cache; falls back to reading where mmap isn't available, ignored with -normalize or -crossfade; replace tracks by renaming a new file over them, a mapped file truncated in place crashes the server")
+	maxIdleBuffers := flag.Int("max-idle-buffers", 0, "chunk buffers kept for reuse per station, e.g. listeners times -client-buffer, instead of a pool the garbage collector empties; 0 for no limit")
+	clientBuffer := flag.Int("client-buffer", 4, "chunks queued per listener so short network hiccups don't drop audio, 0 for none")
+	alignFrames := flag.Bool("align-frames", false, "finish the AAC/MP3 frame in flight before a reload or skip switches tracks, avoiding pops")
+	maxPerIP := flag.Int("max-per-ip", 0, "maximum streams open at once from one IP address across all stations, 0 for no limit")
+	resumeWindow := flag.Duration("resume-window", 0, "how long after a dropped connection a listener may reconnect with ?resume= and the X-Resume-Token it was sent, and be sent the audio it missed first; 0 to not offer it")
+	prebuffer := flag.Int("prebuffer", 2, "recent chunks sent to a new listener straight away so playback starts without waiting for the next tick, 0 for none")
+	genre := flag.String("genre", "", "station genre sent to ICY clients")
+	stationURL := flag.String("url", "", "station website sent to ICY clients")
+	icyAgents := flag.String("icy-agents", "WinampMPEG,NSPlayer", "comma separated User-Agent substrings of legacy players that are answered with ICY 200 OK")
+	logo := flag.String("logo", "", "station logo image served at /artwork for tracks without embedded cover art")
+	offlineFile := flag.String("offline-file", "", "audio broadcast on repeat while a station's source is missing, a built in silence by default")
+	framed := flag.Bool("framed", false, "let clients ask for ?framed=1, which prefixes every chunk with its sequence number and length so gaps can be detected")
+	schedulePath := flag.String("schedule", "", "file of programs such as \"08:00-12:00 => morning.m3u\" that the first station plays at those times of day, local time, instead of its own source")
+	wavHeader := flag.Bool("wav-header", false, "broadcast WAV tracks as raw PCM, sending each listener one streaming WAV header when they connect")
+	adaptivePacing := flag.Bool("adaptive-pacing", false, "adjust every tick so what has been broadcast keeps to real time, correcting the drift of odd sized chunks and late ticks on long running streams")
+	openAttempts := flag.Int("open-attempts", OPENATTEMPTS, "tries at opening a file that can't be read, e.g. on a network share that dropped out, backing off in between before giving up, 1 to not retry")
+	maxDuration := flag.Duration("max-duration", 0, "disconnect each listener after this long so others get a turn, ending the stream cleanly so players can reconnect, 0 for no limit")
+	noKeepalive := flag.Bool("no-keepalive", false, "send Connection: close and never reuse a connection for another request, for clients that hold idle connections open")
+	drainOnShutdown := flag.Bool("drain-on-shutdown", false, "on SIGINT or SIGTERM stop taking new listeners but finish the track playing on every playlist station before exiting, so nobody is cut off mid song")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Minute, "longest -drain-on-shutdown waits for the current tracks to finish before cutting them off")
+	keepaliveInterval := flag.Duration("keepalive-interval", 0, "send listeners a silent frame after this long without audio, e.g. while paused, so proxies don't drop idle connections. MP3 and AAC only, 0 to disable")
+	var stationConfig stationFlags
+	var headerConfig headerFlags
+	var variantConfig variantFlags
+	var allowCIDRs, denyCIDRs, trustedProxies cidrFlags
+	flag.Var(&allowCIDRs, "allow-cidr", "only let listeners in from this network, e.g. 10.0.0.0/8, repeat or separate with commas for several")
+	flag.Var(&denyCIDRs, "deny-cidr", "turn listeners from this network away with a 403, repeat or separate with commas for several. Wins over -allow-cidr")
+	flag.Var(&trustedProxies, "trusted-proxies", "networks of reverse proxies whose X-Forwarded-For is believed, comma separated. Their requests are logged, limited and filtered by the client address it gives")
+	flag.Var(&headerConfig, "header", `"Name: value" header sent with every stream, repeat for several. Streams are sent Cache-Control: no-cache, no-store, Pragma: no-cache and X-Accel-Buffering: no by default, "Name:" removes one`)
+	flag.Var(&stationConfig, "station", "mount=source pair, e.g. /jazz=jazz.m3u, repeat for several stations (overrides -filename and -playlist)")
+	flag.Var(&variantConfig, "variant", "mount=source of another rendition of a station, e.g. /stream-low=low.m3u for a lower bitrate of /stream, repeat for several. It plays alongside the station, which its mount must start with")
+	genSilence := flag.Duration("gen-silence", 0, "write this much silence to -filename, as AAC, MP3 or WAV by its extension, and exit, e.g. for test audio")
+	check := flag.Bool("check", false, "check the settings and every station's tracks, print a summary and exit without serving, non-zero if anything is wrong")
+	configPath := flag.String("config", "", "YAML file of settings named after these flags, flags given on the command line win over it")
 	flag.Parse()
 
-	file, err := os.Open(*fname)
-	if err != nil {
-		log.Fatal(err)
+	if *configPath != "" {
+		if err := loadConfig(*configPath, &stationConfig); err != nil {
+			errs := []error{err}
+			if joined, ok := err.(interface{ Unwrap() []error }); ok {
+				errs = joined.Unwrap()
+			}
+			for _, err := range errs {
+				slog.Error("invalid -config", "path", *configPath, "error", err)
+			}
+			os.Exit(1)
+		}
+	}
+
+	if err := setupLogging(*logLevel, *logJSON); err != nil {
+		fatal("invalid -log-level", "error", err)
+	}
+	build := buildInfo()
+	slog.Info("starting GoRadio", "version", build.Version, "commit", build.Commit, "build_date", build.BuildDate, "go_version", build.GoVersion)
+
+	if *genSilence > 0 {
+		if err := writeSilence(*fname, *genSilence); err != nil {
+			fatal("could not generate silence", "path", *fname, "error", err)
+		}
+		slog.Info("generated silence", "path", *fname, "duration", *genSilence)
+		return
 	}
-	defer file.Close() // Ensure the file is closed after reading
 
-	ctn, err := io.ReadAll(file)
+	useTLS := *tlsCert != "" && *tlsKey != ""
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("-tls-cert and -tls-key must be given together")
+	}
+	var certManager *autocert.Manager
+	if *autocertDomains != "" {
+		if *tlsCert != "" || *tlsKey != "" {
+			fatal("-autocert-domain and -tls-cert/-tls-key can't be used together")
+		}
+		if *unixSocket != "" {
+			fatal("-autocert-domain can't be used with -unix-socket, Let's Encrypt has to reach the server")
+		}
+		var domains []string
+		for _, domain := range strings.Split(*autocertDomains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+		certManager = newAutocertManager(domains, *autocertCache, *autocertEmail)
+		if !flagGiven("addr") {
+			*addr = ":443"
+		}
+	}
+	if *redirectHTTP && !useTLS && certManager == nil {
+		fatal("-redirect-http needs -tls-cert and -tls-key")
+	}
+	if *redirectHTTP && *unixSocket != "" {
+		fatal("-redirect-http can't redirect to -unix-socket")
+	}
+
+	port, err := validateAddr(*addr)
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid -addr", "addr", *addr, "error", err)
+	}
+	if *unixSocket != "" && flagGiven("addr") {
+		fatal("-addr and -unix-socket can't be used together")
 	}
 
-	connPool := NewConnectionPool()
+	if *contentType != "" {
+		if err := validContentType(*contentType); err != nil {
+			fatal("invalid -content-type", "content_type", *contentType, "error", err)
+		}
+	}
 
-	go stream(connPool, ctn)
+	if *mode != "live" && *mode != "ondemand" {
+		fatal("-mode must be live or ondemand", "mode", *mode)
+	}
+	onDemand := *mode == "ondemand"
+	if onDemand && *fromStdin {
+		fatal("-mode ondemand can't serve -stdin")
+	}
+	if *sourceURL != "" && *fromStdin {
+		fatal("-source-url and -stdin can't be used together")
+	}
+	if onDemand && *sourceURL != "" {
+		fatal("-mode ondemand can't serve -source-url")
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Content-Type", "audio/aac")
-		w.Header().Add("Connection", "keep-alive")
+	if *noLoop && !flagGiven("on-eof") {
+		*onEOF = EOFEXIT
+	}
+	if *onEOF != EOFLOOP && *onEOF != EOFHOLD && *onEOF != EOFEXIT {
+		fatal("-on-eof must be loop, hold or exit", "on_eof", *onEOF)
+	}
 
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			log.Println("Could not create flusher")
-			return
+	if *bitrate < 0 {
+		fatal("-bitrate can't be negative", "bitrate", *bitrate)
+	}
+	if *bufferSize <= 0 || *delayMs <= 0 {
+		fatal("-buffer-size and -delay-ms must be positive", "buffer_size", *bufferSize, "delay_ms", *delayMs)
+	}
+
+	if *fallback != "" && *deadAir <= 0 {
+		fatal("-fallback needs a positive -dead-air")
+	}
+
+	credentials := Credentials{User: *authUser, Password: *authPass}
+	if credentials.enabled() && (*authUser == "" || *authPass == "") {
+		fatal("-auth-user and -auth-pass must be given together")
+	}
+	adminCredentials := Credentials{User: *adminUser, Password: *adminPass}
+	ipFilter := NewIPFilter(allowCIDRs, denyCIDRs)
+	if adminCredentials.enabled() && (*adminUser == "" || *adminPass == "") {
+		fatal("-admin-user and -admin-pass must be given together")
+	}
+
+	events := NewEventBus()
+	options := StationOptions{
+		Bitrate:        *bitrate * 1000,
+		ContentType:    *contentType,
+		MaxListeners:   *maxListeners,
+		MaxDrops:       *maxDrops,
+		WriteTimeout:   *writeTimeout,
+		HistorySize:    max(*historySize, 0),
+		Shuffle:        *shuffle,
+		Seed:           *seed,
+		MediaRoot:      *mediaRoot,
+		Crossfade:      time.Duration(*crossfade * float64(time.Second)),
+		Normalize:      *normalize,
+		OnDemand:       onDemand,
+		OnEOF:          *onEOF,
+		AlignFrames:    *alignFrames,
+		BufferSize:     *bufferSize,
+		MaxIdleBuffers: max(*maxIdleBuffers, 0),
+		MMap:           *useMmap,
+		ClientBuffer:   max(*clientBuffer, 0),
+		IPLimiter:      NewIPLimiter(*maxPerIP),
+		Events:         events,
+		Prebuffer:      max(*prebuffer, 0),
+		ResumeWindow:   max(*resumeWindow, 0),
+		Genre:          *genre,
+		URL:            *stationURL,
+		ICYAgents:      strings.Split(*icyAgents, ","),
+		Delay:          time.Duration(*delayMs) * time.Millisecond,
+		DeadAir:        max(*deadAir, 0),
+		OfflineAudio:   defaultOfflineAudio,
+		Framed:         *framed,
+		NoKeepalive:    *noKeepalive,
+		Headers:        streamHeaders(headerConfig),
+		MaxDuration:    max(*maxDuration, 0),
+		OpenAttempts:   *openAttempts,
+		AdaptivePacing: *adaptivePacing,
+		WAVHeader:      *wavHeader,
+		MaxInMemory:    max(*maxInMemory, 0),
+	}
+	if options.Seed == 0 {
+		options.Seed = rand.Uint64()
+	}
+	if *offlineFile != "" {
+		path, err := loadFallback(*offlineFile, *mediaRoot)
+		if err != nil {
+			fatal("invalid -offline-file", "error", err)
+		}
+		if options.OfflineAudio, options.OfflinePath, err = loadOfflineAudio(path, options.MaxInMemory); err != nil {
+			fatal("invalid -offline-file", "error", err)
+		}
+	}
+	if *logo != "" {
+		if options.Logo, err = loadLogo(*logo); err != nil {
+			fatal("invalid -logo", "error", err)
+		}
+	}
+	if *fallback != "" {
+		path, err := loadFallback(*fallback, *mediaRoot)
+		if err != nil {
+			fatal("invalid -fallback", "error", err)
 		}
+		options.Fallback = path
+	}
 
-		connection := &Connection{bufferChannel: make(chan []byte)}
-		connPool.AddConnection(connection)
-		defer connPool.DeleteConnection(connection) // Ensure connection is removed after handling
+	var accessLog *AccessLog // nil logs nothing
+	if *accessLogPath != "" && !*check {
+		accessLog, err = OpenAccessLog(*accessLogPath)
+		if err != nil {
+			fatal("could not open -access-log", "error", err)
+		}
+		defer accessLog.Close()
+	}
 
-		log.Printf("%s has connected to the audio stream\n", r.Host)
+	var stations []*Station
+	if *fromStdin {
+		stations = append(stations, NewLiveStation(*name, "/stream", os.Stdin, "audio/aac", options))
+	} else if *sourceURL != "" {
+		station, err := NewRelayStation(*name, "/stream", *sourceURL, options)
+		if err != nil {
+			fatal("could not connect to -source-url", "url", redactURL(*sourceURL), "error", err)
+		}
+		stations = append(stations, station)
+	} else if len(stationConfig) == 0 {
+		source := *fname
+		if *playlistPath != "" {
+			source = *playlistPath
+		}
+		sourceOptions := options
+		if *dir != "" {
+			source = *dir
+			sourceOptions.Directory = true
+			sourceOptions.Recursive = *recursive
+		}
+		station, err := NewStation(*name, "/stream", source, sourceOptions)
+		if isMissingSource(err) && !onDemand && !*check {
+			station, err = newOfflineStation(*name, "/stream", source, sourceOptions), nil
+		}
+		if err != nil {
+			fatal("could not create station", "source", source, "error", err)
+		}
+		stations = append(stations, station)
+	}
+	for _, config := range stationConfig {
+		mount, source, _ := strings.Cut(config, "=")
+		mount = normalizeMount(mount)
+		station, err := NewStation(strings.TrimPrefix(mount, "/"), mount, source, options)
+		if isMissingSource(err) && !onDemand && !*check {
+			station, err = newOfflineStation(strings.TrimPrefix(mount, "/"), mount, source, options), nil
+		}
+		if err != nil {
+			fatal("could not create station", "mount", mount, "source", source, "error", err)
+		}
+		stations = append(stations, station)
+	}
+	for _, config := range variantConfig {
+		mount, source, _ := strings.Cut(config, "=")
+		mount = normalizeMount(mount)
+		if err := checkMount(mount, stationConfig); err != nil {
+			fatal("invalid -variant", "error", err)
+		}
+		parent := variantParent(stations, mount)
+		if parent == nil {
+			fatal("-variant doesn't belong to a station, its mount must start with one's followed by a dash", "mount", mount)
+		}
+		if parent.playlist == nil || onDemand {
+			fatal("-variant needs a broadcast playlist station", "mount", mount, "station", parent.Mount)
+		}
+		name := parent.Name + "-" + strings.TrimPrefix(mount, parent.Mount+"-")
+		station, err := NewStation(name, mount, source, options)
+		if isMissingSource(err) && !*check {
+			station, err = newOfflineStation(name, mount, source, options), nil
+		}
+		if err != nil {
+			fatal("could not create variant", "mount", mount, "source", source, "error", err)
+		}
+		parent.addVariant(station)
+		stations = append(stations, station)
+	}
+	if *schedulePath != "" {
+		if stations[0].playlist == nil || onDemand {
+			fatal("-schedule needs a broadcast playlist station", "station", stations[0].Mount)
+		}
+		schedule, err := LoadSchedule(*schedulePath, *mediaRoot)
+		if err == nil {
+			err = stations[0].useSchedule(schedule)
+		}
+		if err != nil {
+			fatal("could not load -schedule", "path", *schedulePath, "error", err)
+		}
+	}
+	for _, station := range stations {
+		station.checkPacing()
+	}
+	logEffectiveConfig(flag.CommandLine, stations)
+
+	if *check {
+		if checkStations(os.Stdout, stations, *tlsCert, *tlsKey) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	started := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A station's stream ends on its own when a live input closes or a
+	// -on-eof exit playlist has been played, and takes the whole server down
+	// with it
+	streamEnded := make(chan struct{})
+	var streamEndedOnce sync.Once
+
+	var streams sync.WaitGroup
+	mounts := make(map[*Station]http.HandlerFunc)
+	for _, station := range stations {
+		if onDemand {
+			mounts[station] = accessLog.wrap(allowCORS(*allowOrigin, requireIP(ipFilter, requireAuth(credentials, onDemandHandler(station)))))
+			continue
+		}
+
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			station.stream(ctx)
+			if ctx.Err() == nil {
+				streamEndedOnce.Do(func() { close(streamEnded) })
+			}
+		}()
+		if *keepaliveInterval > 0 {
+			streams.Add(1)
+			go func() {
+				defer streams.Done()
+				station.keepalive(ctx, *keepaliveInterval)
+			}()
+		}
+		if station.deadAir > 0 {
+			streams.Add(1)
+			go func() {
+				defer streams.Done()
+				station.watchdog(ctx)
+			}()
+		}
+
+		mounts[station] = accessLog.wrap(allowCORS(*allowOrigin, requireIP(ipFilter, requireAuth(credentials, streamHandler(station)))))
+	}
+	for station, handler := range mounts {
+		if station.Mount != "/stream" {
+			http.HandleFunc(station.Mount, handler)
+		}
+	}
+	http.HandleFunc("/stream", stationQueryHandler(stations, mounts))
+	http.HandleFunc("/ws", accessLog.wrap(requireIP(ipFilter, requireAuth(credentials, wsHandler(stations, *allowOrigin)))))
+	http.HandleFunc("/{$}", playerHandler(stations))
+	http.HandleFunc("/stats", statsHandler(stations, started, credentials))
+	http.HandleFunc("/healthz", healthzHandler(stations))
+	http.HandleFunc("/version", versionHandler(build))
+	http.HandleFunc("/nowplaying", nowPlayingHandler(stations))
+	http.HandleFunc("/history", historyHandler(stations))
+	http.HandleFunc("/artwork", artworkHandler(stations))
+	http.HandleFunc("/events", eventsHandler(stations, events))
+	http.HandleFunc("GET /queue", queueHandler(stations, *mediaRoot))
+	http.HandleFunc("POST /queue", requireAdmin(adminCredentials, queueHandler(stations, *mediaRoot)))
+	if *allowDownload {
+		http.HandleFunc("/download", accessLog.wrap(allowCORS(*allowOrigin, requireIP(ipFilter, requireAuth(credentials, downloadHandler(stations, *mediaRoot))))))
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("POST /admin/skip", requireAdmin(adminCredentials, skipHandler(stations)))
+	http.HandleFunc("GET /admin/listeners", requireAdmin(adminCredentials, listenersHandler(stations)))
+	http.HandleFunc("POST /admin/kick", requireAdmin(adminCredentials, kickHandler(stations)))
+	http.HandleFunc("POST /admin/pause", requireAdmin(adminCredentials, pauseHandler(stations, true)))
+	http.HandleFunc("POST /admin/resume", requireAdmin(adminCredentials, pauseHandler(stations, false)))
+	http.HandleFunc("POST /admin/reload-playlist", requireAdmin(adminCredentials, reloadPlaylistHandler(stations)))
+
+	server := &http.Server{Addr: *addr, Handler: trustProxies(trustedProxies, http.DefaultServeMux)}
+	server.SetKeepAlivesEnabled(!*noKeepalive)
+	servers := []*http.Server{server}
+	listener, err := listen(*unixSocket, server.Addr)
+	if err != nil {
+		fatal("could not listen", "error", err)
+	}
+	go func() {
+		var err error
+		if certManager != nil {
+			slog.Info("listening for HTTPS with Let's Encrypt certificates", "addr", listener.Addr().String(), "domains", *autocertDomains, "cache", *autocertCache)
+			server.TLSConfig = certManager.TLSConfig()
+			err = server.ServeTLS(listener, "", "")
+		} else if useTLS {
+			slog.Info("listening for HTTPS", "addr", listener.Addr().String())
+			err = server.ServeTLS(listener, *tlsCert, *tlsKey)
+		} else {
+			slog.Info("listening", "addr", listener.Addr().String())
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("server failed", "error", err)
+		}
+	}()
+
+	if *redirectHTTP || certManager != nil {
+		var handler http.Handler = redirectHandler(port)
+		if certManager != nil {
+			handler = certManager.HTTPHandler(handler) // Answers the HTTP-01 challenges, redirects everything else
+		}
+		redirect := &http.Server{Addr: ":80", Handler: handler}
+		servers = append(servers, redirect)
+		go func() {
+			slog.Info("redirecting HTTP to HTTPS", "addr", redirect.Addr)
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("redirect server failed", "error", err)
+			}
+		}()
+	}
 
-		for {
-			buf := <-connection.bufferChannel
-			if _, err := w.Write(buf); err != nil {
-				log.Printf("%s's connection to the audio stream has been closed: %v\n", r.Host, err)
-				return
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	ended := false
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				slog.Info("shutting down", "signal", sig.String())
+				break wait
 			}
-			flusher.Flush()
+
+			slog.Info("reloading audio sources", "signal", sig.String())
+			for _, station := range stations {
+				station.Reload()
+			}
+			if accessLog != nil {
+				if err := accessLog.Reopen(); err != nil {
+					slog.Error("could not reopen access log", "error", err)
+				}
+			}
+		case <-streamEnded:
+			slog.Info("shutting down", "reason", "stream ended")
+			ended = true
+			break wait
+		}
+	}
+
+	// Shutdown stops taking connections straight away but waits for the
+	// streams open to end, which they only do once the pools close
+	shutdownCtx, shutdownCancel := context.WithCancel(context.Background())
+	defer shutdownCancel()
+	var serversDown sync.WaitGroup
+	shutdownServers := func() {
+		for _, server := range servers {
+			serversDown.Add(1)
+			go func() {
+				defer serversDown.Done()
+				if err := server.Shutdown(shutdownCtx); err != nil {
+					slog.Error("could not shut down server", "addr", server.Addr, "error", err)
+				}
+			}()
 		}
-	})
+	}
+	if *drainOnShutdown && !ended {
+		// No new listeners, those already connected hear the tracks out
+		shutdownServers()
+		drainStations(stations, *drainTimeout)
+	}
 
-	log.Println("Listening on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Stop the broadcast first so no more chunks are sent, then let every
+	// handler drain what it has queued and return
+	cancel()
+	streams.Wait()
+	for _, station := range stations {
+		station.pool.Close()
+	}
+	events.Close()
+
+	if !*drainOnShutdown || ended {
+		shutdownServers()
+	}
+	time.AfterFunc(SHUTDOWNTIMEOUT, shutdownCancel)
+	serversDown.Wait()
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStationFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		err    string // in the error for the last value, "" for none
+	}{
+		{"one", []string{"/jazz=jazz.m3u"}, ""},
+		{"several", []string{"/jazz=jazz.m3u", "rock=rock.m3u", "/genre/folk/=folk.m3u"}, ""},
+		{"default mount", []string{"/stream=main.m3u"}, ""},
+		{"no source", []string{"/jazz"}, "expected mount=source"},
+		{"duplicate", []string{"/jazz=a.m3u", "/jazz=b.m3u"}, "given twice"},
+		{"duplicate spelled differently", []string{"/jazz=a.m3u", "jazz/=b.m3u"}, "given twice"},
+		{"reserved", []string{"/stats=a.m3u"}, "taken by the /stats endpoint"},
+		{"reserved prefix", []string{"/admin/skip=a.m3u"}, "taken by the /admin endpoint"},
+		{"metrics", []string{"metrics=a.m3u"}, "taken by the /metrics endpoint"},
+		{"root", []string{"/=a.m3u"}, "needs a name"},
+		{"pattern", []string{"/{station}=a.m3u"}, "can only have"},
+		{"method", []string{"POST /jazz=a.m3u"}, "can only have"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var flags stationFlags
+			var err error
+			for _, value := range test.values {
+				err = flags.Set(value)
+			}
+			if test.err == "" && err != nil {
+				t.Errorf("Set() = %v, want no error", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("Set() = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVariantFlagsRejectDuplicates(t *testing.T) {
+	var flags variantFlags
+	if err := flags.Set("/jazz-low=low.m3u"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Set("/jazz-low/=other.m3u"); err == nil {
+		t.Error("Set() accepted the same variant twice")
+	}
+}
+
+func TestStreamHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		want  http.Header
+	}{
+		{"defaults", nil, defaultStreamHeaders},
+		{"added", []string{"X-Served-By: radio"}, http.Header{"Cache-Control": {"no-cache, no-store"}, "Pragma": {"no-cache"}, "X-Accel-Buffering": {"no"}, "X-Served-By": {"radio"}}},
+		{"replaced and removed", []string{"cache-control: private", "Pragma:"}, http.Header{"Cache-Control": {"private"}, "X-Accel-Buffering": {"no"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var flags headerFlags
+			for _, value := range test.flags {
+				if err := flags.Set(value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := streamHeaders(flags); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("streamHeaders(%q) = %v, want %v", test.flags, got, test.want)
+			}
+		})
+	}
+	if defaultStreamHeaders.Get("Cache-Control") != "no-cache, no-store" {
+		t.Error("streamHeaders() changed the defaults")
+	}
+
+	var flags headerFlags
+	for _, value := range []string{"No colon", ": value"} {
+		if err := flags.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded", value)
+		}
+	}
+}
+
+// Nginx and CDNs are told not to buffer or cache the stream, before any of
+// it is sent
+func TestStreamSendsHeaders(t *testing.T) {
+	options := testOptions()
+	options.Headers = streamHeaders(nil)
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, options)
+	runStation(t, station)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for name, want := range map[string]string{"Cache-Control": "no-cache, no-store, no-transform", "Pragma": "no-cache", "X-Accel-Buffering": "no", "Content-Type": "audio/mpeg"} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
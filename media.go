@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrOutsideMediaRoot = errors.New("path is outside the media root")
+
+// resolvePath turns a requested track path into one that is guaranteed to
+// be inside root, following symlinks so a link can't point back out of it.
+// Relative paths are taken relative to root. An empty root means file
+// access isn't restricted and the path is only cleaned.
+func resolvePath(root, requested string) (string, error) {
+	if root == "" {
+		return filepath.Clean(requested), nil
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Clean(requested)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+
+	if !withinRoot(root, path) {
+		return "", fmt.Errorf("%w: %s", ErrOutsideMediaRoot, requested)
+	}
+
+	// Paths that don't exist yet can't be links, opening them fails anyway
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil || !withinRoot(realRoot, real) {
+			return "", fmt.Errorf("%w: %s", ErrOutsideMediaRoot, requested)
+		}
+	}
+	return path, nil
+}
+
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveLocalPath is resolvePath for paths the operator gave, e.g. on the
+// command line or in a playlist, which are relative to the working
+// directory rather than to root
+func resolveLocalPath(root, path string) (string, error) {
+	if root == "" {
+		return filepath.Clean(path), nil
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return resolvePath(root, abs)
+}
+
+// checkFile makes sure path is a file that can be opened, explaining what's
+// wrong with it otherwise
+func checkFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return sourceError(path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory, not an audio file or playlist", absPath(path))
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return sourceError(path, err)
+	}
+	return file.Close()
+}
+
+// sourceError describes why path couldn't be opened, naming it in full so a
+// path relative to the wrong working directory stands out. It still wraps
+// err for errors.Is.
+func sourceError(path string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err // The path is already in the message
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%s does not exist: %w", absPath(path), err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%s can't be read, check its permissions: %w", absPath(path), err)
+	}
+	return fmt.Errorf("could not open %s: %w", absPath(path), err)
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// checkTracks checks every track of a playlist up front, so all the broken
+// ones are reported together instead of one by one as they come up. Only a
+// playlist with nothing playable is an error.
+func checkTracks(playlist *Playlist) error {
+	var errs []error
+	tracks := playlist.Tracks()
+	for _, track := range tracks {
+		if err := checkFile(track); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(tracks) {
+		return errors.Join(errs...)
+	}
+	if len(errs) > 0 {
+		slog.Warn("some playlist tracks can't be played and will be skipped", "tracks", len(tracks), "unplayable", len(errs), "error", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "jazz"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "jazz"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "track.mp3"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		requested string
+		want      string // relative to root, "" for rejected
+	}{
+		{"track.mp3", "track.mp3"},
+		{"jazz/track.mp3", "jazz/track.mp3"},
+		{"jazz/../track.mp3", "track.mp3"},
+		{"./jazz//track.mp3", "jazz/track.mp3"},
+		{root + "/jazz/track.mp3", "jazz/track.mp3"},
+		{"inside/track.mp3", "inside/track.mp3"}, // A link that stays in the root
+		{"../../etc/passwd", ""},
+		{"jazz/../../etc/passwd", ""},
+		{"/etc/passwd", ""},
+		{"..", ""},
+		{root + "/../" + filepath.Base(outside), ""},
+		{"escape", ""},
+		{"escape/track.mp3", ""},
+		{"..track.mp3", "..track.mp3"}, // Starts with dots but isn't the parent
+	}
+	for _, test := range tests {
+		t.Run(test.requested, func(t *testing.T) {
+			got, err := resolvePath(root, test.requested)
+			if test.want == "" {
+				if !errors.Is(err, ErrOutsideMediaRoot) {
+					t.Errorf("resolvePath() = %q, %v, want %v", got, err, ErrOutsideMediaRoot)
+				}
+				return
+			}
+			if want := filepath.Join(root, test.want); err != nil || got != want {
+				t.Errorf("resolvePath() = %q, %v, want %q", got, err, want)
+			}
+		})
+	}
+}
+
+func TestResolvePathNoRoot(t *testing.T) {
+	if got, err := resolvePath("", "jazz/../../etc/passwd"); err != nil || got != "../etc/passwd" {
+		t.Errorf("resolvePath() = %q, %v, want the path only cleaned", got, err)
+	}
+}
+
+// Paths the operator gives are relative to the working directory, not the
+// root, but still have to end up inside it
+func TestResolveLocalPath(t *testing.T) {
+	root := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if got, err := resolveLocalPath(root, "track.mp3"); err != nil || got != filepath.Join(root, "track.mp3") {
+		t.Errorf("resolveLocalPath() = %q, %v", got, err)
+	}
+	if got, err := resolveLocalPath(filepath.Join(root, "media"), "track.mp3"); !errors.Is(err, ErrOutsideMediaRoot) {
+		t.Errorf("resolveLocalPath() = %q, %v, want %v", got, err, ErrOutsideMediaRoot)
+	}
+}
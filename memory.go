@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// NewMemoryStation creates a station that broadcasts audio on repeat, paced
+// at options.Bitrate, or every options.Delay when that's 0, like a one track
+// playlist. Nothing is read from disk, so tests can stream without any
+// tracks. The format is sniffed from audio.
+func NewMemoryStation(name, mount string, audio []byte, options StationOptions) *Station {
+	station := newStation(name, mount, options)
+	station.memory = func() io.Reader { return bytes.NewReader(audio) }
+	station.contentType = sniffContentType(audio)
+	station.bitrate = options.Bitrate
+	return station
+}
+
+// NewReaderStation creates a station that broadcasts r once, paced like
+// NewMemoryStation, and ends when r does. Unlike NewLiveStation, r is read
+// as fast as the ticker asks rather than as its data arrives, so it can be
+// anything from a bytes.Reader to a generator.
+func NewReaderStation(name, mount string, r io.Reader, contentType string, options StationOptions) *Station {
+	station := newStation(name, mount, options)
+	var once sync.Once
+	station.memory = func() (next io.Reader) {
+		once.Do(func() { next = r })
+		return next
+	}
+	station.contentType = contentType
+	station.bitrate = options.Bitrate
+	return station
+}
+
+// streamMemory broadcasts the station's in-memory source, pass after pass,
+// until it has no more or ctx is cancelled
+func (s *Station) streamMemory(ctx context.Context) {
+	buffer := s.pool.getBuffer()
+	defer s.pool.putBuffer(buffer)
+
+	interval, factor := s.delay, 0.0
+	if s.overrideBitrate > 0 {
+		interval, factor = tickInterval(s.bufferSize, s.overrideBitrate), 1
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pace := s.trackPacer(interval, factor)
+
+	for source := s.memory(); source != nil; source = s.memory() {
+		if s.playMemory(ctx, source, buffer, ticker, interval, pace) {
+			return
+		}
+	}
+	slog.Info("in-memory source finished", "station", s.Name)
+}
+
+// playMemory broadcasts one pass of source, reporting whether streamMemory
+// should stop. A panic in source, e.g. a generator's, ends the pass rather
+// than the server, like a track's in playTrack.
+func (s *Station) playMemory(ctx context.Context, source io.Reader, buffer []byte, ticker *time.Ticker, interval time.Duration, pace *pacer) (done bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("panic while streaming in-memory source", "station", s.Name, "panic", r, "stack", string(debug.Stack()))
+			// Don't spin if the next pass panics straight away too
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				done = true
+			}
+		}
+	}()
+
+	err := s.streamTrack(ctx, source, buffer, ticker, interval, pace)
+	for err == errReload {
+		err = s.streamTrack(ctx, source, buffer, ticker, interval, pace) // There's nothing to reload from
+	}
+	if ctx.Err() != nil {
+		return true
+	}
+	if err == errEmptyTrack {
+		slog.Warn("in-memory source has no audio", "station", s.Name)
+		return true
+	} else if err != nil && err != errSkip {
+		slog.Error("could not read in-memory source", "station", s.Name, "error", err)
+		return true
+	}
+	return false
+}
+
+// ServeStations streams stations at their mounts from a server on an
+// ephemeral port of the loopback interface, returning its base URL, e.g.
+// http://127.0.0.1:41234. Everything stops when ctx is cancelled. It's the
+// bare streaming path, without the middleware, pages or admin endpoints
+// main sets up, for tests.
+func ServeStations(ctx context.Context, stations ...*Station) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	for _, station := range stations {
+		go station.stream(ctx)
+		mux.HandleFunc(station.Mount, streamHandler(station))
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("server failed", "addr", listener.Addr().String(), "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		for _, station := range stations {
+			station.pool.Close() // Ends the streams, which Shutdown waits for
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWNTIMEOUT)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	return "http://" + listener.Addr().String(), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// panicReader hands out n bytes, then panics like a parser choking on them
+type panicReader struct{ n int }
+
+func (p *panicReader) Read(b []byte) (int, error) {
+	if p.n <= 0 {
+		panic("bad data")
+	}
+	n := min(len(b), p.n)
+	p.n -= n
+	return n, nil
+}
+
+// A source that panics ends its own station's stream, while the server
+// carries on streaming every other
+func TestPanicKeepsServing(t *testing.T) {
+	healthy := NewMemoryStation("healthy", "/healthy", []byte("healthy audio "), testOptions())
+	panicking := NewReaderStation("panicking", "/panicking", &panicReader{n: 4096}, "audio/mpeg", testOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	base, err := ServeStations(ctx, healthy, panicking)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-panicking.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("panicking station still streaming")
+	}
+
+	resp, err := http.Get(base + "/healthy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got := make([]byte, 3*len("healthy audio "))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(got, []byte("healthy audio ")) {
+		t.Errorf("streamed %q after the panic", got)
+	}
+}
+
+// End to end: a memory station served over HTTP sends its audio whole, pass
+// after pass, at its bitrate, and the stream ends cleanly on shutdown
+func TestServeMemoryStation(t *testing.T) {
+	audio := bytes.Repeat(silentMPEGFrame, 3)
+	for i := range audio {
+		if i%len(silentMPEGFrame) >= 4 {
+			audio[i] = byte(i)
+		}
+	}
+	options := testOptions()
+	options.BufferSize = len(audio)       // A pass a chunk
+	options.Bitrate = len(audio) * 8 * 20 // 50ms a pass
+	station := NewMemoryStation("memory", "/memory", audio, options)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	base, err := ServeStations(ctx, station)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(base + "/memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "audio/mpeg" {
+		t.Errorf("Content-Type = %q, want audio/mpeg", got)
+	}
+	const passes = 5
+	start := time.Now()
+	got := make([]byte, passes*len(audio))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if want := bytes.Repeat(audio, passes); !bytes.Equal(got, want) {
+		t.Error("streamed bytes differ from the audio on repeat")
+	}
+	if least := (passes - 1) * 50 * time.Millisecond * 7 / 10; elapsed < least || elapsed > 2*time.Second {
+		t.Errorf("%d passes took %v, want about %v", passes, elapsed, (passes-1)*50*time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-station.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("station still streaming after shutdown")
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("stream didn't end cleanly: %v", err)
+	}
+}
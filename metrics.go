@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	listenersGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goradio_listeners",
+		Help: "Number of listeners currently connected.",
+	}, []string{"station"})
+
+	bytesBroadcastCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goradio_bytes_broadcast_total",
+		Help: "Bytes of audio broadcast, counted once per chunk rather than per listener.",
+	}, []string{"station"})
+
+	bufferDropsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goradio_buffer_drops_total",
+		Help: "Chunks skipped because a listener wasn't keeping up.",
+	}, []string{"station"})
+
+	broadcastLagGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goradio_broadcast_lag_seconds",
+		Help: "How late the last broadcast tick was, i.e. how far the stream fell behind real time.",
+	}, []string{"station"})
+
+	buffersAllocatedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goradio_buffers_allocated_total",
+		Help: "Chunk buffers allocated because none was free to reuse.",
+	}, []string{"station"})
+
+	buffersReusedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goradio_buffers_reused_total",
+		Help: "Chunk buffers taken from the pool instead of allocated.",
+	}, []string{"station"})
+
+	trackChangesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goradio_track_changes_total",
+		Help: "Number of times a station moved on to a new track.",
+	}, []string{"station"})
+)
+
+// poolMetrics are a pool's metrics with its station label already applied,
+// so the broadcast path doesn't look up label values on every chunk
+type poolMetrics struct {
+	listeners      prometheus.Gauge
+	bytesBroadcast prometheus.Counter
+	bufferDrops    prometheus.Counter
+
+	buffersAllocated prometheus.Counter
+	buffersReused    prometheus.Counter
+}
+
+func newPoolMetrics(station string) poolMetrics {
+	return poolMetrics{
+		listeners:      listenersGauge.WithLabelValues(station),
+		bytesBroadcast: bytesBroadcastCounter.WithLabelValues(station),
+		bufferDrops:    bufferDropsCounter.WithLabelValues(station),
+
+		buffersAllocated: buffersAllocatedCounter.WithLabelValues(station),
+		buffersReused:    buffersReusedCounter.WithLabelValues(station),
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// mappedFile is a track memory mapped with -mmap. The mapping is kept for as
+// long as the file is unchanged, so every time round the playlist the track
+// is read straight from the page cache instead of through the file.
+type mappedFile struct {
+	data    []byte // nil for a track too large to map, which is read from the file
+	size    int64
+	modTime time.Time
+}
+
+// mappedTrack returns a reader over the rest of file, from where it's at,
+// out of its memory mapping, mapping it first if it isn't or has changed
+// since. file itself is then only used to tell. It comes back as it is if
+// it can't be mapped, e.g. on a platform without mmap, and reads carry on
+// normally. Runs on the stream goroutine.
+func (s *Station) mappedTrack(file *os.File) io.Reader {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return file
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return file
+	}
+
+	path := file.Name()
+	mapped, ok := s.mmaps[path]
+	if !ok || mapped.size != info.Size() || !mapped.modTime.Equal(info.ModTime()) {
+		if ok && mapped.data != nil {
+			unmapFile(mapped.data)
+		}
+		delete(s.mmaps, path)
+		if s.maxInMemory > 0 && info.Size() > s.maxInMemory {
+			// Remembered, so this is only logged once the file changes
+			slog.Info("track is larger than -max-inmemory-bytes, reading it from disk instead of mapping it", "station", s.Name, "track", path, "size", info.Size(), "max_inmemory_bytes", s.maxInMemory)
+			s.mmaps[path] = &mappedFile{size: info.Size(), modTime: info.ModTime()}
+			return file
+		}
+		data, err := mapFile(file, info.Size())
+		if err != nil {
+			slog.Debug("could not memory map track, reading it instead", "station", s.Name, "track", path, "error", err)
+			return file
+		}
+		mapped = &mappedFile{data: data, size: info.Size(), modTime: info.ModTime()}
+		s.mmaps[path] = mapped
+	}
+	if mapped.data == nil {
+		return file
+	}
+	return bytes.NewReader(mapped.data[min(offset, mapped.size):])
+}
+
+// unmapRemoved drops the mappings of tracks that are no longer in the
+// playlist, e.g. after a reload or a rescan, so their memory and the files
+// themselves are let go of. Runs on the stream goroutine.
+func (s *Station) unmapRemoved() {
+	if len(s.mmaps) == 0 {
+		return
+	}
+	keep := make(map[string]bool)
+	for _, track := range s.playlist.Tracks() {
+		if path, err := resolveLocalPath(s.mediaRoot, track); err == nil {
+			keep[path] = true
+		}
+	}
+	for path, mapped := range s.mmaps {
+		if keep[path] {
+			continue
+		}
+		if mapped.data != nil {
+			unmapFile(mapped.data)
+		}
+		delete(s.mmaps, path)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile always fails, there is no mmap here, so tracks are read as usual
+func mapFile(*os.File, int64) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func unmapFile([]byte) {}
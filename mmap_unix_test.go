@@ -0,0 +1,188 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMappedTrack(t *testing.T) {
+	path := writeTestFile(t, "track.mp3", []byte("0123456789"))
+	options := testOptions()
+	options.MMap = true
+	station := newStation("test", "/stream", options)
+
+	read := func(offset int64) (string, []byte) {
+		t.Helper()
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.Seek(offset, io.SeekStart)
+		data, err := io.ReadAll(station.mappedTrack(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped := station.mmaps[path]
+		if mapped == nil || mapped.data == nil {
+			t.Fatal("track wasn't memory mapped")
+		}
+		return string(data), mapped.data
+	}
+
+	got, first := read(0)
+	if got != "0123456789" {
+		t.Errorf("read %q through the mapping", got)
+	}
+	got, second := read(4) // From where the file is at, e.g. past an ID3 tag
+	if got != "456789" {
+		t.Errorf("read %q from offset 4", got)
+	}
+	if &first[0] != &second[0] {
+		t.Error("track mapped again though it hadn't changed")
+	}
+
+	if err := os.WriteFile(path, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := read(0); got != "changed" {
+		t.Errorf("read %q after the track changed, want it mapped afresh", got)
+	}
+}
+
+// Tracks over -max-inmemory-bytes are read from the file instead of mapped
+func TestMappedTrackMaxInMemory(t *testing.T) {
+	data := []byte("0123456789")
+	for limit, mapped := range map[int64]bool{0: true, 10: true, 9: false} {
+		path := writeTestFile(t, "track.mp3", data)
+		options := testOptions()
+		options.MMap = true
+		options.MaxInMemory = limit
+		station := newStation("test", "/stream", options)
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		source := station.mappedTrack(file)
+		if got := source != io.Reader(file); got != mapped {
+			t.Errorf("limit %d: mapped = %v, want %v", limit, got, mapped)
+		}
+		if got, err := io.ReadAll(source); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("limit %d: read %q, %v, want %q", limit, got, err, data)
+		}
+		if entry := station.mmaps[path]; entry == nil || (entry.data != nil) != mapped {
+			t.Errorf("limit %d: remembered %+v", limit, entry)
+		}
+		file.Close()
+	}
+}
+
+// A station reading through the mapping broadcasts the same bytes, loop
+// after loop
+func TestMMapStream(t *testing.T) {
+	track := bytes.Repeat(silentMPEGFrame, 5)
+	for i := range track {
+		if i%len(silentMPEGFrame) >= 4 {
+			track[i] = byte(i)
+		}
+	}
+	path := writeTestFile(t, "track.mp3", track)
+	options := testOptions()
+	options.MMap = true
+	station, err := NewStation("test", "/stream", path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newTestConnection(16)
+	if err := station.pool.AddConnection(listener); err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+
+	want := bytes.Repeat(track, 3)
+	var received []byte
+	for len(received) < len(want) {
+		select {
+		case chunk := <-listener.bufferChannel:
+			received = append(received, chunk.Data...)
+		case <-time.After(time.Second):
+			t.Fatalf("stream stopped after %d bytes", len(received))
+		}
+	}
+	if !bytes.Equal(received[:len(want)], want) {
+		t.Error("broadcast through the mapping differs from the track")
+	}
+}
+
+// A track replaced by renaming a new file over it, the safe way to change a
+// mapped track, is mapped afresh from the new file
+func TestMappedTrackRenamedOver(t *testing.T) {
+	path := writeTestFile(t, "track.mp3", []byte("0123456789"))
+	options := testOptions()
+	options.MMap = true
+	station := newStation("test", "/stream", options)
+
+	read := func() string {
+		t.Helper()
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		data, err := io.ReadAll(station.mappedTrack(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	read()
+	replacement := filepath.Join(filepath.Dir(path), "new.mp3")
+	if err := os.WriteFile(replacement, []byte("replaced!!"), 0o644); err != nil { // Same size
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second) // Past the modification time granularity
+	if err := os.Chtimes(replacement, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != "replaced!!" {
+		t.Errorf("read %q after the track was renamed over, want the new file", got)
+	}
+}
+
+// Tracks that have left the playlist are unmapped once a reload is played
+func TestUnmapRemoved(t *testing.T) {
+	kept := writeTestFile(t, "kept.mp3", []byte("kept"))
+	removed := writeTestFile(t, "removed.mp3", []byte("removed"))
+	options := testOptions()
+	options.MMap = true
+	station := newStation("test", "/stream", options)
+	station.playlist = NewPlaylist(kept, removed)
+	for _, path := range []string{kept, removed} {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		station.mappedTrack(file)
+		file.Close()
+	}
+
+	station.pending.Store(&[]string{kept})
+	station.advance(false)
+	if station.mmaps[kept] == nil {
+		t.Error("track still in the playlist was unmapped")
+	}
+	if _, ok := station.mmaps[removed]; ok {
+		t.Error("track no longer in the playlist is still mapped")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Normalizing scales PCM samples, so like crossfading it only applies to
+// 16-bit PCM WAV tracks. A track's ReplayGain is used if it has one,
+// otherwise its gain is worked out from the RMS level of its samples. MP3,
+// AAC and OGG tracks would need decoding and re-encoding, so they're always
+// played as they are.
+const (
+	normalizeTarget  = -18.0 // dBFS RMS every track is brought to
+	normalizeMaxGain = 12.0  // dB either way, so near silence isn't blown up into noise
+)
+
+// parseReplayGain reads a replaygain_track_gain value such as "-6.48 dB"
+func parseReplayGain(value string) (float64, bool) {
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "dB"))
+	gain, err := strconv.ParseFloat(value, 64)
+	return gain, err == nil
+}
+
+// normalizeSource returns file with its samples scaled to the normalized
+// level, or file untouched if it isn't 16-bit PCM WAV. file must be at the
+// start of the WAV header.
+func (s *Station) normalizeSource(file *os.File, tag ID3Tag) io.Reader {
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return file
+	}
+	counter := &countingReader{r: file}
+	format, err := readWAVHeader(counter)
+	if err != nil || !format.mixable() {
+		file.Seek(start, io.SeekStart)
+		if tag.HasGain {
+			slog.Debug("ReplayGain can only be applied to PCM WAV tracks, playing as is", "station", s.Name)
+		}
+		return file
+	}
+	header := make([]byte, counter.n)
+	file.ReadAt(header, start)
+
+	gain, fromTag := tag.Gain, tag.HasGain
+	if !fromTag {
+		gain = pcmGain(io.LimitReader(file, format.dataSize))
+		file.Seek(start+counter.n, io.SeekStart)
+	}
+	gain = max(-normalizeMaxGain, min(gain, normalizeMaxGain))
+	slog.Debug("normalizing track", "station", s.Name, "gain_db", gain, "replaygain", fromTag)
+
+	return io.MultiReader(
+		bytes.NewReader(header),
+		&gainReader{r: io.LimitReader(file, format.dataSize), factor: math.Pow(10, gain/20)},
+		file, // Any chunks after the samples
+	)
+}
+
+// pcmGain works out the gain in dB that brings 16-bit samples to
+// normalizeTarget, held back so the loudest sample doesn't clip
+func pcmGain(r io.Reader) float64 {
+	var sum float64
+	var count, peak int
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := io.ReadFull(r, buffer)
+		for i := 0; i+1 < n; i += 2 {
+			sample := int(int16(binary.LittleEndian.Uint16(buffer[i:])))
+			sum += float64(sample * sample)
+			peak = max(peak, sample, -sample)
+			count++
+		}
+		if err != nil {
+			break
+		}
+	}
+	if count == 0 || peak == 0 {
+		return 0 // Silence stays silent
+	}
+
+	rms := math.Sqrt(sum / float64(count))
+	gain := normalizeTarget - 20*math.Log10(rms/math.MaxInt16)
+	headroom := -20 * math.Log10(float64(peak)/math.MaxInt16)
+	return min(gain, headroom)
+}
+
+// gainReader scales the 16-bit little endian samples read through it by
+// factor, clipping at full scale
+type gainReader struct {
+	r      io.Reader
+	factor float64
+	carry  []byte // half a sample left over from the last read
+}
+
+func (g *gainReader) Read(p []byte) (int, error) {
+	if len(p) < 2 {
+		return 0, io.ErrShortBuffer // No room for a whole sample
+	}
+	for {
+		n := copy(p, g.carry)
+		g.carry = g.carry[:0]
+		m, err := g.r.Read(p[n:])
+		n += m
+
+		whole := n &^ 1
+		if whole < n && err == nil {
+			g.carry = append(g.carry, p[whole])
+			n = whole
+		}
+		for i := 0; i+1 < whole; i += 2 {
+			sample := float64(int16(binary.LittleEndian.Uint16(p[i:]))) * g.factor
+			sample = math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(sample)))
+			binary.LittleEndian.PutUint16(p[i:], uint16(int16(sample)))
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseReplayGain(t *testing.T) {
+	for value, want := range map[string]float64{
+		"-6.48 dB": -6.48,
+		"+2.5dB":   2.5,
+		" 0.00 ":   0,
+	} {
+		if got, ok := parseReplayGain(value); !ok || got != want {
+			t.Errorf("parseReplayGain(%q) = %v, %v, want %v", value, got, ok, want)
+		}
+	}
+	if _, ok := parseReplayGain("loud"); ok {
+		t.Error(`parseReplayGain("loud") succeeded`)
+	}
+}
+
+func TestPCMGain(t *testing.T) {
+	quiet := pcmWAV(100*time.Millisecond, 1000)[44:]
+	want := normalizeTarget - 20*math.Log10(1000.0/math.MaxInt16)
+	if got := pcmGain(bytes.NewReader(quiet)); math.Abs(got-want) > 0.01 {
+		t.Errorf("pcmGain() = %.2f dB, want %.2f", got, want)
+	}
+	// Held back so the peak stays under full scale
+	loud := pcmWAV(100*time.Millisecond, 1000)[44:]
+	loud[0], loud[1] = 0x00, 0x40 // 16384
+	if got := pcmGain(bytes.NewReader(loud)); got > 20*math.Log10(math.MaxInt16/16384.0) {
+		t.Errorf("pcmGain() = %.2f dB, would clip the peak", got)
+	}
+	if got := pcmGain(bytes.NewReader(make([]byte, 100))); got != 0 {
+		t.Errorf("pcmGain(silence) = %v, want 0", got)
+	}
+}
+
+// With -normalize and -crossfade, the samples are scaled before they're
+// mixed, so the tracks and the fade between them are all at the new level
+func TestNormalizeCrossfade(t *testing.T) {
+	options := testOptions()
+	options.Normalize = true
+	options.Crossfade = 100 * time.Millisecond
+	station := newStation("Test", "/test", options)
+	station.contentType = "audio/wav"
+	double := ID3Tag{Gain: 20 * math.Log10(2), HasGain: true}
+
+	play := func(value int16) []byte {
+		t.Helper()
+		file, err := os.Open(writeTestFile(t, "track.wav", pcmWAV(500*time.Millisecond, value)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		pcm, err := io.ReadAll(station.trackSource(file, double))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pcm
+	}
+	first, second := play(1000), play(-1000)
+
+	if got := sampleAt(first, 0); got != 2000 {
+		t.Errorf("first track starts at %d, want 2000", got)
+	}
+	fade := len(station.fadeTail) / 2
+	if fade == 0 {
+		t.Fatal("nothing held back to fade into the next track")
+	}
+	for i, want := range map[int]int16{0: 2000, fade / 2: 0, len(second)/2 - 1: -2000} {
+		if got := sampleAt(second, i); got < want-2 || got > want+2 {
+			t.Errorf("sample %d of the second track = %d, want about %d", i, got, want)
+		}
+	}
+	if got := sampleAt(station.fadeTail, fade-1); got != -2000 {
+		t.Errorf("tail held for the next fade is at %d, want -2000", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NowPlaying is published by the stream goroutine each time a track starts
+type NowPlaying struct {
+	Station string    `json:"station"`
+	Mount   string    `json:"mount"`
+	File    string    `json:"file"`
+	Title   string    `json:"title"`
+	Artist  string    `json:"artist"`
+	Album   string    `json:"album"`
+	Started time.Time `json:"started"`
+	Elapsed float64   `json:"elapsed_seconds"`
+	Artwork bool      `json:"has_artwork"`       // the track has cover art of its own at /artwork
+	Program string    `json:"program,omitempty"` // the scheduled program on, see Schedule
+
+	path    string
+	artwork []byte
+}
+
+// setNowPlaying records that track has just started. The title falls back
+// to the filename for untagged tracks.
+func (s *Station) setNowPlaying(track string, tag ID3Tag) {
+	var artwork []byte
+	if _, ok := imageType(tag.Picture); ok {
+		artwork = tag.Picture
+	}
+	s.nowPlaying.Store(&NowPlaying{
+		Station: s.Name,
+		Mount:   s.Mount,
+		File:    filepath.Base(track),
+		Title:   cmp.Or(tag.Title, trackTitle(track)),
+		Artist:  tag.Artist,
+		Album:   tag.Album,
+		Started: time.Now(),
+		Artwork: artwork != nil,
+		Program: s.programName(),
+		path:    track,
+		artwork: artwork,
+	})
+	s.events.Publish(s.trackEvent())
+}
+
+// NowPlaying returns the current track, with zero values if nothing has
+// started yet or the station is live
+func (s *Station) NowPlaying() NowPlaying {
+	current := s.nowPlaying.Load()
+	if current == nil {
+		return NowPlaying{Station: s.Name, Mount: s.Mount}
+	}
+
+	nowPlaying := *current
+	nowPlaying.Elapsed = time.Since(nowPlaying.Started).Seconds()
+	return nowPlaying
+}
+
+// findStation looks a station up by name or mount, e.g. "jazz" or "/jazz"
+func findStation(stations []*Station, key string) *Station {
+	for _, station := range stations {
+		if station.Name == key || station.Mount == "/"+strings.TrimPrefix(key, "/") {
+			return station
+		}
+	}
+	return nil
+}
+
+// nowPlayingHandler returns every station's current track, or just one
+// station's with ?station=name
+func nowPlayingHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body any
+		if key := r.URL.Query().Get("station"); key != "" {
+			station := findStation(stations, key)
+			if station == nil {
+				http.Error(w, "Unknown station", http.StatusNotFound)
+				return
+			}
+			body = station.NowPlaying()
+		} else {
+			var all []NowPlaying
+			for _, station := range stations {
+				all = append(all, station.NowPlaying())
+			}
+			body = all
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			slog.Error("could not write now playing", "error", err)
+		}
+	}
+}
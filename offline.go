@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	OFFLINEPOLL     = 5 * time.Second // how often an offline station looks for its source
+	OFFLINEHEADSIZE = 256 * 1024      // bytes of offline audio streamed from disk kept to detect its format and bitrate
+)
+
+// What a station does once its playlist has been played through, see -on-eof
+const (
+	EOFLOOP = "loop" // start again from the top
+	EOFHOLD = "hold" // keep listeners connected with the offline audio
+	EOFEXIT = "exit" // stop the stream, which shuts the server down
+)
+
+// defaultOfflineAudio is played by stations whose source is missing, unless
+// -offline-file gives something else. It's two seconds of MP3 silence.
+//
+//go:embed web/offline.mp3
+var defaultOfflineAudio []byte
+
+// newOfflineStation creates a station whose source doesn't exist yet. It
+// broadcasts offlineAudio on repeat and goes on air with source as soon as
+// it appears.
+func newOfflineStation(name, mount, source string, options StationOptions) *Station {
+	station := newStation(name, mount, options)
+	station.playlist = NewPlaylist(source) // Stands in for the real tracks until they're loaded
+	station.queue = &Queue{}
+	station.source = source
+	station.offline.Store(true)
+	if options.Shuffle {
+		station.playlist.Shuffle(options.Seed)
+	}
+
+	// Players can't switch formats mid-stream, so the format is settled
+	// now from what the source will be called
+	var ok bool
+	if station.contentType, ok = extensionContentTypes[strings.ToLower(filepath.Ext(source))]; !ok {
+		station.contentType = sniffContentType(options.OfflineAudio)
+	}
+	station.bitrate = options.Bitrate
+	return station
+}
+
+// isMissingSource reports whether NewStation failed only because its source
+// isn't there (yet)
+func isMissingSource(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// streamOffline broadcasts the offline audio until the station's source can
+// be loaded, reporting false if ctx was cancelled first
+func (s *Station) streamOffline(ctx context.Context, buffer []byte, ticker *time.Ticker) bool {
+	slog.Warn("source missing, broadcasting offline audio until it appears", "station", s.Name, "source", s.source, "path", absPath(s.source))
+	poll := time.NewTicker(OFFLINEPOLL)
+	defer poll.Stop()
+	return s.repeatOffline(ctx, buffer, ticker, poll.C, s.tryGoingOnAir)
+}
+
+// streamHold broadcasts the offline audio once the playlist has been played,
+// so listeners stay connected, until ctx is cancelled
+func (s *Station) streamHold(ctx context.Context, buffer []byte, ticker *time.Ticker) {
+	slog.Info("holding listeners with the offline audio", "station", s.Name)
+	s.ended.Store(true)
+	s.repeatOffline(ctx, buffer, ticker, nil, nil)
+}
+
+// repeatOffline broadcasts the offline audio on repeat, calling done every
+// time poll ticks to ask whether to stop. It reports false if ctx was
+// cancelled first. With a nil poll it only stops for ctx.
+func (s *Station) repeatOffline(ctx context.Context, buffer []byte, ticker *time.Ticker, poll <-chan time.Time, done func() bool) bool {
+	ticker.Reset(s.offlineInterval())
+	var audio io.ReadSeeker = bytes.NewReader(s.offlineAudio)
+	silent := len(s.offlineAudio) == 0
+	if s.offlinePath != "" {
+		file, err := os.Open(s.offlinePath)
+		if err != nil {
+			slog.Error("could not open the offline audio, broadcasting nothing", "station", s.Name, "path", s.offlinePath, "error", err)
+			audio, silent = bytes.NewReader(nil), true
+		} else {
+			defer file.Close()
+			audio = file
+		}
+	}
+
+	for {
+		select {
+		case <-poll:
+			if done() {
+				return true
+			}
+		default:
+		}
+
+		n, err := audio.Read(buffer)
+		if n > 0 {
+			s.pool.Broadcast(buffer[:n])
+			s.lastBroadcast.Store(time.Now().UnixNano())
+		}
+		if n > 0 || silent { // Silence still waits for the poll
+			select {
+			case <-ticker.C:
+			case request := <-s.skip:
+				close(request) // There's no track to skip
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if err == io.EOF {
+			audio.Seek(0, io.SeekStart)
+		}
+	}
+}
+
+// tryGoingOnAir loads the station's source if it has appeared
+func (s *Station) tryGoingOnAir() bool {
+	playlist, err := s.loadSource()
+	if err != nil {
+		if !isMissingSource(err) {
+			slog.Error("source appeared but can't be loaded", "station", s.Name, "source", s.source, "error", err)
+		}
+		return false
+	}
+
+	if contentType, err := playlistContentType(playlist); err == nil && contentType != s.contentType {
+		slog.Warn("source format differs from the stream", "station", s.Name, "format", contentType, "stream_format", s.contentType)
+	}
+	s.playlist.Replace(playlist.Tracks())
+	s.offline.Store(false)
+	slog.Info("source appeared, going on air", "station", s.Name, "source", s.source)
+	return true
+}
+
+// offlineInterval paces the offline audio like any other track
+func (s *Station) offlineInterval() time.Duration {
+	if s.overrideBitrate > 0 {
+		return tickInterval(s.bufferSize, s.overrideBitrate)
+	}
+	if bitrate := framesBitrate(s.offlineAudio); bitrate > 0 {
+		return tickInterval(s.bufferSize, bitrate)
+	}
+	return s.delay
+}
+
+// loadOfflineAudio reads the -offline-file at path into memory, unless it's
+// larger than maxInMemory. Then only its start is read, to tell its format
+// and bitrate by, and streamPath is set for it to be read from disk every
+// time round instead.
+func loadOfflineAudio(path string, maxInMemory int64) (audio []byte, streamPath string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if maxInMemory <= 0 || info.Size() <= maxInMemory {
+		audio, err = os.ReadFile(path)
+		return audio, "", err
+	}
+
+	slog.Info("offline audio is larger than -max-inmemory-bytes, streaming it from disk", "path", path, "size", info.Size(), "max_inmemory_bytes", maxInMemory)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	audio = make([]byte, OFFLINEHEADSIZE)
+	n, err := io.ReadFull(file, audio)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, "", err
+	}
+	return audio[:n], path, nil
+}
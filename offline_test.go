@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// -offline-file is read into memory up to -max-inmemory-bytes, past that only
+// its start is, and it's streamed from disk
+func TestLoadOfflineAudio(t *testing.T) {
+	data := bytes.Repeat(silentMPEGFrame, OFFLINEHEADSIZE/len(silentMPEGFrame)+10) // More than the head
+	path := writeTestFile(t, "offline.mp3", data)
+	size := int64(len(data))
+	tests := []struct {
+		name        string
+		maxInMemory int64
+		audio       int // bytes held in memory
+		streamed    bool
+	}{
+		{"no limit", 0, len(data), false},
+		{"below the limit", size + 1, len(data), false},
+		{"at the limit", size, len(data), false},
+		{"above the limit", size - 1, OFFLINEHEADSIZE, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			audio, streamPath, err := loadOfflineAudio(path, test.maxInMemory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(audio) != test.audio || !bytes.Equal(audio, data[:len(audio)]) {
+				t.Errorf("held %d bytes in memory, want the first %d", len(audio), test.audio)
+			}
+			if (streamPath == path) != test.streamed || (streamPath != "" && streamPath != path) {
+				t.Errorf("streamPath = %q, want streamed from disk %v", streamPath, test.streamed)
+			}
+		})
+	}
+
+	if _, _, err := loadOfflineAudio(filepath.Join(t.TempDir(), "missing.mp3"), 0); err == nil {
+		t.Error("loadOfflineAudio() read a file that isn't there")
+	}
+}
+
+// Offline audio over the limit is read from the file every time round, not
+// from what was held in memory
+func TestOfflineAudioFromDisk(t *testing.T) {
+	held := append(silentMPEGFrame[:4:4], "held in memory"...)
+	path := writeTestFile(t, "offline.mp3", held)
+	options := testOptions()
+	var err error
+	if options.OfflineAudio, options.OfflinePath, err = loadOfflineAudio(path, 1); err != nil {
+		t.Fatal(err)
+	}
+	onDisk := append(silentMPEGFrame[:4:4], "read from disk"...)
+	if err := os.WriteFile(path, onDisk, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	station := newOfflineStation("test", "/stream", filepath.Join(t.TempDir(), "missing.mp3"), options)
+	listener := newTestConnection(16)
+	if err := station.pool.AddConnection(listener); err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case chunk := <-listener.bufferChannel:
+			if !bytes.Equal(chunk.Data, onDisk) {
+				t.Fatalf("pass %d broadcast %q, want %q", i, chunk.Data, onDisk)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("offline audio stopped after %d passes", i)
+		}
+	}
+}
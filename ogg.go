@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+)
+
+const (
+	oggHeaderSize = 27
+	maxOggHeaders = 1 << 20 // Vorbis headers are a few KB, anything near this isn't headers
+)
+
+var oggMagic = []byte("OggS")
+
+// chunker is a source that picks its own broadcast boundaries instead of
+// filling a fixed size buffer
+type chunker interface {
+	// nextChunk returns about size bytes, averaging out to size over time
+	nextChunk(size int) ([]byte, error)
+}
+
+// oggPageLength returns the length of the OGG page at the start of b, from
+// its header and segment table, or false if b doesn't start with a page
+// header or is too short to tell
+func oggPageLength(b []byte) (int, bool) {
+	if len(b) < oggHeaderSize || !bytes.Equal(b[:4], oggMagic) {
+		return 0, false
+	}
+	segments := int(b[26])
+	if len(b) < oggHeaderSize+segments {
+		return 0, false
+	}
+
+	length := oggHeaderSize + segments
+	for _, lacing := range b[oggHeaderSize : oggHeaderSize+segments] {
+		length += int(lacing)
+	}
+	return length, true
+}
+
+// oggGranule returns the granule position of the page at the start of b.
+// Header pages have 0, pages where no packet ends have -1.
+func oggGranule(page []byte) int64 {
+	return int64(binary.LittleEndian.Uint64(page[6:14]))
+}
+
+// oggPager cuts an OGG stream into whole pages, so that every broadcast
+// starts on a page boundary and a listener joining mid-track gets something
+// their player can sync to. It keeps the track's header pages so they can
+// be sent to listeners who joined after them.
+type oggPager struct {
+	r         *bufio.Reader
+	chunk     []byte
+	debt      int // bytes owed to, or if negative ahead of, the pacing
+	headers   []byte
+	inHeaders bool
+	onHeaders func(headers []byte) // called once the headers are complete
+
+	unread  []byte // rest of a chunk handed out by Read
+	readErr error
+}
+
+func newOggPager(r io.Reader, onHeaders func([]byte)) *oggPager {
+	return &oggPager{r: bufio.NewReader(r), inHeaders: true, onHeaders: onHeaders}
+}
+
+// nextChunk returns whole pages, at least one, adding up to size bytes on
+// average. A chunk that overshoots size makes the next one shorter.
+func (p *oggPager) nextChunk(size int) ([]byte, error) {
+	target := size + p.debt
+	p.chunk = p.chunk[:0]
+	for len(p.chunk) == 0 || len(p.chunk) < target {
+		page, err := p.readPage()
+		if err != nil {
+			p.debt = 0
+			return p.chunk, err
+		}
+		p.chunk = append(p.chunk, page...)
+		p.collectHeaders(page)
+	}
+	p.debt = max(-size, min(target-len(p.chunk), size))
+	return p.chunk, nil
+}
+
+// Read makes the pager a plain reader too, for callers that don't care
+// where chunks start
+func (p *oggPager) Read(b []byte) (int, error) {
+	if len(p.unread) == 0 {
+		if p.readErr != nil {
+			return 0, p.readErr
+		}
+		p.unread, p.readErr = p.nextChunk(len(b))
+	}
+	n := copy(b, p.unread)
+	p.unread = p.unread[n:]
+	if len(p.unread) == 0 {
+		return n, p.readErr
+	}
+	return n, nil
+}
+
+// readPage returns the next page, skipping anything between pages
+func (p *oggPager) readPage() ([]byte, error) {
+	skipped := 0
+	for {
+		header, err := p.r.Peek(oggHeaderSize)
+		if err != nil {
+			return nil, io.EOF // Too short for a page, a truncated one is dropped
+		}
+		if !bytes.Equal(header[:4], oggMagic) {
+			p.r.Discard(1)
+			skipped++
+			continue
+		}
+		if skipped > 0 {
+			slog.Debug("skipped bytes between OGG pages", "bytes", skipped)
+		}
+
+		table, err := p.r.Peek(oggHeaderSize + int(header[26]))
+		if err != nil {
+			return nil, io.EOF
+		}
+		length, _ := oggPageLength(table)
+		page := make([]byte, length)
+		if _, err := io.ReadFull(p.r, page); err != nil {
+			return nil, io.EOF
+		}
+		return page, nil
+	}
+}
+
+// collectHeaders keeps the pages ahead of the first audio page
+func (p *oggPager) collectHeaders(page []byte) {
+	if !p.inHeaders {
+		return
+	}
+	if granule := oggGranule(page); granule == 0 || granule == -1 {
+		if len(p.headers)+len(page) <= maxOggHeaders {
+			p.headers = append(p.headers, page...)
+			return
+		}
+	}
+	p.inHeaders = false
+	if len(p.headers) > 0 && p.onHeaders != nil {
+		p.onHeaders(p.headers)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// oggPage is a page of one packet of size bytes, which ends on it
+func oggPage(granule int64, size int) []byte {
+	var lacing []byte
+	for rest := size; ; rest -= 255 {
+		if rest < 255 {
+			lacing = append(lacing, byte(rest))
+			break
+		}
+		lacing = append(lacing, 255)
+	}
+	page := append([]byte("OggS"), 0, 0)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = append(page, make([]byte, 12)...) // Serial, sequence, checksum
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	return append(page, bytes.Repeat([]byte{0x55}, size)...)
+}
+
+func TestOggPageLength(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+		ok   bool
+	}{
+		{"small", oggPage(0, 10), oggHeaderSize + 1 + 10, true},
+		{"many segments", oggPage(1, 1000), oggHeaderSize + 4 + 1000, true},
+		{"empty packet", oggPage(-1, 0), oggHeaderSize + 1, true},
+		{"header only", oggPage(1, 1000)[:oggHeaderSize], 0, false},
+		{"not a page", append([]byte("OggX"), oggPage(1, 10)[4:]...), 0, false},
+		{"too short", []byte("OggS"), 0, false},
+	}
+	for _, test := range tests {
+		if got, ok := oggPageLength(test.data); got != test.want || ok != test.ok {
+			t.Errorf("%s: oggPageLength() = %d, %v, want %d, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// splitPages returns the length of every page in b, failing the test if b
+// isn't made of whole pages
+func splitPages(t *testing.T, b []byte) []int {
+	t.Helper()
+	var lengths []int
+	for len(b) > 0 {
+		length, ok := oggPageLength(b)
+		if !ok || length > len(b) {
+			t.Fatalf("chunk doesn't start on a whole page: %q", b[:min(len(b), 8)])
+		}
+		lengths = append(lengths, length)
+		b = b[length:]
+	}
+	return lengths
+}
+
+func TestOggPagerWholePages(t *testing.T) {
+	var stream []byte
+	headers := append(oggPage(0, 30), oggPage(0, 3000)...)
+	stream = append(stream, headers...)
+	for i := 1; i <= 50; i++ {
+		stream = append(stream, oggPage(int64(i)*1024, 100+i*37%900)...)
+	}
+
+	for _, size := range []int{64, 1024, 8192} {
+		t.Run(fmt.Sprintf("size=%d", size), func(t *testing.T) {
+			var collected []byte
+			pager := newOggPager(bytes.NewReader(stream), func(h []byte) { collected = append([]byte{}, h...) })
+			var out []byte
+			chunks := 0
+			for {
+				chunk, err := pager.nextChunk(size)
+				if len(chunk) > 0 {
+					splitPages(t, chunk)
+					out = append(out, chunk...)
+					chunks++
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(out, stream) {
+				t.Errorf("pager passed %d bytes of %d", len(out), len(stream))
+			}
+			if !bytes.Equal(collected, headers) {
+				t.Errorf("collected %d bytes of headers, want %d", len(collected), len(headers))
+			}
+			// Pages are never split, but chunks still average out to size
+			if average := len(stream) / chunks; size > 1000 && (average < size/2 || average > 2*size) {
+				t.Errorf("chunks average %d bytes, want about %d", average, size)
+			}
+		})
+	}
+}
+
+func TestOggPagerSkipsGarbage(t *testing.T) {
+	first, second := oggPage(1, 200), oggPage(2, 300)
+	stream := bytes.Join([][]byte{[]byte("junk"), first, []byte("Ogg"), second, oggPage(3, 400)[:50]}, nil)
+
+	got, err := io.ReadAll(newOggPager(bytes.NewReader(stream), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The truncated page at the end is dropped rather than sent half
+	if want := append(append([]byte{}, first...), second...); !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, want the %d of the two whole pages", len(got), len(want))
+	}
+}
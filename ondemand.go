@@ -0,0 +1,63 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// onDemandHandler serves a station's tracks as plain files rather than as a
+// live broadcast, so clients can seek with Range requests. ?track=N picks a
+// playlist entry, the first one by default.
+func onDemandHandler(station *Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		index := 0
+		if value := r.URL.Query().Get("track"); value != "" {
+			var err error
+			if index, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "No such track", http.StatusNotFound)
+				return
+			}
+		}
+
+		track, ok := station.playlist.Track(index)
+		if !ok {
+			http.Error(w, "No such track", http.StatusNotFound)
+			return
+		}
+		path, err := resolveLocalPath(station.mediaRoot, track)
+		if err != nil {
+			http.Error(w, "No such track", http.StatusNotFound)
+			return
+		}
+		serveTrack(w, r, station, path)
+	}
+}
+
+// serveTrack sends the track at path as a file
+func serveTrack(w http.ResponseWriter, r *http.Request, station *Station, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		slog.Error("could not open track", "station", station.Name, "track", path, "error", err)
+		http.Error(w, "Track unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Track unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	contentType, err := detectContentType(path)
+	if err != nil {
+		contentType = station.contentType
+	}
+	contentType = cmp.Or(station.overrideType, contentType)
+	w.Header().Set("Content-Type", contentType)
+	identityEncoding(w)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file) // Handles Range, If-Range and 206s
+}
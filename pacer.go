@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// Gains of the adaptive pacer, per second of audio it is ahead of or
+	// behind real time. The integral term takes out a steady drift, the
+	// proportional one reacts to a late tick or an odd sized chunk.
+	PACERKP = 0.5
+	PACERKI = 0.05
+)
+
+// pacer adapts the tick interval so that what has been broadcast of a track
+// tracks real time, for -adaptive-pacing. A fixed interval only matches the
+// bitrate on average: chunks that aren't a full buffer, e.g. OGG pages, and
+// ticks that fire late add up over a long stream, and listeners' buffers
+// slowly fill up or run dry. A nil pacer leaves the interval alone.
+type pacer struct {
+	rate     float64 // bytes per second of audio
+	base     time.Duration
+	start    time.Time
+	sent     int64
+	integral float64
+}
+
+// newPacer paces to the rate of bufferSize bytes every base, the interval
+// worked out from the track's bitrate
+func newPacer(bufferSize int, base time.Duration) *pacer {
+	return &pacer{rate: float64(bufferSize) / base.Seconds(), base: base, start: time.Now()}
+}
+
+// next returns how long to wait after broadcasting n more bytes: as long as
+// those bytes last, corrected by how far ahead of real time the track is
+func (p *pacer) next(n int) time.Duration {
+	p.sent += int64(n)
+	ahead := float64(p.sent)/p.rate - time.Since(p.start).Seconds()
+	p.integral += ahead
+	seconds := float64(n)/p.rate + PACERKP*ahead + PACERKI*p.integral
+	interval := time.Duration(seconds * float64(time.Second))
+	return min(max(interval, time.Millisecond), 2*p.base)
+}
+
+// reset starts measuring again from now, e.g. after a pause, which isn't
+// time the broadcast fell behind
+func (p *pacer) reset() {
+	if p == nil {
+		return
+	}
+	p.start, p.sent, p.integral = time.Now(), 0, 0
+}
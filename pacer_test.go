@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPacerNext(t *testing.T) {
+	const base = 100 * time.Millisecond
+	tests := []struct {
+		name     string
+		elapsed  time.Duration // since the track started, for 1s of audio sent
+		min, max time.Duration
+	}{
+		{"on time", time.Second, 95 * time.Millisecond, 106 * time.Millisecond},
+		{"ahead", 900 * time.Millisecond, 145 * time.Millisecond, 160 * time.Millisecond}, // Waits longer
+		{"behind", 1100 * time.Millisecond, 40 * time.Millisecond, 55 * time.Millisecond}, // Catches up
+		{"far ahead", 0, 2 * base, 2 * base},
+		{"far behind", time.Hour, time.Millisecond, time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newPacer(1000, base) // 10000 bytes a second
+			p.start = time.Now().Add(-test.elapsed)
+			p.sent = 9000
+			if got := p.next(1000); got < test.min || got > test.max {
+				t.Errorf("next() = %v, want between %v and %v", got, test.min, test.max)
+			}
+		})
+	}
+}
+
+// A steady drift builds up in the integral, so the correction keeps growing
+// until it's taken out
+func TestPacerIntegral(t *testing.T) {
+	p := newPacer(1000, 100*time.Millisecond)
+	p.start = time.Now().Add(-900 * time.Millisecond)
+	p.sent = 10000 // 100ms ahead
+	first := p.next(0)
+	second := p.next(0)
+	if second <= first {
+		t.Errorf("intervals %v then %v for the same drift, want the second longer", first, second)
+	}
+
+	p.reset()
+	if p.sent != 0 || p.integral != 0 || time.Since(p.start) > time.Second {
+		t.Errorf("reset() left %+v", p)
+	}
+	var none *pacer
+	none.reset()
+}
+
+// halfReader hands out at most half of what's asked for, like a source of
+// short pages
+type halfReader struct{ r io.Reader }
+
+func (h halfReader) Read(p []byte) (int, error) { return h.r.Read(p[:max(len(p)/2, 1)]) }
+
+// Chunks of half a buffer, broadcast a tick apart, would play at half speed.
+// The adaptive pacer shortens the ticks to keep to the bitrate.
+func TestAdaptivePacing(t *testing.T) {
+	const audio = 10 * 1024
+	for _, adaptive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("adaptive=%v", adaptive), func(t *testing.T) {
+			options := testOptions()
+			options.AdaptivePacing = adaptive
+			options.Bitrate = 20 * 1024 * 8 // A full buffer every 50ms, the audio lasts 500ms
+			station := newStation("test", "/stream", options)
+			buffer := make([]byte, options.BufferSize)
+			interval := tickInterval(options.BufferSize, options.Bitrate)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			start := time.Now()
+			err := station.streamTrack(context.Background(), halfReader{bytes.NewReader(make([]byte, audio))}, buffer, ticker, interval, station.trackPacer(interval, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+			want := 500 * time.Millisecond
+			if !adaptive {
+				want = time.Second // Still a tick a chunk
+			}
+			if elapsed < want*7/10 || elapsed > want*14/10 {
+				t.Errorf("%d bytes took %v, want about %v", audio, elapsed, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Playlist is an ordered list of tracks that loops back to the top after the last one
+type Playlist struct {
+	mu      sync.RWMutex // guards tracks, which Replace swaps out from under readers
+	tracks  []string
+	current atomic.Int64 // index into tracks
+
+	// Only touched by Advance and Replace, i.e. the stream goroutine
+	shuffle  *rand.Rand // nil plays tracks in order
+	order    []int      // the current permutation of tracks when shuffling
+	position int        // index into order
+}
+
+func NewPlaylist(tracks ...string) *Playlist {
+	return &Playlist{tracks: tracks}
+}
+
+// LoadPlaylist reads an M3U (plain or extended) or PLS playlist file.
+// Relative track paths are resolved against the playlist's directory and
+// tracks outside mediaRoot, if one is set, are left out.
+func LoadPlaylist(path, mediaRoot string) (*Playlist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	isPLS := strings.EqualFold(filepath.Ext(path), ".pls")
+	dir := filepath.Dir(path)
+
+	var tracks []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if isPLS {
+			line = parsePLSLine(line)
+		} else if strings.HasPrefix(line, "#") {
+			continue // #EXTM3U, #EXTINF and comments carry no paths
+		}
+		if line == "" {
+			continue
+		}
+
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		track, err := resolveLocalPath(mediaRoot, line)
+		if err != nil {
+			slog.Warn("leaving track out of playlist", "playlist", path, "error", err)
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("playlist %s has no tracks", path)
+	}
+
+	return NewPlaylist(tracks...), nil
+}
+
+// loadSource returns the playlist for a station source, which is either a
+// playlist file or a single audio file played on repeat. Either has to be
+// inside mediaRoot if one is set.
+func loadSource(path, mediaRoot string) (*Playlist, error) {
+	path, err := resolveLocalPath(mediaRoot, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkFile(path); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8", ".pls":
+		return LoadPlaylist(path, mediaRoot)
+	}
+
+	// A single empty file would leave nothing to loop. Files shorter than one
+	// buffer are fine, they are repeated once per tick.
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, sourceError(path, err)
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("%s is empty", absPath(path))
+	}
+	return NewPlaylist(path), nil
+}
+
+// LoadDirectory plays every audio file in dir, in name order. Files are
+// recognised by their extension, hidden ones are left out. Subdirectories
+// are played too, in place, if recursive is set.
+func LoadDirectory(dir, mediaRoot string, recursive bool) (*Playlist, error) {
+	dir, err := resolveLocalPath(mediaRoot, dir)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := scanDirectory(dir, mediaRoot, recursive)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("no audio files in %s", absPath(dir))
+	}
+	return NewPlaylist(tracks...), nil
+}
+
+func scanDirectory(dir, mediaRoot string, recursive bool) ([]string, error) {
+	entries, err := os.ReadDir(dir) // Sorted by name
+	if err != nil {
+		return nil, sourceError(dir, err)
+	}
+
+	var tracks []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") { // Also skips files still being copied in by many tools
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if !recursive {
+				continue
+			}
+			subdirectory, err := scanDirectory(path, mediaRoot, recursive)
+			if err != nil {
+				slog.Warn("leaving directory out of playlist", "dir", path, "error", err)
+				continue
+			}
+			tracks = append(tracks, subdirectory...)
+			continue
+		}
+		if _, ok := extensionContentTypes[strings.ToLower(filepath.Ext(path))]; !ok {
+			continue
+		}
+		track, err := resolveLocalPath(mediaRoot, path)
+		if err != nil {
+			slog.Warn("leaving track out of playlist", "dir", dir, "error", err)
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// parsePLSLine returns the path of a FileN=path entry, or "" for any other line
+func parsePLSLine(line string) string {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok || !strings.HasPrefix(strings.ToLower(key), "file") {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+// Current returns the index of the track that is playing
+func (p *Playlist) Current() int {
+	return int(p.current.Load())
+}
+
+// CurrentTrack returns the path of the track that is playing
+func (p *Playlist) CurrentTrack() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.tracks[p.Current()]
+}
+
+// Track returns the path of the i'th track, if there is one
+func (p *Playlist) Track(i int) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if i < 0 || i >= len(p.tracks) {
+		return "", false
+	}
+	return p.tracks[i], true
+}
+
+// Tracks returns a copy of every track in playlist order
+func (p *Playlist) Tracks() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string{}, p.tracks...)
+}
+
+// Replace swaps in a new list of tracks and starts again from the top, or
+// from a fresh permutation when shuffling
+func (p *Playlist) Replace(tracks []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracks = tracks
+	p.current.Store(0)
+	if p.shuffle != nil {
+		p.order = p.shuffle.Perm(len(p.tracks))
+		p.position = 0
+		p.current.Store(int64(p.order[0]))
+	}
+}
+
+// Shuffle switches to playing tracks in a random permutation, reshuffled
+// each time the list is exhausted. The same seed gives the same order.
+func (p *Playlist) Shuffle(seed uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.shuffle = rand.New(rand.NewPCG(seed, seed))
+	p.order = p.shuffle.Perm(len(p.tracks))
+	p.position = 0
+	p.current.Store(int64(p.order[0]))
+}
+
+// Advance moves on to the next track, wrapping around after the last one.
+// It reports whether it wrapped, i.e. the whole list has been played.
+func (p *Playlist) Advance() (wrapped bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shuffle == nil {
+		next := (p.Current() + 1) % len(p.tracks)
+		p.current.Store(int64(next))
+		return next == 0
+	}
+
+	p.position++
+	if p.position == len(p.order) {
+		wrapped = true
+		last := p.order[len(p.order)-1]
+		p.order = p.shuffle.Perm(len(p.tracks))
+		p.position = 0
+
+		// Don't play the same track twice in a row across the reshuffle
+		if p.order[0] == last && len(p.order) > 1 {
+			swap := 1 + p.shuffle.IntN(len(p.order)-1)
+			p.order[0], p.order[swap] = p.order[swap], p.order[0]
+		}
+	}
+	p.current.Store(int64(p.order[p.position]))
+	return wrapped
+}
+
+func (p *Playlist) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.tracks)
+}
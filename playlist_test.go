@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadPlaylist(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     []string // relative to the playlist's directory
+	}{
+		{"plain.m3u", "a.mp3\nb.mp3\n", []string{"a.mp3", "b.mp3"}},
+		{"extended.m3u", "#EXTM3U\n#EXTINF:123,Artist - Title\na.mp3\n\n# a comment\nsub/b.mp3\n", []string{"a.mp3", "sub/b.mp3"}},
+		{"crlf.m3u8", "#EXTM3U\r\na.mp3\r\n  b.mp3  \r\n", []string{"a.mp3", "b.mp3"}},
+		{"radio.pls", "[playlist]\nFile1=a.mp3\nTitle1=A\nLength1=-1\nfile2 = b.mp3\nNumberOfEntries=2\nVersion=2\n", []string{"a.mp3", "b.mp3"}},
+		{"upper.PLS", "[playlist]\nFILE1=a.mp3\n", []string{"a.mp3"}},
+		{"no-equals.pls", "[playlist]\nFile1\nFile2=b.mp3\n", []string{"b.mp3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTestFile(t, test.name, []byte(test.playlist))
+			playlist, err := LoadPlaylist(path, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, track := range test.want {
+				want = append(want, filepath.Join(filepath.Dir(path), track))
+			}
+			if got := playlist.Tracks(); !slices.Equal(got, want) {
+				t.Errorf("Tracks() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadPlaylistAbsolutePaths(t *testing.T) {
+	track := writeTestFile(t, "a.mp3", []byte("ID3"))
+	playlist, err := LoadPlaylist(writeTestFile(t, "absolute.m3u", []byte(track+"\n")), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := playlist.Tracks(); !slices.Equal(got, []string{track}) {
+		t.Errorf("Tracks() = %q, want %q", got, track)
+	}
+}
+
+func TestLoadPlaylistMediaRoot(t *testing.T) {
+	root := t.TempDir()
+	outside := writeTestFile(t, "outside.mp3", []byte("ID3"))
+	path := filepath.Join(root, "list.m3u")
+	if err := os.WriteFile(path, []byte("in.mp3\n../escape.mp3\n"+outside+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	playlist, err := LoadPlaylist(path, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := playlist.Tracks(), []string{filepath.Join(root, "in.mp3")}; !slices.Equal(got, want) {
+		t.Errorf("Tracks() = %q, want %q", got, want)
+	}
+}
+
+func TestLoadPlaylistFails(t *testing.T) {
+	for name, playlist := range map[string]string{
+		"empty.m3u":    "",
+		"comments.m3u": "#EXTM3U\n#EXTINF:1,Nothing\n",
+		"titles.pls":   "[playlist]\nTitle1=A\nNumberOfEntries=0\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadPlaylist(writeTestFile(t, name, []byte(playlist)), ""); err == nil {
+				t.Error("LoadPlaylist() succeeded, want an error")
+			}
+		})
+	}
+	if _, err := LoadPlaylist(filepath.Join(t.TempDir(), "missing.m3u"), ""); !os.IsNotExist(err) {
+		t.Errorf("LoadPlaylist() error = %v, want not exist", err)
+	}
+}
+
+func TestAdvanceWraps(t *testing.T) {
+	playlist := NewPlaylist("a", "b", "c")
+	var played []string
+	var wraps []bool
+	for i := 0; i < 4; i++ {
+		played = append(played, playlist.CurrentTrack())
+		wraps = append(wraps, playlist.Advance())
+	}
+	if want := []string{"a", "b", "c", "a"}; !slices.Equal(played, want) {
+		t.Errorf("played %q, want %q", played, want)
+	}
+	if want := []bool{false, false, true, false}; !slices.Equal(wraps, want) {
+		t.Errorf("Advance() = %v, want %v", wraps, want)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConnection(depth int) *Connection {
+	return &Connection{bufferChannel: make(chan Chunk, depth), connected: time.Now()}
+}
+
+// receive copies out every chunk sent to connection until its channel is
+// closed, handing each buffer back to pool, after delay per chunk
+func receive(pool *ConnectionPool, connection *Connection, delay time.Duration) []byte {
+	var received []byte
+	for chunk := range connection.bufferChannel {
+		received = append(received, chunk.Data...)
+		pool.putBuffer(chunk.Data)
+		time.Sleep(delay)
+	}
+	return received
+}
+
+// Run with -race: listeners reading at their own pace, with others joining
+// and leaving all the while, must each get exactly what was broadcast, even
+// though the broadcaster overwrites its buffer straight away
+func TestBroadcastCopiesPerConnection(t *testing.T) {
+	const bufferSize, chunks = 16, 200
+	source := make([]byte, bufferSize*chunks)
+	for i := range source {
+		source[i] = byte(i * 7)
+	}
+
+	pool := NewConnectionPool("/test-copies", bufferSize)
+	delays := []time.Duration{0, 10 * time.Microsecond, 100 * time.Microsecond}
+	results := make([][]byte, len(delays))
+	var readers sync.WaitGroup
+	for i, delay := range delays {
+		connection := newTestConnection(chunks) // Deep enough that nothing is dropped
+		if err := pool.AddConnection(connection); err != nil {
+			t.Fatal(err)
+		}
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			results[i] = receive(pool, connection, delay)
+		}()
+	}
+
+	stop := make(chan struct{})
+	var churn sync.WaitGroup
+	churn.Add(1)
+	go func() {
+		defer churn.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			connection := newTestConnection(1)
+			if err := pool.AddConnection(connection); err != nil {
+				return
+			}
+			go receive(pool, connection, 0)
+			pool.DeleteConnection(connection)
+			connection.close()
+		}
+	}()
+
+	buffer := make([]byte, bufferSize)
+	for i := 0; i < chunks; i++ {
+		copy(buffer, source[i*bufferSize:])
+		pool.Broadcast(buffer)
+		for j := range buffer {
+			buffer[j] = 0xFF // A listener sharing buffer would see this
+		}
+	}
+	close(stop)
+	churn.Wait()
+	pool.Close()
+	readers.Wait()
+
+	for i, received := range results {
+		if !bytes.Equal(received, source) {
+			t.Errorf("listener %d (delay %v) got %d bytes that differ from the %d broadcast", i, delays[i], len(received), len(source))
+		}
+	}
+}
+
+func TestAddConnection(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxConnections int
+		existing       int
+		closed         bool
+		want           error
+	}{
+		{"room", 2, 1, false, nil},
+		{"no limit", 0, 10, false, nil},
+		{"full", 2, 2, false, ErrPoolFull},
+		{"closed", 0, 0, true, ErrPoolClosed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := NewConnectionPool("/test-add", 16)
+			pool.maxConnections = test.maxConnections
+			for i := 0; i < test.existing; i++ {
+				if err := pool.AddConnection(newTestConnection(1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.closed {
+				pool.Close()
+			}
+			if err := pool.AddConnection(newTestConnection(1)); err != test.want {
+				t.Errorf("AddConnection() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// A listener that hands each chunk back before the next broadcast needs one
+// buffer allocated, then reuses it from then on
+func TestBufferReuse(t *testing.T) {
+	const bufferSize, chunks = 16, 100
+	pool := NewConnectionPool("/test-reuse", bufferSize)
+	pool.limitIdleBuffers(4) // A sync.Pool may be emptied at any time
+	connection := newTestConnection(4)
+	if err := pool.AddConnection(connection); err != nil {
+		t.Fatal(err)
+	}
+	source := make([]byte, bufferSize)
+	for i := 0; i < chunks; i++ {
+		pool.Broadcast(source)
+		pool.putBuffer((<-connection.bufferChannel).Data)
+	}
+	want := BufferStats{Size: bufferSize, Allocated: 1, AllocatedBytes: bufferSize, Reused: chunks - 1}
+	if got := pool.bufferStats(); got != want {
+		t.Errorf("bufferStats() = %+v, want %+v", got, want)
+	}
+}
+
+// Only -max-idle-buffers wait to be reused, and ones of the wrong size never
+// go back in
+func TestMaxIdleBuffers(t *testing.T) {
+	pool := NewConnectionPool("/test-idle", 16)
+	pool.limitIdleBuffers(2)
+	for i := 0; i < 3; i++ {
+		pool.putBuffer(make([]byte, 16))
+	}
+	pool.putBuffer(make([]byte, 32))
+	if stats := pool.bufferStats(); stats.Dropped != 1 || len(pool.idleBuffers) != 2 {
+		t.Errorf("%d buffers idle, %d dropped, want 2 and 1", len(pool.idleBuffers), stats.Dropped)
+	}
+	for i := 0; i < 3; i++ {
+		if buffer := pool.getBuffer(); len(buffer) != 16 {
+			t.Errorf("getBuffer() returned %d bytes, want 16", len(buffer))
+		}
+	}
+	if stats := pool.bufferStats(); stats.Reused != 2 || stats.Allocated != 1 {
+		t.Errorf("%d reused, %d allocated, want 2 and 1", stats.Reused, stats.Allocated)
+	}
+}
+
+// Every listener is sent a copy in a buffer from the pool, so once it's warm
+// a broadcast allocates a few bytes per listener, putting a slice back into
+// the sync.Pool, rather than a whole buffer
+func BenchmarkBroadcast(b *testing.B) {
+	for _, listeners := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("listeners=%d", listeners), func(b *testing.B) {
+			pool := NewConnectionPool("/bench-broadcast", BUFFERSIZE)
+			var readers sync.WaitGroup
+			for i := 0; i < listeners; i++ {
+				connection := newTestConnection(4)
+				if err := pool.AddConnection(connection); err != nil {
+					b.Fatal(err)
+				}
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+					receive(pool, connection, 0)
+				}()
+			}
+			buffer := make([]byte, BUFFERSIZE)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buffer) * listeners))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pool.Broadcast(buffer)
+			}
+			b.StopTimer()
+			pool.Close()
+			readers.Wait()
+		})
+	}
+}
+
+// Listeners joining and leaving while the pool broadcasts flat out only wait
+// for the snapshot of the pool to be taken, not for every send, so neither
+// holds the other up. connects/op is how many joined and left per broadcast.
+func BenchmarkBroadcastChurn(b *testing.B) {
+	for _, listeners := range []int{10, 100} {
+		b.Run(fmt.Sprintf("listeners=%d", listeners), func(b *testing.B) {
+			pool := NewConnectionPool("/bench-churn", BUFFERSIZE)
+			var readers sync.WaitGroup
+			for i := 0; i < listeners; i++ {
+				connection := newTestConnection(4)
+				if err := pool.AddConnection(connection); err != nil {
+					b.Fatal(err)
+				}
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+					receive(pool, connection, 0)
+				}()
+			}
+
+			stop := make(chan struct{})
+			connects := make(chan int)
+			go func() {
+				count := 0
+				for {
+					select {
+					case <-stop:
+						connects <- count
+						return
+					default:
+					}
+					connection := newTestConnection(1)
+					if pool.AddConnection(connection) == nil {
+						pool.DeleteConnection(connection)
+						count++
+					}
+				}
+			}()
+
+			buffer := make([]byte, BUFFERSIZE)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pool.Broadcast(buffer)
+			}
+			b.StopTimer()
+			close(stop)
+			b.ReportMetric(float64(<-connects)/float64(b.N), "connects/op")
+			pool.Close()
+			readers.Wait()
+		})
+	}
+}
+
+// A listener that stops reading fills its queue and is cut loose once it has
+// missed maxDrops chunks in a row, while one keeping up stays
+func TestBroadcastEvictsStalledListener(t *testing.T) {
+	tests := []struct {
+		maxDrops, depth, broadcasts int
+		evicted                     bool
+	}{
+		{3, 1, 3, false}, // The first fills the queue, two drops
+		{3, 1, 4, true},
+		{1, 2, 3, true},
+		{0, 1, 100, false}, // Never evicted
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("max=%d depth=%d broadcasts=%d", test.maxDrops, test.depth, test.broadcasts), func(t *testing.T) {
+			pool := NewConnectionPool("/test-evict", 16)
+			pool.maxDrops = test.maxDrops
+			stalled := newTestConnection(test.depth)
+			reading := newTestConnection(test.broadcasts)
+			for _, connection := range []*Connection{stalled, reading} {
+				if err := pool.AddConnection(connection); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < test.broadcasts; i++ {
+				pool.Broadcast(make([]byte, 16))
+			}
+
+			if got := pool.Count() == 1; got != test.evicted {
+				t.Errorf("evicted = %v, want %v (%d listeners left)", got, test.evicted, pool.Count())
+			}
+			if stalled.closed != test.evicted {
+				t.Errorf("channel closed = %v, want %v", stalled.closed, test.evicted)
+			}
+			if len(reading.bufferChannel) != test.broadcasts {
+				t.Errorf("listener keeping up got %d chunks, want %d", len(reading.bufferChannel), test.broadcasts)
+			}
+		})
+	}
+}
+
+// Each chunk is sent in join order, starting one listener further along
+// than the last. Idle buffers are handed out first in, first out, so which
+// buffer a listener gets shows where it came in the round.
+func TestBroadcastRoundRobin(t *testing.T) {
+	const listeners = 3
+	pool := NewConnectionPool("/test-round-robin", 16)
+	pool.limitIdleBuffers(listeners)
+	connections := make([]*Connection, listeners)
+	for i := range connections {
+		connections[i] = newTestConnection(listeners * 2)
+		if err := pool.AddConnection(connections[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffers := make([][]byte, listeners)
+	for i := range buffers {
+		buffers[i] = make([]byte, 16)
+	}
+
+	var firsts []int
+	for round := 0; round < listeners*2; round++ {
+		for _, buffer := range buffers {
+			pool.putBuffer(buffer)
+		}
+		pool.Broadcast(make([]byte, 16))
+		order := make([]int, listeners) // of each connection in the round
+		for i, connection := range connections {
+			chunk := <-connection.bufferChannel
+			order[i] = slices.IndexFunc(buffers, func(buffer []byte) bool { return &buffer[0] == &chunk.Data[0] })
+		}
+		first := slices.Index(order, 0)
+		for i := range order {
+			if want := (i - first + listeners) % listeners; order[i] != want {
+				t.Fatalf("round %d sent in order %v, want join order from listener %d", round, order, first)
+			}
+		}
+		firsts = append(firsts, first)
+	}
+	for i := 1; i < len(firsts); i++ {
+		if firsts[i] != (firsts[i-1]+1)%listeners {
+			t.Errorf("rounds started with listeners %v, want each in turn", firsts)
+			break
+		}
+	}
+}
+
+// Listeners reading at the same pace, too slow for the broadcast, drop
+// about as many chunks as each other
+func TestBroadcastDropsSpreadEvenly(t *testing.T) {
+	const listeners, chunks = 4, 200
+	pool := NewConnectionPool("/test-fairness", 16)
+	received := make([]int, listeners)
+	var readers sync.WaitGroup
+	for i := range received {
+		connection := newTestConnection(1)
+		if err := pool.AddConnection(connection); err != nil {
+			t.Fatal(err)
+		}
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			received[i] = len(receive(pool, connection, 2*time.Millisecond)) / 16
+		}()
+	}
+	for i := 0; i < chunks; i++ {
+		pool.Broadcast(make([]byte, 16))
+		time.Sleep(500 * time.Microsecond)
+	}
+	pool.Close()
+	readers.Wait()
+
+	var dropped []int
+	total := 0
+	for _, got := range received {
+		dropped = append(dropped, chunks-got)
+		total += chunks - got
+	}
+	mean := total / listeners
+	if mean == 0 {
+		t.Fatalf("nothing was dropped, received %v of %d", received, chunks)
+	}
+	for _, drops := range dropped {
+		if drops < mean/2 || drops > mean*2 {
+			t.Errorf("drops %v, want each near %d", dropped, mean)
+			break
+		}
+	}
+}
+
+// A listener that keeps up on average but stalls now and then, as over a
+// patchy network, only loses chunks when a stall outlasts its queue, so
+// deeper queues drop less of the same stalls
+func BenchmarkDropRate(b *testing.B) {
+	for _, depth := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			pool := NewConnectionPool("/bench-drops", 1024)
+			connection := newTestConnection(depth)
+			if err := pool.AddConnection(connection); err != nil {
+				b.Fatal(err)
+			}
+			received := make(chan int)
+			go func() {
+				jitter := rand.New(rand.NewPCG(1, 2)) // The same stalls for every depth
+				count := 0
+				for chunk := range connection.bufferChannel {
+					count++
+					pool.putBuffer(chunk.Data)
+					if jitter.IntN(20) == 0 {
+						time.Sleep(time.Duration(jitter.IntN(20)) * time.Millisecond) // Up to 20 ticks
+					}
+				}
+				received <- count
+			}()
+
+			buffer := make([]byte, 1024)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pool.Broadcast(buffer)
+				time.Sleep(time.Millisecond) // A tick
+			}
+			b.StopTimer()
+			pool.Close()
+			b.ReportMetric(100*float64(b.N-<-received)/float64(b.N), "%dropped")
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// MAXQUEUE is how many tracks can be waiting on a station's queue
+const MAXQUEUE = 100
+
+var ErrQueueFull = errors.New("queue is full")
+
+// Queue holds tracks requested to play next, ahead of the playlist
+type Queue struct {
+	mu     sync.Mutex
+	tracks []string
+}
+
+// Push adds track to the end of the queue, unless MAXQUEUE are already
+// waiting
+func (q *Queue) Push(track string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.tracks) >= MAXQUEUE {
+		return ErrQueueFull
+	}
+	q.tracks = append(q.tracks, track)
+	return nil
+}
+
+// Pop removes and returns the next queued track, if there is one
+func (q *Queue) Pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.tracks) == 0 {
+		return "", false
+	}
+	track := q.tracks[0]
+	q.tracks = q.tracks[1:]
+	return track, true
+}
+
+// List returns a copy of the pending tracks in play order
+func (q *Queue) List() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string{}, q.tracks...)
+}
+
+type StationQueue struct {
+	Station string   `json:"station"`
+	Mount   string   `json:"mount"`
+	Tracks  []string `json:"tracks"`
+}
+
+// queueHandler lists a station's pending tracks on GET and queues a track
+// (form or query value "track") on POST. Queued tracks must be inside
+// mediaRoot, so queueing is refused when no root is configured, and in the
+// station's format, as listeners can't switch formats mid-stream. main
+// only lets admins POST.
+func queueHandler(stations []*Station, mediaRoot string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		station := stations[0]
+		if key := r.URL.Query().Get("station"); key != "" {
+			if station = findStation(stations, key); station == nil {
+				http.Error(w, "Unknown station", http.StatusNotFound)
+				return
+			}
+		}
+		if station.queue == nil {
+			http.Error(w, "Live stations have no queue", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if mediaRoot == "" {
+				http.Error(w, "Queueing tracks needs -media-root", http.StatusForbidden)
+				return
+			}
+
+			track, err := resolvePath(mediaRoot, r.FormValue("track"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if info, err := os.Stat(track); err != nil || !info.Mode().IsRegular() {
+				http.Error(w, "No such track", http.StatusBadRequest)
+				return
+			}
+			if contentType, err := detectContentType(track); err != nil || contentType != station.contentType {
+				http.Error(w, "Track isn't "+station.contentType+" like the stream", http.StatusUnsupportedMediaType)
+				return
+			}
+
+			if err := station.queue.Push(track); err != nil {
+				http.Error(w, "Queue is full", http.StatusTooManyRequests)
+				return
+			}
+			slog.Info("track queued", "station", station.Name, "track", track, "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		body := StationQueue{Station: station.Name, Mount: station.Mount, Tracks: station.queue.List()}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			slog.Error("could not write queue", "error", err)
+		}
+	}
+}
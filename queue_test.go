@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// queueStation is a station playing an MP3 from a fresh media root, which
+// also holds tracks to queue
+func queueStation(t *testing.T) (station *Station, root string) {
+	t.Helper()
+	root = t.TempDir()
+	for name, data := range map[string][]byte{
+		"playing.mp3": silentMPEGFrame,
+		"next.mp3":    silentMPEGFrame,
+		"other.ogg":   []byte("OggS\x00\x02"),
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	options := testOptions()
+	options.MediaRoot = root
+	station, err := NewStation("Test", "/test", filepath.Join(root, "playing.mp3"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return station, root
+}
+
+func postQueue(handler http.HandlerFunc, track string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/queue", strings.NewReader(url.Values{"track": {track}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestQueueHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		track string
+		want  int
+	}{
+		{"relative", "next.mp3", http.StatusAccepted},
+		{"absolute inside", "{root}/next.mp3", http.StatusAccepted},
+		{"traversal", "../../etc/passwd", http.StatusBadRequest},
+		{"absolute outside", "/etc/passwd", http.StatusBadRequest},
+		{"missing", "gone.mp3", http.StatusBadRequest},
+		{"directory", "dir", http.StatusBadRequest},
+		{"other format", "other.ogg", http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			station, root := queueStation(t)
+			handler := queueHandler([]*Station{station}, root)
+			w := postQueue(handler, strings.ReplaceAll(test.track, "{root}", root))
+			if w.Code != test.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+
+			queued := station.queue.List()
+			if test.want != http.StatusAccepted {
+				if len(queued) != 0 {
+					t.Errorf("queued %q after a %d", queued, w.Code)
+				}
+				return
+			}
+			var body StationQueue
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{filepath.Join(root, "next.mp3")}
+			if !slices.Equal(body.Tracks, want) || !slices.Equal(queued, want) {
+				t.Errorf("queue = %q, response %q, want %q", queued, body.Tracks, want)
+			}
+		})
+	}
+}
+
+func TestQueueHandlerFull(t *testing.T) {
+	station, root := queueStation(t)
+	handler := queueHandler([]*Station{station}, root)
+	for i := 0; i < MAXQUEUE; i++ {
+		if w := postQueue(handler, "next.mp3"); w.Code != http.StatusAccepted {
+			t.Fatalf("track %d: status = %d", i, w.Code)
+		}
+	}
+	if w := postQueue(handler, "next.mp3"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d with a full queue, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := len(station.queue.List()); got != MAXQUEUE {
+		t.Errorf("%d tracks queued, want %d", got, MAXQUEUE)
+	}
+}
+
+func TestQueueHandlerNoMediaRoot(t *testing.T) {
+	station, _ := queueStation(t)
+	if w := postQueue(queueHandler([]*Station{station}, ""), "next.mp3"); w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+// main lets anyone list the queue but only admins add to it
+func TestQueueNeedsAdmin(t *testing.T) {
+	station, root := queueStation(t)
+	admin := Credentials{User: "admin", Password: "secret"}
+	tests := []struct {
+		name        string
+		credentials Credentials
+		user        string
+		want        int
+	}{
+		{"admin", admin, "admin", http.StatusAccepted},
+		{"wrong user", admin, "listener", http.StatusUnauthorized},
+		{"no admin configured", Credentials{}, "admin", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := requireAdmin(test.credentials, queueHandler([]*Station{station}, root))
+			r := httptest.NewRequest(http.MethodPost, "/queue?track=next.mp3", nil)
+			r.SetBasicAuth(test.user, "secret")
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.want {
+				t.Errorf("status = %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	queueHandler([]*Station{station}, root)(w, httptest.NewRequest(http.MethodGet, "/queue?station=Test", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
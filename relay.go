@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	RELAYTIMEOUT    = 10 * time.Second // to connect to the upstream and get its response headers
+	RELAYMINBACKOFF = time.Second
+	RELAYMAXBACKOFF = 30 * time.Second
+
+	relaySniffSize = 8192 // bytes read from the upstream at startup to detect its format
+)
+
+var relayClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: RELAYTIMEOUT,
+	},
+}
+
+// NewRelayStation creates a station that rebroadcasts an upstream stream,
+// e.g. an Icecast mount. The upstream is connected to once here to learn
+// its format and bitrate, which listeners are then sent whatever happens
+// later.
+func NewRelayStation(name, mount, sourceURL string, options StationOptions) (*Station, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RELAYTIMEOUT)
+	defer cancel()
+	resp, err := relayGet(ctx, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	station := newStation(name, mount, options)
+	station.relayURL = sourceURL
+
+	// Whatever the upstream doesn't announce is worked out from its first
+	// frames, as for files
+	head := make([]byte, relaySniffSize)
+	n, _ := io.ReadFull(resp.Body, head)
+	head = head[:n]
+
+	station.contentType = resp.Header.Get("Content-Type")
+	if station.contentType == "" {
+		station.contentType = sniffContentType(head)
+	}
+	if station.contentType == "" {
+		slog.Warn("could not tell the upstream's format, assuming MP3", "station", name, "url", redactURL(sourceURL))
+		station.contentType = "audio/mpeg"
+	}
+	station.bitrate = options.Bitrate
+	if station.bitrate == 0 {
+		if kbps, err := strconv.Atoi(resp.Header.Get("icy-br")); err == nil && kbps > 0 {
+			station.bitrate = kbps * 1000
+		} else {
+			station.bitrate = framesBitrate(head) // Left at 0 (unknown) if it can't be detected
+		}
+	}
+	return station, nil
+}
+
+// relayGet requests the upstream stream. The body is only valid as long as
+// ctx is.
+func relayGet(ctx context.Context, sourceURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "GoRadio relay")
+
+	resp, err := relayClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// streamRelay copies the upstream into the broadcast as it arrives. The
+// upstream sets the pace, so there's no ticker. When it goes away it is
+// reconnected to, backing off while it stays down.
+func (s *Station) streamRelay(ctx context.Context) {
+	buffer := s.pool.getBuffer()
+	defer s.pool.putBuffer(buffer)
+
+	backoff := newBackoff(RELAYMINBACKOFF, RELAYMAXBACKOFF)
+	for {
+		resp, err := relayGet(ctx, s.relayURL)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			retryIn := backoff.next()
+			slog.Error("could not connect to upstream", "station", s.Name, "url", redactURL(s.relayURL), "error", err, "retry_in", retryIn)
+			select {
+			case <-time.After(retryIn):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" && contentType != s.contentType {
+			slog.Warn("upstream format changed, listeners may not be able to play it", "station", s.Name, "format", contentType, "stream_format", s.contentType)
+		}
+		slog.Info("connected to upstream", "station", s.Name, "url", redactURL(s.relayURL))
+		s.relayConnected.Store(true)
+
+		relayed, err := s.copyUpstream(ctx, resp.Body, buffer)
+		resp.Body.Close()
+		s.relayConnected.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		// Only an upstream that sent audio is back, one that answers and
+		// hangs up straight away, e.g. a stopped mount, is still backed off
+		if relayed > 0 {
+			backoff.reset()
+		}
+		retryIn := backoff.next()
+		slog.Warn("upstream disconnected, reconnecting", "station", s.Name, "url", redactURL(s.relayURL), "error", err, "bytes", relayed, "retry_in", retryIn)
+		select {
+		case <-time.After(retryIn):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// copyUpstream broadcasts body until it ends or ctx is cancelled, returning
+// how many bytes it broadcast
+func (s *Station) copyUpstream(ctx context.Context, body io.Reader, buffer []byte) (int64, error) {
+	idle := newEmptyReads()
+	var relayed int64
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			s.pool.Broadcast(buffer[:n])
+			s.lastBroadcast.Store(time.Now().UnixNano())
+			relayed += int64(n)
+		}
+		if err != nil {
+			return relayed, err
+		}
+		if err := idle.record(ctx, n); err != nil {
+			return relayed, err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewRelayStation(t *testing.T) {
+	mp3 := bytes.Repeat(silentMPEGFrame, 30)
+	tests := []struct {
+		name        string
+		header      http.Header
+		body        []byte
+		contentType string
+		bitrate     int
+	}{
+		{"announced", http.Header{"Content-Type": {"audio/aac"}, "Icy-Br": {"64"}}, silentADTSFrame, "audio/aac", 64000},
+		{"sniffed", nil, mp3, "audio/mpeg", 128000},
+		{"unknown", nil, []byte("not audio"), "audio/mpeg", 0}, // Assumed to be MP3
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = nil // Not sniffed by net/http either
+				for name, values := range test.header {
+					w.Header()[name] = values
+				}
+				w.Write(test.body)
+			}))
+			defer upstream.Close()
+
+			station, err := NewRelayStation("relay", "/relay", upstream.URL, testOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if station.contentType != test.contentType {
+				t.Errorf("contentType = %q, want %q", station.contentType, test.contentType)
+			}
+			if math.Abs(float64(station.bitrate-test.bitrate)) > 0.01*float64(test.bitrate) {
+				t.Errorf("bitrate = %d, want about %d", station.bitrate, test.bitrate)
+			}
+		})
+	}
+}
+
+func TestNewRelayStationUpstreamDown(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	if _, err := NewRelayStation("relay", "/relay", upstream.URL, testOptions()); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("NewRelayStation() error = %v, want the upstream's 404", err)
+	}
+}
+
+// The upstream's audio is rebroadcast as it arrives, and when it hangs up
+// the relay connects again and carries on
+func TestRelayReconnects(t *testing.T) {
+	var connections atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		fmt.Fprintf(w, "connection %d", connections.Add(1))
+	}))
+	defer upstream.Close()
+
+	station, err := NewRelayStation("relay", "/relay", upstream.URL, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newTestConnection(16)
+	if err := station.pool.AddConnection(listener); err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+
+	// The first connection was NewRelayStation's, to sniff the format
+	for _, want := range []string{"connection 2", "connection 3"} {
+		select {
+		case chunk := <-listener.bufferChannel:
+			if string(chunk.Data) != want {
+				t.Errorf("relayed %q, want %q", chunk.Data, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("nothing relayed, waiting for %q", want)
+		}
+	}
+}
+
+// An upstream that answers and hangs up at once, like a stopped mount, is
+// backed off from rather than reconnected to in a loop
+func TestRelayBacksOffEmptyUpstream(t *testing.T) {
+	var connections atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections.Add(1)
+		w.Header().Set("Content-Type", "audio/mpeg")
+		if connections.Load() == 1 {
+			w.Write(silentMPEGFrame) // For NewRelayStation to sniff
+		}
+	}))
+	defer upstream.Close()
+
+	station, err := NewRelayStation("relay", "/relay", upstream.URL, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	time.Sleep(1500 * time.Millisecond)
+	// Waits of RELAYMINBACKOFF, then twice that, each jittered down by half
+	if got := connections.Load() - 1; got < 1 || got > 4 {
+		t.Errorf("reconnected %d times in 1.5s, want a few at most", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ResumeTokens let a listener whose connection dropped pick up where it
+// left off. Every stream is sent an X-Resume-Token; reconnecting with
+// ?resume=<token> within the window sends the chunks missed in between, as
+// fast as the connection takes them, before carrying on live. Only what is
+// still in the ring can be caught up. A nil ResumeTokens resumes nothing.
+type ResumeTokens struct {
+	mu     sync.Mutex
+	window time.Duration
+	points map[string]resumePoint
+}
+
+// resumePoint is where a listener's last connection left off
+type resumePoint struct {
+	seq  uint64 // of the last chunk written
+	left time.Time
+}
+
+// NewResumeTokens returns nil, resuming nothing, unless window is positive
+func NewResumeTokens(window time.Duration) *ResumeTokens {
+	if window <= 0 {
+		return nil
+	}
+	return &ResumeTokens{window: window, points: make(map[string]resumePoint)}
+}
+
+// issue returns a new token, unguessable so nobody can take over another
+// listener's place
+func (t *ResumeTokens) issue() string {
+	token := make([]byte, 16)
+	rand.Read(token) // Never fails
+	return hex.EncodeToString(token)
+}
+
+// take looks token up, reporting where its connection left off if that was
+// within the window. A token is only good for one reconnect, the new
+// connection saves it afresh when it ends.
+func (t *ResumeTokens) take(token string) (seq uint64, ok bool) {
+	if t == nil || token == "" {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	point, ok := t.points[token]
+	delete(t.points, token)
+	if !ok || time.Since(point.left) > t.window {
+		return 0, false
+	}
+	return point.seq, true
+}
+
+// save records that token's connection ended after the chunk seq, dropping
+// the tokens that can no longer resume
+func (t *ResumeTokens) save(token string, seq uint64) {
+	if t == nil || seq == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for other, point := range t.points {
+		if now.Sub(point.left) > t.window {
+			delete(t.points, other)
+		}
+	}
+	t.points[token] = resumePoint{seq: seq, left: now}
+}
+
+// ringSize is how many chunks the ring has to hold: the prebuffer of a high
+// latency listener, or enough to resume over the whole window at bitrate,
+// whichever is more. The tick is a guess when the bitrate isn't known.
+func ringSize(options StationOptions, bitrate int) int {
+	size := max(options.Prebuffer, HIGHLATENCYPREBUFFER)
+	if options.ResumeWindow <= 0 {
+		return size
+	}
+	tick := options.Delay
+	if bitrate > 0 {
+		tick = tickInterval(options.BufferSize, bitrate)
+	}
+	if tick <= 0 {
+		return size
+	}
+	return max(size, int((options.ResumeWindow+tick-1)/tick))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResumeTokens(t *testing.T) {
+	if NewResumeTokens(0) != nil {
+		t.Error("NewResumeTokens(0) offers resuming")
+	}
+	var none *ResumeTokens
+	none.save("token", 1)
+	if _, ok := none.take("token"); ok {
+		t.Error("nil ResumeTokens resumed a listener")
+	}
+
+	tokens := NewResumeTokens(50 * time.Millisecond)
+	first, second := tokens.issue(), tokens.issue()
+	if len(first) != 32 || first == second {
+		t.Errorf("issued %q then %q, want different 16 byte tokens", first, second)
+	}
+	if _, ok := tokens.take(first); ok {
+		t.Error("took a token before its connection ended")
+	}
+	tokens.save(first, 7)
+	tokens.save(second, 0) // Never sent anything, so nothing to resume from
+	if seq, ok := tokens.take(first); !ok || seq != 7 {
+		t.Errorf("take() = %d, %v, want 7, true", seq, ok)
+	}
+	if _, ok := tokens.take(first); ok {
+		t.Error("token resumed a second time")
+	}
+	if _, ok := tokens.take(second); ok {
+		t.Error("resumed a connection that was sent nothing")
+	}
+
+	tokens.save(first, 8)
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := tokens.take(first); ok {
+		t.Error("resumed after the window")
+	}
+}
+
+func TestRingSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		options StationOptions
+		bitrate int
+		want    int
+	}{
+		{"prebuffer only", StationOptions{Prebuffer: 20}, 0, 20},
+		{"high latency prebuffer", StationOptions{Prebuffer: 2}, 0, HIGHLATENCYPREBUFFER},
+		{"window at bitrate", StationOptions{BufferSize: 1000, ResumeWindow: 10 * time.Second}, 64000, 80}, // A chunk every 125ms
+		{"window at delay", StationOptions{Delay: 100 * time.Millisecond, ResumeWindow: 10 * time.Second}, 0, 100},
+		{"no tick", StationOptions{ResumeWindow: 10 * time.Second}, 0, HIGHLATENCYPREBUFFER},
+	}
+	for _, test := range tests {
+		if got := ringSize(test.options, test.bitrate); got != test.want {
+			t.Errorf("%s: ringSize() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// A listener reconnecting with its token is sent what was broadcast while
+// it was away before anything live
+func TestResumeCatchesUp(t *testing.T) {
+	options := testOptions()
+	options.Prebuffer = 1
+	options.ResumeWindow = time.Minute
+	station := newStation("test", "/stream", options)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	connect := func(query string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	read := func(resp *http.Response, want string) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(resp.Body, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("read %q, want %q", got, want)
+		}
+	}
+	station.pool.Broadcast([]byte("first ")) // Sent as the prebuffer
+	resp := connect("")
+	token := resp.Header.Get("X-Resume-Token")
+	if token == "" {
+		t.Fatal("no X-Resume-Token sent")
+	}
+	read(resp, "first ")
+	station.pool.Broadcast([]byte("second "))
+	read(resp, "second ")
+	resp.Body.Close()
+	waitFor(t, "the listener to leave", func() bool { return station.pool.Count() == 0 })
+
+	station.pool.Broadcast([]byte("missed "))
+	station.pool.Broadcast([]byte("also "))
+	resumed := connect("?resume=" + token)
+	defer resumed.Body.Close()
+	if got := resumed.Header.Get("X-Resume-Token"); got != token {
+		t.Errorf("resumed with token %q, want %q kept", got, token)
+	}
+	station.pool.Broadcast([]byte("live"))
+	read(resumed, "missed also live")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"syscall"
+	"time"
+)
+
+const (
+	OPENATTEMPTS   = 4 // tries at opening a file before giving up, by default
+	OPENMINBACKOFF = 200 * time.Millisecond
+	OPENMAXBACKOFF = 5 * time.Second
+)
+
+// backoff is an exponential backoff from min up to max. Every wait is
+// jittered to between half and all of the current step, so stations
+// retrying the same share or upstream don't do it in lockstep.
+type backoff struct {
+	min, max time.Duration
+	step     time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max, step: min}
+}
+
+// next returns how long to wait before the next try and doubles the step
+func (b *backoff) next() time.Duration {
+	step := b.step
+	b.step = min(b.step*2, b.max)
+	return step/2 + rand.N(step/2+1)
+}
+
+// reset starts again from min, after a success
+func (b *backoff) reset() {
+	b.step = b.min
+}
+
+// isTransient reports whether err came from the file system, which may well
+// work on another try, e.g. a network share that dropped out, rather than
+// from what was read
+func isTransient(err error) bool {
+	var pathErr *fs.PathError
+	var errno syscall.Errno // What's left once sourceError has described the path
+	return errors.As(err, &pathErr) || errors.As(err, &errno)
+}
+
+// retryOpen calls open until it succeeds, fails in a way that isn't
+// transient or has been tried attempts times, backing off in between. It
+// returns open's last error, also when ctx is cancelled while waiting.
+func retryOpen(ctx context.Context, attempts int, path string, open func() error) error {
+	wait := newBackoff(OPENMINBACKOFF, OPENMAXBACKOFF)
+	for attempt := 1; ; attempt++ {
+		err := open()
+		if err == nil || attempt >= attempts || !isTransient(err) {
+			return err
+		}
+		retryIn := wait.next()
+		slog.Warn("could not open, retrying", "path", path, "attempt", attempt, "retry_in", retryIn, "error", err)
+		select {
+		case <-time.After(retryIn):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	wait := newBackoff(100*time.Millisecond, time.Second)
+	ms := time.Millisecond
+	for i, step := range []time.Duration{100 * ms, 200 * ms, 400 * ms, 800 * ms, time.Second, time.Second} { // Capped at the maximum
+		if got := wait.next(); got < step/2 || got > step {
+			t.Errorf("wait %d = %v, want between %v and %v", i, got, step/2, step)
+		}
+	}
+	wait.reset()
+	if got := wait.next(); got > 100*time.Millisecond {
+		t.Errorf("wait after reset = %v, want at most the minimum", got)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for err, want := range map[error]bool{
+		&fs.PathError{Op: "open", Path: "track.mp3", Err: syscall.EIO}: true,
+		fmt.Errorf("reading track: %w", syscall.ESTALE):                true,
+		errors.New("not an audio file"):                                false,
+	} {
+		if got := isTransient(err); got != want {
+			t.Errorf("isTransient(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
+
+func TestRetryOpen(t *testing.T) {
+	transient := &fs.PathError{Op: "open", Path: "track.mp3", Err: syscall.EIO}
+	tests := []struct {
+		name     string
+		attempts int
+		failures []error // returned by open in turn, then it succeeds
+		tries    int
+		err      error
+	}{
+		{"first time", 3, nil, 1, nil},
+		{"after a transient failure", 3, []error{transient}, 2, nil},
+		{"out of attempts", 2, []error{transient, transient, transient}, 2, transient},
+		{"not transient", 3, []error{errUnrecognisedFormat}, 1, errUnrecognisedFormat},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tries := 0
+			err := retryOpen(context.Background(), test.attempts, "track.mp3", func() error {
+				tries++
+				if tries <= len(test.failures) {
+					return test.failures[tries-1]
+				}
+				return nil
+			})
+			if err != test.err || tries != test.tries {
+				t.Errorf("retryOpen() = %v after %d tries, want %v after %d", err, tries, test.err, test.tries)
+			}
+		})
+	}
+}
+
+// Shutting down doesn't wait out a backoff
+func TestRetryOpenCancelled(t *testing.T) {
+	transient := &fs.PathError{Op: "open", Path: "track.mp3", Err: syscall.EIO}
+	ctx, cancel := context.WithCancel(context.Background())
+	tries := 0
+	start := time.Now()
+	err := retryOpen(ctx, 100, "track.mp3", func() error {
+		tries++
+		cancel()
+		return transient
+	})
+	if err != transient || tries != 1 {
+		t.Errorf("retryOpen() = %v after %d tries, want the open error after 1", err, tries)
+	}
+	if elapsed := time.Since(start); elapsed >= OPENMINBACKOFF/2 {
+		t.Errorf("returned after %v, still waited", elapsed)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+// ChunkRing keeps copies of the last few chunks broadcast, so a listener
+// joining now can be sent the audio just before it. It's safe for
+// concurrent use. A nil ring, or one of size 0, keeps nothing.
+type ChunkRing struct {
+	mu     sync.Mutex
+	chunks []Chunk // len grows to cap, then the oldest slot is overwritten
+	next   int     // slot the next chunk goes in, the oldest once the ring is full
+}
+
+func NewChunkRing(size int) *ChunkRing {
+	if size <= 0 {
+		return nil
+	}
+	return &ChunkRing{chunks: make([]Chunk, 0, size)}
+}
+
+// Push copies data into the ring, reusing the storage of the chunk it
+// pushes out
+func (r *ChunkRing) Push(data []byte, seq uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.chunks) < cap(r.chunks) {
+		r.chunks = append(r.chunks, Chunk{Data: append([]byte{}, data...), Seq: seq})
+	} else {
+		oldest := &r.chunks[r.next]
+		oldest.Data = append(oldest.Data[:0], data...)
+		oldest.Seq = seq
+	}
+	r.next = (r.next + 1) % cap(r.chunks)
+}
+
+// Last returns copies of the newest n chunks in the ring, oldest first
+func (r *ChunkRing) Last(n int) []Chunk {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n = min(n, len(r.chunks))
+	chunks := make([]Chunk, 0, n)
+	for i := len(r.chunks) - n; i < len(r.chunks); i++ { // Until the ring is full next is len, i.e. 0 here
+		chunk := r.chunks[(r.next+i)%len(r.chunks)]
+		chunks = append(chunks, Chunk{Data: append([]byte{}, chunk.Data...), Seq: chunk.Seq})
+	}
+	return chunks
+}
+
+// After returns copies of the chunks in the ring broadcast after seq, oldest
+// first. Any that have already been pushed out are missing.
+func (r *ChunkRing) After(seq uint64) []Chunk {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var chunks []Chunk
+	for i := range len(r.chunks) {
+		if chunk := r.chunks[(r.next+i)%len(r.chunks)]; chunk.Seq > seq {
+			chunks = append(chunks, Chunk{Data: append([]byte{}, chunk.Data...), Seq: chunk.Seq})
+		}
+	}
+	return chunks
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// seqs lists the sequence numbers of chunks, and checks each holds the data
+// it was pushed with
+func seqs(t *testing.T, chunks []Chunk) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	for _, chunk := range chunks {
+		if want := fmt.Sprint("chunk ", chunk.Seq); string(chunk.Data) != want {
+			t.Errorf("chunk %d holds %q", chunk.Seq, chunk.Data)
+		}
+		seqs = append(seqs, chunk.Seq)
+	}
+	return seqs
+}
+
+func TestChunkRing(t *testing.T) {
+	tests := []struct {
+		pushed    int
+		last      int
+		wantLast  []uint64
+		after     uint64
+		wantAfter []uint64
+	}{
+		{pushed: 0, last: 2, wantLast: nil, after: 0, wantAfter: nil},
+		{pushed: 2, last: 3, wantLast: []uint64{1, 2}, after: 1, wantAfter: []uint64{2}},
+		{pushed: 3, last: 2, wantLast: []uint64{2, 3}, after: 0, wantAfter: []uint64{1, 2, 3}},
+		{pushed: 7, last: 2, wantLast: []uint64{6, 7}, after: 2, wantAfter: []uint64{5, 6, 7}}, // Wrapped, 3 and 4 are gone
+		{pushed: 7, last: 5, wantLast: []uint64{5, 6, 7}, after: 7, wantAfter: nil},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("pushed=%d", test.pushed), func(t *testing.T) {
+			ring := NewChunkRing(3)
+			for seq := uint64(1); seq <= uint64(test.pushed); seq++ {
+				ring.Push([]byte(fmt.Sprint("chunk ", seq)), seq)
+			}
+			if got := seqs(t, ring.Last(test.last)); !slices.Equal(got, test.wantLast) {
+				t.Errorf("Last(%d) = %v, want %v", test.last, got, test.wantLast)
+			}
+			if got := seqs(t, ring.After(test.after)); !slices.Equal(got, test.wantAfter) {
+				t.Errorf("After(%d) = %v, want %v", test.after, got, test.wantAfter)
+			}
+		})
+	}
+}
+
+// The ring keeps copies, so neither the broadcaster reusing its buffer nor
+// a listener writing to what it was given changes what's kept
+func TestChunkRingCopies(t *testing.T) {
+	ring := NewChunkRing(2)
+	buffer := []byte("chunk 1")
+	ring.Push(buffer, 1)
+	copy(buffer, "overwritten")
+	ring.Last(1)[0].Data[0] = 'X'
+	if got := seqs(t, ring.After(0)); !slices.Equal(got, []uint64{1}) {
+		t.Errorf("ring holds %v", got)
+	}
+}
+
+func TestChunkRingDisabled(t *testing.T) {
+	for _, ring := range []*ChunkRing{NewChunkRing(0), nil} {
+		ring.Push([]byte("chunk 1"), 1)
+		if ring.Last(1) != nil || ring.After(0) != nil {
+			t.Error("a ring of size 0 kept a chunk")
+		}
+	}
+}
+
+// Run with -race: broadcasting and listeners joining at once
+func TestChunkRingConcurrent(t *testing.T) {
+	ring := NewChunkRing(4)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for seq := uint64(1); seq <= 1000; seq++ {
+			ring.Push([]byte(fmt.Sprint("chunk ", seq)), seq)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			got := seqs(t, ring.Last(4))
+			for j := 1; j < len(got); j++ {
+				if got[j] != got[j-1]+1 {
+					t.Errorf("Last(4) = %v, not consecutive", got)
+					return
+				}
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+// A new listener is sent the pool's newest chunks first, running straight
+// into the next broadcast
+func TestPrebuffer(t *testing.T) {
+	pool := NewConnectionPool("/test-prebuffer", 16)
+	pool.recent = NewChunkRing(4)
+	for seq := 1; seq <= 5; seq++ {
+		pool.Broadcast([]byte(fmt.Sprint("chunk ", seq)))
+	}
+	connection := newTestConnection(4)
+	connection.prebufferChunks = 2
+	if err := pool.AddConnection(connection); err != nil {
+		t.Fatal(err)
+	}
+	pool.Broadcast([]byte("chunk 6"))
+	got := seqs(t, connection.prebuffer)
+	got = append(got, seqs(t, []Chunk{<-connection.bufferChannel})...)
+	if want := []uint64{4, 5, 6}; !slices.Equal(got, want) {
+		t.Errorf("listener got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Program is a show on a station's schedule, played between two times of
+// day. A range that ends before it starts runs past midnight.
+type Program struct {
+	Name   string // the source's name without extension, e.g. "morning" for morning.m3u
+	Source string
+	start  int // minutes after midnight
+	end    int
+}
+
+func (p Program) covers(minute int) bool {
+	if p.start <= p.end {
+		return minute >= p.start && minute < p.end
+	}
+	return minute >= p.start || minute < p.end
+}
+
+// Schedule says which program a station plays when. Outside every
+// program the station plays its own source, and where programs overlap the
+// one listed first wins.
+type Schedule struct {
+	programs []Program
+}
+
+// LoadSchedule reads a schedule file with one program per line, e.g.
+//
+//	08:00-12:00 => morning.m3u
+//	22:00-02:00 => late.m3u
+//
+// Blank lines and lines starting with # are skipped. Sources are relative to
+// the schedule. Every bad line is reported, not just the first.
+func LoadSchedule(path, mediaRoot string) (*Schedule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	schedule := &Schedule{}
+	var errs []error
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		program, err := parseProgram(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %w", path, number, err))
+			continue
+		}
+		if !filepath.IsAbs(program.Source) {
+			program.Source = filepath.Join(filepath.Dir(path), program.Source)
+		}
+		if program.Source, err = resolveLocalPath(mediaRoot, program.Source); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %w", path, number, err))
+			continue
+		}
+		for _, other := range schedule.programs {
+			if other.covers(program.start) || program.covers(other.start) {
+				slog.Warn("programs overlap, the earlier line wins", "schedule", path, "line", number, "program", program.Name, "over", other.Name)
+			}
+		}
+		schedule.programs = append(schedule.programs, program)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(schedule.programs) == 0 {
+		return nil, fmt.Errorf("schedule %s has no programs", path)
+	}
+	return schedule, nil
+}
+
+// parseProgram parses one "HH:MM-HH:MM => source" line
+func parseProgram(line string) (Program, error) {
+	times, source, ok := strings.Cut(line, "=>")
+	source = strings.TrimSpace(source)
+	if !ok || source == "" {
+		return Program{}, fmt.Errorf("expected HH:MM-HH:MM => source, got %q", line)
+	}
+	from, to, ok := strings.Cut(strings.TrimSpace(times), "-")
+	if !ok {
+		return Program{}, fmt.Errorf("expected a time range such as 08:00-12:00, got %q", strings.TrimSpace(times))
+	}
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return Program{}, err
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return Program{}, err
+	}
+	if start == end {
+		return Program{}, fmt.Errorf("%s starts and ends at the same time", strings.TrimSpace(times))
+	}
+	return Program{Name: trackTitle(source), Source: source, start: start, end: end}, nil
+}
+
+// parseTimeOfDay parses HH:MM into minutes after midnight. 24:00 is
+// midnight at the end of the day.
+func parseTimeOfDay(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("expected a time of day such as 08:00, got %q", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// At returns the program on at t, in t's time zone, or false in a gap
+func (s *Schedule) At(t time.Time) (Program, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	for _, program := range s.programs {
+		if program.covers(minute) {
+			return program, true
+		}
+	}
+	return Program{}, false
+}
+
+// followSchedule switches the playlist to the program on now, or back to
+// the station's own source in a gap, if that isn't what's playing. It runs
+// on the stream goroutine between tracks, so the track playing at a
+// program's boundary is always heard to the end. A program that can't be
+// loaded is logged and the current playlist carries on. It reports whether
+// the playlist changed.
+func (s *Station) followSchedule() bool {
+	if s.schedule == nil {
+		return false
+	}
+	program, _ := s.schedule.At(time.Now())
+	if current := s.program.Load(); current != nil && current.Source == program.Source {
+		return false
+	} else if current == nil && program.Source == "" {
+		return false
+	}
+
+	playlist, err := s.loadProgram(program.Source)
+	if err != nil {
+		slog.Warn("could not switch programs, carrying on with the current one", "station", s.Name, "program", program.Name, "source", program.Source, "error", err)
+		return false
+	}
+
+	if program.Source == "" {
+		slog.Info("switching back to the station's own source, no program is on", "station", s.Name, "source", s.source)
+		s.program.Store(nil)
+	} else {
+		slog.Info("switching programs", "station", s.Name, "program", program.Name, "source", program.Source, "tracks", playlist.Len())
+		s.program.Store(&program)
+	}
+	s.pending.Store(nil) // Loaded afresh just now, or again when the program ends
+	s.playlist.Replace(playlist.Tracks())
+	return true
+}
+
+// programName is the name of the program on, "" when the station is
+// playing its own source
+func (s *Station) programName() string {
+	if program := s.program.Load(); program != nil {
+		return program.Name
+	}
+	return ""
+}
+
+// loadProgram loads a program's source, or the station's own for "", and
+// checks it can be played in the stream's format
+func (s *Station) loadProgram(source string) (*Playlist, error) {
+	var playlist *Playlist
+	var err error
+	if source == "" {
+		playlist, err = s.loadSource()
+	} else {
+		playlist, err = loadSource(source, s.mediaRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTracks(playlist); err != nil {
+		return nil, err
+	}
+	contentType, err := streamFormat(playlist, s.overrideType)
+	if err != nil {
+		return nil, err
+	}
+	if s.contentType != "" && contentType != s.contentType {
+		return nil, fmt.Errorf("the program is %s but the stream is %s, listeners can't switch formats", contentType, s.contentType)
+	}
+	return playlist, nil
+}
+
+// useSchedule has the station follow schedule, once every program has been
+// checked to be playable in the stream's format
+func (s *Station) useSchedule(schedule *Schedule) error {
+	var errs []error
+	for _, program := range schedule.programs {
+		if _, err := s.loadProgram(program.Source); err != nil {
+			errs = append(errs, fmt.Errorf("program %s: %w", program.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	s.schedule = schedule
+	return nil
+}
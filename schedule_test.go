@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProgram(t *testing.T) {
+	tests := []struct {
+		line       string
+		start, end int
+		err        bool
+	}{
+		{"08:00-12:00 => morning.m3u", 8 * 60, 12 * 60, false},
+		{"22:30 - 02:00=>late.m3u", 22*60 + 30, 2 * 60, false},
+		{"18:00-24:00 => evening.m3u", 18 * 60, 24 * 60, false},
+		{"08:00-12:00 morning.m3u", 0, 0, true},
+		{"08:00-12:00 =>", 0, 0, true},
+		{"08:00 => morning.m3u", 0, 0, true},
+		{"8am-12:00 => morning.m3u", 0, 0, true},
+		{"08:00-08:00 => morning.m3u", 0, 0, true},
+	}
+	for _, test := range tests {
+		program, err := parseProgram(test.line)
+		if (err != nil) != test.err {
+			t.Errorf("parseProgram(%q) error = %v, want error %v", test.line, err, test.err)
+			continue
+		}
+		if err == nil && (program.start != test.start || program.end != test.end) {
+			t.Errorf("parseProgram(%q) runs %d-%d, want %d-%d", test.line, program.start, program.end, test.start, test.end)
+		}
+	}
+}
+
+func TestLoadSchedule(t *testing.T) {
+	path := writeTestFile(t, "schedule.txt", []byte("# Weekdays\n\n08:00-12:00 => morning.m3u\n22:00-02:00 => late.m3u\n09:00-10:00 => news.mp3\n"))
+	schedule, err := LoadSchedule(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, program := range schedule.programs {
+		names = append(names, program.Name)
+	}
+	if want := []string{"morning", "late", "news"}; !slices.Equal(names, want) {
+		t.Errorf("programs %v, want %v", names, want)
+	}
+	if want := filepath.Join(filepath.Dir(path), "morning.m3u"); schedule.programs[0].Source != want {
+		t.Errorf("source %q, want %q relative to the schedule", schedule.programs[0].Source, want)
+	}
+
+	day := time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local)
+	for clock, want := range map[string]string{
+		"08:00": "morning",
+		"09:30": "morning", // Overlaps news, listed first
+		"11:59": "morning",
+		"12:00": "", // A gap
+		"23:00": "late",
+		"01:30": "late", // Past midnight
+		"02:00": "",
+	} {
+		at, _ := time.Parse("15:04", clock)
+		program, ok := schedule.At(day.Add(time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute))
+		if program.Name != want || ok != (want != "") {
+			t.Errorf("At(%s) = %q, %v, want %q", clock, program.Name, ok, want)
+		}
+	}
+}
+
+// Every bad line is reported at once
+func TestLoadScheduleErrors(t *testing.T) {
+	_, err := LoadSchedule(writeTestFile(t, "schedule.txt", []byte("08:00-12:00 => morning.m3u\nnoon => lunch.m3u\n13:00-25:00 => afternoon.m3u\n")), "")
+	if err == nil {
+		t.Fatal("LoadSchedule() accepted bad lines")
+	}
+	for _, line := range []string{"schedule.txt:2", "schedule.txt:3"} {
+		if !strings.Contains(err.Error(), line) {
+			t.Errorf("error %q doesn't mention %s", err, line)
+		}
+	}
+	if _, err := LoadSchedule(writeTestFile(t, "schedule.txt", []byte("# Nothing yet\n")), ""); err == nil {
+		t.Error("LoadSchedule() accepted a schedule with no programs")
+	}
+}
+
+// aroundNow is a program on from an hour ago to an hour from now
+func aroundNow(name, source string) Program {
+	now := time.Now()
+	minute := now.Hour()*60 + now.Minute()
+	return Program{Name: name, Source: source, start: (minute + 23*60) % (24 * 60), end: (minute + 60) % (24 * 60)}
+}
+
+// The station switches to the program on between tracks, and back to its
+// own source once it's over
+func TestFollowSchedule(t *testing.T) {
+	station, err := NewStation("test", "/stream", silenceFile(t, "own.mp3", 100*time.Millisecond), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	morning := silenceFile(t, "morning.mp3", 100*time.Millisecond)
+	if err := station.useSchedule(&Schedule{programs: []Program{aroundNow("morning", morning)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !station.followSchedule() {
+		t.Fatal("followSchedule() didn't switch to the program on")
+	}
+	if got := station.playlist.Tracks(); !slices.Equal(got, []string{morning}) || station.programName() != "morning" {
+		t.Errorf("playing %v on program %q, want the morning program", got, station.programName())
+	}
+	if station.followSchedule() {
+		t.Error("followSchedule() switched again to the program already on")
+	}
+
+	later := aroundNow("later", morning)
+	later.start, later.end = (later.start+12*60)%(24*60), (later.end+12*60)%(24*60)
+	station.schedule = &Schedule{programs: []Program{later}}
+	if !station.followSchedule() {
+		t.Fatal("followSchedule() didn't switch back in a gap")
+	}
+	if got := station.playlist.Tracks(); len(got) != 1 || filepath.Base(got[0]) != "own.mp3" || station.programName() != "" {
+		t.Errorf("playing %v on program %q, want the station's own source", got, station.programName())
+	}
+}
+
+// Programs have to be in the stream's format, and one that goes missing
+// later leaves the current playlist playing
+func TestScheduleProgramChecked(t *testing.T) {
+	station, err := NewStation("test", "/stream", silenceFile(t, "own.mp3", 100*time.Millisecond), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aac := silenceFile(t, "morning.aac", 100*time.Millisecond)
+	if err := station.useSchedule(&Schedule{programs: []Program{aroundNow("morning", aac)}}); err == nil {
+		t.Error("useSchedule() accepted an AAC program on an MP3 stream")
+	}
+
+	morning := silenceFile(t, "morning.mp3", 100*time.Millisecond)
+	if err := station.useSchedule(&Schedule{programs: []Program{aroundNow("morning", morning)}}); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(morning)
+	if station.followSchedule() || station.programName() != "" {
+		t.Error("followSchedule() switched to a program that can't be loaded")
+	}
+}
+
+func TestNowPlayingProgram(t *testing.T) {
+	station, err := NewStation("test", "/stream", silenceFile(t, "own.mp3", 100*time.Millisecond), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := station.useSchedule(&Schedule{programs: []Program{aroundNow("morning", silenceFile(t, "morning.mp3", 100*time.Millisecond))}}); err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	waitFor(t, "the morning program", func() bool {
+		playing := station.NowPlaying()
+		return playing.File == "morning.mp3" && playing.Program == "morning"
+	})
+}
+
+// A playlist reloaded while a program is on isn't thrown away when the
+// program's tracks go round, it waits for the station's own source
+func TestReloadDuringProgram(t *testing.T) {
+	station, err := NewStation("test", "/stream", silenceFile(t, "own.mp3", 100*time.Millisecond), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	morning := silenceFile(t, "morning.mp3", 100*time.Millisecond)
+	if err := station.useSchedule(&Schedule{programs: []Program{aroundNow("morning", morning)}}); err != nil {
+		t.Fatal(err)
+	}
+	if !station.followSchedule() {
+		t.Fatal("followSchedule() didn't switch to the program on")
+	}
+
+	if _, err := station.ReloadPlaylist(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	station.advance(false)
+	if got := station.playlist.Tracks(); !slices.Equal(got, []string{morning}) {
+		t.Errorf("playing %v, want the program's tracks until it ends", got)
+	}
+	if station.pending.Load() == nil {
+		t.Error("reloaded playlist dropped while the program was on")
+	}
+
+	later := aroundNow("later", morning)
+	later.start, later.end = (later.start+12*60)%(24*60), (later.end+12*60)%(24*60)
+	station.schedule = &Schedule{programs: []Program{later}}
+	station.advance(false)
+	if got := station.playlist.Tracks(); len(got) != 1 || filepath.Base(got[0]) != "own.mp3" || station.pending.Load() != nil {
+		t.Errorf("playing %v once the program ended, want the reloaded source", got)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	silenceSampleRate = 44100
+	silenceChannels   = 2
+)
+
+// writeSilence creates path holding duration of silence, as ADTS AAC, MP3
+// or 16-bit PCM WAV depending on its extension, to have audio to test with.
+// MP3 and AAC are whole frames, so they can run up to a frame long.
+// An existing file is never overwritten.
+func writeSilence(path string, duration time.Duration) error {
+	var header, frame []byte
+	var count int
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".aac":
+		frame, count = silentADTSFrame, frameCount(duration, 1024)
+	case ".mp3":
+		frame, count = silentMPEGFrame, frameCount(duration, 1152)
+	case ".wav":
+		samples := int(duration.Seconds() * silenceSampleRate)
+		frame, count = make([]byte, 2*silenceChannels), samples
+		header = wavHeader(samples * len(frame))
+	default:
+		return fmt.Errorf("can only generate .aac, .mp3 or .wav files, not %s", path)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	w.Write(header)
+	for range count {
+		w.Write(frame)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// frameCount is how many frames of samplesPerFrame cover duration
+func frameCount(duration time.Duration, samplesPerFrame int) int {
+	samples := duration.Seconds() * silenceSampleRate
+	return int((samples + float64(samplesPerFrame) - 1) / float64(samplesPerFrame))
+}
+
+// wavHeader is the RIFF header of a 16-bit PCM WAV file with dataSize bytes
+// of samples
+func wavHeader(dataSize int) []byte {
+	const bitsPerSample = 16
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+dataSize))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(header[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(header[22:], silenceChannels)
+	binary.LittleEndian.PutUint32(header[24:], silenceSampleRate)
+	binary.LittleEndian.PutUint32(header[28:], silenceSampleRate*silenceChannels*bitsPerSample/8)
+	binary.LittleEndian.PutUint16(header[32:], silenceChannels*bitsPerSample/8)
+	binary.LittleEndian.PutUint16(header[34:], bitsPerSample)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(dataSize))
+	return header
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteSilence(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		prefix      []byte
+		contentType string
+	}{
+		{"silence.aac", 44 * len(silentADTSFrame), silentADTSFrame, "audio/aac"},  // 1024 samples a frame, rounded up
+		{"silence.mp3", 39 * len(silentMPEGFrame), silentMPEGFrame, "audio/mpeg"}, // 1152 samples a frame
+		{"silence.WAV", 44 + 44100*4, []byte("RIFF"), "audio/wav"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := silenceFile(t, test.name, time.Second)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != test.size || !bytes.HasPrefix(data, test.prefix) {
+				t.Errorf("wrote %d bytes starting %x, want %d starting %x", len(data), data[:min(len(data), 8)], test.size, test.prefix)
+			}
+			if got := sniffContentType(data); got != test.contentType {
+				t.Errorf("sniffed as %q, want %q", got, test.contentType)
+			}
+		})
+	}
+}
+
+func TestWriteSilenceFails(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.mp3")
+	if err := os.WriteFile(existing, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{existing, filepath.Join(dir, "silence.flac")} {
+		if err := writeSilence(path, time.Second); err == nil {
+			t.Errorf("writeSilence(%s) succeeded", path)
+		}
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "keep" {
+		t.Errorf("existing file overwritten with %q", data)
+	}
+}
+
+// A generated file streams byte for byte as it was written
+func TestStreamSilence(t *testing.T) {
+	path := silenceFile(t, "silence.aac", 200*time.Millisecond)
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := testOptions()
+	options.Bitrate = 10_000_000 // Rather than the real time of a few bytes a frame
+	station, err := NewStation("test", "/stream", path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "audio/aac" {
+		t.Errorf("Content-Type = %q, want audio/aac", got)
+	}
+	// Joined part way through a pass, so a whole one is somewhere in two
+	got := make([]byte, 2*len(want))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(got, want) {
+		t.Error("streamed audio doesn't hold the generated file")
+	}
+}
@@ -0,0 +1,1067 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Station is a single mount point: its own listeners, source tracks and
+// stream goroutine. Listeners of one station never receive another's audio.
+type Station struct {
+	Name  string
+	Mount string
+
+	pool     *ConnectionPool
+	playlist *Playlist        // nil for live stations
+	queue    *Queue           // played ahead of the playlist, nil for live stations
+	live     io.Reader        // read continuously instead of a playlist, nil for file stations
+	memory   func() io.Reader // next pass of an in-memory source, which returns nil once done; nil for file stations
+	relayURL string           // upstream rebroadcast instead of a playlist, empty for file stations
+
+	relayConnected atomic.Bool
+
+	variants  []*Station // other renditions of the station, e.g. a lower bitrate, each with its own mount
+	variantOf *Station   // the station this is a variant of, nil for a main station
+
+	source       string      // what the playlist was loaded from
+	directory    bool        // source is a directory, rescanned each time the playlist wraps
+	recursive    bool        // a directory source includes its subdirectories
+	offline      atomic.Bool // the source is missing and offlineAudio is on air instead
+	offlineAudio []byte
+	offlinePath  string // streamed from disk instead of offlineAudio, which only has its start, see loadOfflineAudio
+
+	reload  chan struct{}            // asks stream to re-open the current track
+	pending atomic.Pointer[[]string] // tracks of a reloaded playlist, swapped in after the current track
+	skip    chan chan string         // asks stream to move on, it sends the next track's title back
+	skipped chan string              // reply to the pending skip, stream goroutine only
+	paused  atomic.Bool
+	resumed chan struct{} // wakes stream up after a pause
+	history *History
+
+	nowPlaying    atomic.Pointer[NowPlaying]
+	streaming     atomic.Bool
+	lastBroadcast atomic.Int64           // unix nanoseconds of the last chunk broadcast
+	silent        atomic.Bool            // set by the watchdog while there is dead air
+	lag           atomic.Int64           // nanoseconds the last tick came late by
+	lagWarned     time.Time              // when lag was last logged, stream goroutine only
+	realTime      atomic.Uint64          // float64 bits of the current track's real-time factor, 0 when unknown
+	oggHeaders    atomic.Pointer[[]byte] // header pages of the OGG track playing, sent to listeners first
+	wavHeader     atomic.Pointer[[]byte] // streaming WAV header for the track playing with -wav-header, sent to listeners first
+
+	contentType     string
+	bitrate         int    // bits per second of the first track, 0 when unknown
+	overrideBitrate int    // bits per second, 0 to detect per track
+	overrideType    string // sent as Content-Type in place of contentType, see responseContentType
+	writeTimeout    time.Duration
+	mediaRoot       string
+	bufferSize      int
+	clientBuffer    int // chunks queued per listener before broadcasts to it are dropped
+	ipLimiter       *IPLimiter
+	events          *EventBus
+	genre           string
+	logo            []byte
+	url             string
+	icyAgents       []string // User-Agent substrings of players sent an ICY status line
+	headers         http.Header
+	framed          bool
+	delay           time.Duration
+
+	onDemand       bool
+	onEOF          string      // EOFLOOP, EOFHOLD or EOFEXIT
+	ended          atomic.Bool // the playlist has been played and is being held, see EOFHOLD
+	noKeepalive    bool
+	maxDuration    time.Duration           // how long one listener may stay connected, 0 for no limit
+	alignFrames    bool                    // finish the frame in flight before a reload or skip cuts the track
+	openAttempts   int                     // tries at opening a track or reloading the source, see retryOpen
+	adaptivePacing bool                    // correct every tick so tracks keep to real time, see pacer
+	schedule       *Schedule               // programs played at set times instead of the source, nil for none
+	program        atomic.Pointer[Program] // the program on, nil while the source plays
+	resume         *ResumeTokens
+	draining       atomic.Bool            // stop after the current track, see drainable
+	stopped        chan struct{}          // closed when stream returns
+	mmaps          map[string]*mappedFile // tracks memory mapped with -mmap by path, stream goroutine only, nil without
+	maxInMemory    int64                  // bytes of the largest file held in memory whole, 0 for no limit
+	wavStream      bool                   // WAV tracks are broadcast as raw PCM behind one streaming header, see storeWAVHeader
+	deadAir        time.Duration          // silence before the watchdog steps in, 0 for no watchdog
+	fallback       string                 // broadcast during dead air, "" to only log it
+	crossfade      time.Duration
+	normalize      bool
+	fadeTail       []byte    // end of the previous track, held back to mix into the next, stream goroutine only
+	adtsCarry      adtsCarry // end of the previous AAC track, held back to join onto the next, stream goroutine only
+	fadeFormat     wavFormat
+	wavFormat      wavFormat // of the WAV track playing with -wav-header, stream goroutine only
+}
+
+// StationOptions are the settings shared by every station
+type StationOptions struct {
+	Bitrate        int           // bits per second used to pace every track, 0 to detect per track
+	ContentType    string        // sent to listeners whatever the tracks are detected as, "" to send the detected type
+	MaxListeners   int           // 0 for no limit
+	MaxDrops       int           // consecutive dropped buffers before a listener is evicted, 0 to never evict
+	WriteTimeout   time.Duration // 0 for no limit
+	HistorySize    int           // number of finished tracks remembered for /history
+	Shuffle        bool
+	Directory      bool          // the source is a directory whose audio files are played, rescanned every time round
+	Recursive      bool          // a Directory source includes its subdirectories
+	Seed           uint64        // shuffle seed, the same seed plays the same order
+	MediaRoot      string        // every file played must be inside this directory, unrestricted when empty
+	Crossfade      time.Duration // overlap between consecutive PCM WAV tracks, 0 for hard cuts
+	Normalize      bool          // bring PCM WAV tracks to the same loudness
+	OnDemand       bool          // tracks are served as files and never broadcast
+	OnEOF          string        // what to do once the playlist has been played, EOFLOOP by default
+	AlignFrames    bool          // cut tracks on ADTS/MPEG frame boundaries when reloading or skipping
+	DeadAir        time.Duration // silence before the watchdog steps in, 0 for no watchdog
+	Fallback       string        // file broadcast during dead air, "" to only log it
+	OpenAttempts   int           // tries at opening a source or track before giving up, backing off in between
+	AdaptivePacing bool          // adjust every tick to keep tracks to real time
+	WAVHeader      bool          // send WAV listeners one streaming header, then raw PCM
+	Logo           []byte        // image served at /artwork when the track has no cover art
+	BufferSize     int           // bytes broadcast per tick
+	MMap           bool          // read tracks through memory mappings kept between loops
+	MaxIdleBuffers int           // buffers kept for reuse per station, 0 to leave it to a sync.Pool
+	ClientBuffer   int           // chunks queued per listener to absorb hiccups, 0 to hand chunks over directly
+	IPLimiter      *IPLimiter    // shared by every station, nil for no per-IP limit
+	Events         *EventBus     // where track and listener changes are published, nil for nowhere
+	Prebuffer      int           // recent chunks sent to new listeners, 0 for none
+	ResumeWindow   time.Duration // how long after dropping a listener may resume where it left off, 0 to not offer it
+	OfflineAudio   []byte        // broadcast on repeat by stations whose source is missing
+	OfflinePath    string        // file broadcast in place of OfflineAudio, read from disk every time round
+	MaxInMemory    int64         // bytes of the largest file held in memory whole, larger ones are read from disk, 0 for no limit
+	Framed         bool          // clients may ask for the framed protocol with ?framed=1
+	NoKeepalive    bool          // close every listener's connection when its stream ends instead of reusing it
+	Headers        http.Header   // sent with every stream, e.g. to stop it being cached
+	MaxDuration    time.Duration // listeners are disconnected after this long, 0 for never
+	Genre          string        // sent to ICY clients as icy-genre
+	URL            string        // sent to ICY clients as icy-url
+	ICYAgents      []string      // User-Agent substrings of legacy players that need an "ICY 200 OK" status line
+	Delay          time.Duration // tick length for tracks whose bitrate is unknown
+}
+
+// NewStation creates a station mounted at mount playing source, which is
+// either an audio file or an M3U/PLS playlist
+func NewStation(name, mount, source string, options StationOptions) (*Station, error) {
+	var playlist *Playlist
+	err := retryOpen(context.Background(), options.OpenAttempts, source, func() error {
+		var err error
+		if options.Directory {
+			playlist, err = LoadDirectory(source, options.MediaRoot, options.Recursive)
+		} else {
+			playlist, err = loadSource(source, options.MediaRoot)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkTracks(playlist); err != nil {
+		return nil, err
+	}
+
+	contentType, err := streamFormat(playlist, options.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Shuffle {
+		playlist.Shuffle(options.Seed)
+	}
+
+	station := newStation(name, mount, options)
+	station.playlist = playlist
+	station.source = source
+	station.queue = &Queue{}
+	station.contentType = contentType
+	station.bitrate = options.Bitrate
+	if station.bitrate == 0 {
+		station.bitrate, _ = detectBitrate(playlist.CurrentTrack()) // Left at 0 (unknown) if it can't be detected
+		station.pool.recent = NewChunkRing(ringSize(options, station.bitrate))
+	}
+	return station, nil
+}
+
+// newStation sets up everything a station needs apart from its source
+func newStation(name, mount string, options StationOptions) *Station {
+	pool := NewConnectionPool(mount, options.BufferSize)
+	pool.maxConnections = options.MaxListeners
+	pool.maxDrops = options.MaxDrops
+	pool.recent = NewChunkRing(ringSize(options, options.Bitrate))
+	pool.prebuffer = options.Prebuffer
+	pool.limitIdleBuffers(options.MaxIdleBuffers)
+
+	station := &Station{
+		Name:            name,
+		Mount:           mount,
+		pool:            pool,
+		reload:          make(chan struct{}, 1),
+		skip:            make(chan chan string, 1),
+		resumed:         make(chan struct{}, 1),
+		history:         NewHistory(options.HistorySize),
+		overrideBitrate: options.Bitrate,
+		overrideType:    options.ContentType,
+		writeTimeout:    options.WriteTimeout,
+		mediaRoot:       options.MediaRoot,
+		crossfade:       options.Crossfade,
+		normalize:       options.Normalize,
+		onDemand:        options.OnDemand,
+		onEOF:           cmp.Or(options.OnEOF, EOFLOOP),
+		noKeepalive:     options.NoKeepalive,
+		maxDuration:     options.MaxDuration,
+		alignFrames:     options.AlignFrames,
+		openAttempts:    max(options.OpenAttempts, 1),
+		adaptivePacing:  options.AdaptivePacing,
+		wavStream:       options.WAVHeader || options.Crossfade > 0, // Crossfaded tracks are raw PCM, which needs the header
+		logo:            options.Logo,
+		deadAir:         options.DeadAir,
+		fallback:        options.Fallback,
+		bufferSize:      options.BufferSize,
+		clientBuffer:    options.ClientBuffer,
+		ipLimiter:       options.IPLimiter,
+		events:          options.Events,
+		offlineAudio:    options.OfflineAudio,
+		offlinePath:     options.OfflinePath,
+		maxInMemory:     options.MaxInMemory,
+		directory:       options.Directory,
+		recursive:       options.Recursive,
+		genre:           options.Genre,
+		url:             options.URL,
+		icyAgents:       options.ICYAgents,
+		headers:         options.Headers,
+		framed:          options.Framed,
+		delay:           options.Delay,
+		resume:          NewResumeTokens(options.ResumeWindow),
+		stopped:         make(chan struct{}),
+	}
+	if options.MMap {
+		station.mmaps = make(map[string]*mappedFile)
+	}
+	pool.onCountChange = func(listeners int) {
+		station.events.Publish(Event{Type: "listeners", Station: name, Mount: mount, Listeners: listeners})
+	}
+	return station
+}
+
+// currentTrack returns the path of the track being broadcast, or "" for a
+// live station
+func (s *Station) currentTrack() string {
+	if s.playlist == nil {
+		return ""
+	}
+	if current := s.nowPlaying.Load(); current != nil {
+		return current.path // May be a queued track rather than the playlist's
+	}
+	return s.playlist.CurrentTrack()
+}
+
+// nextTrack returns the track to play next: the head of the queue if
+// anything is queued, otherwise the playlist's current track
+func (s *Station) nextTrack() (track string, queued bool) {
+	if track, ok := s.queue.Pop(); ok {
+		return track, true
+	}
+	return s.playlist.CurrentTrack(), false
+}
+
+// advance moves on after a track. Queued tracks are played in between
+// playlist tracks, so they leave the playlist where it was. It reports
+// whether the station should stop playing tracks, which only happens
+// without looping once the whole playlist has been played, or when
+// draining.
+func (s *Station) advance(queued bool) (done bool) {
+	if s.draining.Load() {
+		return true
+	}
+	if queued {
+		return false
+	}
+	if s.followSchedule() {
+		s.unmapRemoved()
+		return false
+	}
+	// The station's own source is only reloaded or rescanned while it plays,
+	// a reload made during a program waits for it to end
+	onProgram := s.program.Load() != nil
+	if tracks := s.pending.Load(); tracks != nil && !onProgram {
+		tracks = s.pending.Swap(nil) // The latest, if another reload came in since
+		slog.Info("playing the reloaded playlist", "station", s.Name, "tracks", len(*tracks))
+		s.playlist.Replace(*tracks)
+		s.unmapRemoved()
+		return false
+	}
+	wrapped := s.playlist.Advance()
+	if wrapped && s.directory && !onProgram {
+		s.rescan()
+	}
+	if wrapped {
+		s.unmapRemoved() // Queued tracks and ones rescanned away
+	}
+	return wrapped && s.onEOF != EOFLOOP
+}
+
+// loadSource loads the station's source afresh
+func (s *Station) loadSource() (*Playlist, error) {
+	if s.directory {
+		return LoadDirectory(s.source, s.mediaRoot, s.recursive)
+	}
+	return loadSource(s.source, s.mediaRoot)
+}
+
+// rescan picks up files added to or removed from a directory source since
+// it was last read. The old list is kept if the directory can't be read.
+func (s *Station) rescan() {
+	playlist, err := s.loadSource()
+	if err != nil {
+		slog.Warn("could not rescan directory, replaying the previous tracks", "station", s.Name, "dir", s.source, "error", err)
+		return
+	}
+	if slices.Equal(playlist.Tracks(), s.playlist.Tracks()) {
+		return
+	}
+	slog.Info("directory changed, playing its new tracks", "station", s.Name, "dir", s.source, "tracks", playlist.Len())
+	s.playlist.Replace(playlist.Tracks())
+}
+
+// ReloadPlaylist reads the station's source again and has stream switch to
+// it, from the top, once the current track ends, or once the program on
+// ends if the schedule has one on. The new list is checked
+// first and, if it has nothing playable or is in another format than the
+// stream, left out so the old one carries on. It returns the number of
+// tracks loaded.
+func (s *Station) ReloadPlaylist(ctx context.Context) (int, error) {
+	var playlist *Playlist
+	err := retryOpen(ctx, s.openAttempts, s.source, func() error {
+		var err error
+		playlist, err = s.loadSource()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := checkTracks(playlist); err != nil {
+		return 0, err
+	}
+	contentType, err := streamFormat(playlist, s.overrideType)
+	if err != nil {
+		return 0, err
+	}
+	if contentType != s.contentType {
+		return 0, fmt.Errorf("the playlist is %s but the stream is %s, listeners can't switch formats", contentType, s.contentType)
+	}
+
+	tracks := playlist.Tracks()
+	s.pending.Store(&tracks)
+	if program := s.program.Load(); program != nil {
+		slog.Info("playlist reloaded, switching once the program ends", "station", s.Name, "source", s.source, "tracks", len(tracks), "program", program.Name)
+	} else {
+		slog.Info("playlist reloaded, switching after the current track", "station", s.Name, "source", s.source, "tracks", len(tracks))
+	}
+	return len(tracks), nil
+}
+
+// title is what listeners are shown as playing, "Artist - Title" when the
+// track is tagged
+func (s *Station) title() string {
+	if s.playlist == nil {
+		return s.Name
+	}
+	if s.offline.Load() {
+		return s.Name + " (offline)"
+	}
+	if s.ended.Load() {
+		return s.Name
+	}
+	if current := s.nowPlaying.Load(); current != nil {
+		if current.Artist != "" {
+			return current.Artist + " - " + current.Title
+		}
+		return current.Title
+	}
+	return trackTitle(s.playlist.CurrentTrack())
+}
+
+// stream broadcasts the station's playlist, pacing each track to its bitrate
+// unless an override bitrate was given. The playlist loops forever unless
+// the station is to stop at the end of it: with EOFEXIT stream returns after
+// one pass, with EOFHOLD it carries on broadcasting the offline audio until
+// ctx is cancelled.
+func (s *Station) stream(ctx context.Context) {
+	connectionPool := s.pool
+
+	s.streaming.Store(true)
+	defer s.streaming.Store(false)
+	defer close(s.stopped)
+
+	if s.live != nil {
+		s.streamLive(ctx)
+		return
+	}
+	if s.relayURL != "" {
+		s.streamRelay(ctx)
+		return
+	}
+	if s.memory != nil {
+		s.streamMemory(ctx)
+		return
+	}
+
+	buffer := connectionPool.getBuffer()
+	defer connectionPool.putBuffer(buffer)
+
+	ticker := time.NewTicker(s.delay)
+	defer ticker.Stop()
+
+	if s.offline.Load() && !s.streamOffline(ctx, buffer, ticker) {
+		return
+	}
+
+	s.followSchedule()
+	for {
+		if s.playTrack(ctx, buffer, ticker) {
+			break
+		}
+	}
+	s.refuseSkip()
+	if ctx.Err() == nil {
+		s.flushFadeTail(ctx, buffer, ticker)
+		s.flushADTSCarry(ctx, ticker)
+	}
+	if s.onEOF == EOFHOLD && ctx.Err() == nil && !s.draining.Load() {
+		s.streamHold(ctx, buffer, ticker)
+	}
+}
+
+// playTrack opens and broadcasts the next track. It reports whether stream
+// should stop, because ctx was cancelled or a playlist that doesn't loop has
+// been played. A panic while streaming, e.g. a parser choking on bad data,
+// only costs the track it happened on and not the whole server.
+func (s *Station) playTrack(ctx context.Context, buffer []byte, ticker *time.Ticker) (done bool) {
+	track, queued := s.nextTrack()
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("panic while streaming, skipping track", "station", s.Name, "track", track, "panic", r, "stack", string(debug.Stack()))
+			if s.advance(queued) {
+				slog.Info("playlist finished", "station", s.Name)
+				done = true
+				return
+			}
+			// Don't spin if the next track panics straight away too
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				done = true
+			}
+		}
+	}()
+
+	file, tag, err := s.openTrack(ctx, track)
+	if err != nil {
+		slog.Error("skipping track", "station", s.Name, "track", track, "error", err)
+		if s.advance(queued) {
+			slog.Info("playlist finished", "station", s.Name)
+			return true
+		}
+		// Don't spin if every track is unavailable
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return true
+		}
+		return false
+	}
+	defer func() { file.Close() }() // file changes on reload
+
+	slog.Info("track changed", "station", s.Name, "track", track)
+	s.setNowPlaying(track, tag)
+	if s.skipped != nil {
+		s.skipped <- s.title()
+		s.skipped = nil
+	}
+	trackChangesCounter.WithLabelValues(s.Mount).Inc()
+	interval, factor := s.trackInterval(track)
+	s.realTime.Store(math.Float64bits(factor))
+	ticker.Reset(interval)
+	source := s.trackSource(file, tag)
+	pace := s.trackPacer(interval, factor)
+	err = s.streamTrack(ctx, source, buffer, ticker, interval, pace)
+	for err == errReload {
+		// Pick up whatever is on disk now, but keep playing the file we
+		// already have open if the new one can't be opened
+		if reloaded, tag, openErr := s.openTrack(ctx, track); openErr != nil {
+			slog.Error("could not reload track, keeping the old content", "station", s.Name, "track", track, "error", openErr)
+		} else {
+			slog.Info("track reloaded", "station", s.Name, "track", track)
+			s.finishFrame(source, buffer)
+			file.Close()
+			file = reloaded
+			s.setNowPlaying(track, tag)
+			interval, factor = s.trackInterval(track)
+			s.realTime.Store(math.Float64bits(factor))
+			ticker.Reset(interval)
+			source = s.trackSource(file, tag)
+			pace = s.trackPacer(interval, factor)
+		}
+		err = s.streamTrack(ctx, source, buffer, ticker, interval, pace)
+	}
+	if ctx.Err() != nil {
+		return true
+	}
+	if err == errSkip {
+		s.finishFrame(source, buffer)
+		slog.Info("track skipped", "station", s.Name, "track", track)
+	} else if err == errEmptyTrack {
+		slog.Warn("track has no audio", "station", s.Name, "track", track)
+	} else if err != nil {
+		slog.Error("could not read track", "station", s.Name, "track", track, "error", err)
+	}
+	s.finishTrack()
+	if s.advance(queued) {
+		slog.Info("playlist finished", "station", s.Name)
+		return true
+	}
+
+	if err == errEmptyTrack {
+		// Nothing was broadcast so nothing waited on the ticker, don't
+		// spin if the playlist is all empty files
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return true
+		}
+	}
+	return false
+}
+
+// refuseSkip answers a skip picked up just before the playlist ended, the
+// station was drained or ctx was cancelled, that no next track is coming
+// for, rather than leaving it to time out
+func (s *Station) refuseSkip() {
+	if s.skipped != nil {
+		close(s.skipped)
+		s.skipped = nil
+	}
+}
+
+// Reload asks the stream goroutine to re-open the current track once the
+// buffer in flight has been broadcast. Listeners stay connected throughout.
+func (s *Station) Reload() {
+	select {
+	case s.reload <- struct{}{}:
+	default: // A reload is already pending
+	}
+}
+
+// Pause holds the broadcast where it is until Resume is called
+func (s *Station) Pause() {
+	if !s.paused.Swap(true) {
+		slog.Info("station paused", "station", s.Name)
+	}
+}
+
+// Resume carries on broadcasting from where Pause stopped
+func (s *Station) Resume() {
+	if !s.paused.Swap(false) {
+		return
+	}
+	slog.Info("station resumed", "station", s.Name)
+	select {
+	case s.resumed <- struct{}{}:
+	default: // stream hasn't picked up the previous wake-up yet, one is enough
+	}
+}
+
+// openTrack opens a track after checking, once more, that it is inside the
+// media root. Tracks are vetted as they are added, but the file system can
+// change underneath, e.g. a file swapped for a symlink. Opening is retried
+// while it fails transiently.
+func (s *Station) openTrack(ctx context.Context, track string) (*os.File, ID3Tag, error) {
+	path, err := resolveLocalPath(s.mediaRoot, track)
+	if err != nil {
+		return nil, ID3Tag{}, err
+	}
+	var file *os.File
+	var tag ID3Tag
+	err = retryOpen(ctx, s.openAttempts, path, func() error {
+		file, tag, err = openTrack(path)
+		return err
+	})
+	return file, tag, err
+}
+
+// trackSource is what gets broadcast for an opened track: the file itself,
+// or a normalized and/or crossfaded view of it, followed frame by frame if
+// cuts are aligned. OGG tracks are cut into whole pages and AAC tracks into
+// whole frames instead.
+func (s *Station) trackSource(file *os.File, tag ID3Tag) io.Reader {
+	var source io.Reader = file
+	wavStream := s.wavStream && s.contentType == "audio/wav"
+	if wavStream {
+		s.storeWAVHeader(file)
+	}
+	if s.mmaps != nil && !s.normalize && s.crossfade == 0 {
+		source = s.mappedTrack(file) // Normalizing and crossfading seek around the file itself
+	}
+	if s.normalize {
+		source = s.normalizeSource(file, tag)
+	}
+	if wavStream && s.crossfade == 0 {
+		source = stripWAVHeader(source)
+	}
+	if s.crossfade > 0 {
+		source = s.crossfadeSource(source) // Normalized first, so the fades are mixed at the new level
+	}
+	if s.contentType == "audio/ogg" {
+		// Pages are whole already, so there's no frame to finish
+		return newOggPager(source, func(headers []byte) {
+			headers = append([]byte{}, headers...)
+			s.oggHeaders.Store(&headers)
+		})
+	}
+	if s.contentType == "audio/aac" {
+		// Whole frames only, so there's no frame to finish either
+		return newADTSFramer(source, &s.adtsCarry)
+	}
+	if s.alignFrames {
+		source = &frameReader{r: source}
+	}
+	return source
+}
+
+const (
+	LAGWARNING      = 500 * time.Millisecond // lag worth logging, listeners' buffers start running dry
+	LAGWARNINTERVAL = time.Minute            // between lag warnings, so an overloaded server isn't also flooding its log
+)
+
+// recordLag publishes how late a tick was. Ticks never come early, so
+// anything above zero is time the stream fell behind, e.g. because the
+// machine is overloaded or a broadcast took longer than a tick.
+func (s *Station) recordLag(lag time.Duration) {
+	lag = max(lag, 0)
+	s.lag.Store(int64(lag))
+	broadcastLagGauge.WithLabelValues(s.Mount).Set(lag.Seconds())
+	if lag >= LAGWARNING && time.Since(s.lagWarned) >= LAGWARNINTERVAL {
+		slog.Warn("broadcast is falling behind real time", "station", s.Name, "lag", lag)
+		s.lagWarned = time.Now()
+	}
+}
+
+var (
+	// errReload is returned by streamTrack when a reload was requested
+	errReload = errors.New("reload requested")
+	// errEmptyTrack is returned by streamTrack when a track had no audio at all
+	errEmptyTrack = errors.New("track is empty")
+	// errSkip is returned by streamTrack when the track was skipped
+	errSkip = errors.New("track skipped")
+)
+
+// trackPacer returns the pacer for a track paced at interval, or nil to keep
+// to interval, without -adaptive-pacing or when the bitrate is unknown
+func (s *Station) trackPacer(interval time.Duration, factor float64) *pacer {
+	if !s.adaptivePacing || (factor == 0 && s.overrideBitrate == 0) {
+		return nil
+	}
+	return newPacer(s.bufferSize, interval)
+}
+
+// streamTrack broadcasts source until EOF, reading only bufferSize bytes at
+// a time. Chunks are interval apart, or as far as pace says.
+func (s *Station) streamTrack(ctx context.Context, source io.Reader, buffer []byte, ticker *time.Ticker, interval time.Duration, pace *pacer) error {
+	empty := true
+	var lastTick time.Time
+	idle := newEmptyReads()
+	for {
+		// Paused stations hold their place in the track and send nothing,
+		// listeners stay connected until it resumes
+		if s.paused.Load() {
+			lastTick = time.Time{} // The wait isn't lag
+			pace.reset()
+		}
+		for s.paused.Load() {
+			select {
+			case <-s.resumed:
+			case s.skipped = <-s.skip:
+				return errSkip
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var chunk []byte
+		var err error
+		if c, ok := source.(chunker); ok {
+			chunk, err = c.nextChunk(len(buffer))
+		} else {
+			var n int
+			n, err = source.Read(buffer)
+			chunk = buffer[:n] // Only the portion that was read
+		}
+		if err == nil {
+			if err := idle.record(ctx, len(chunk)); err != nil {
+				return err
+			}
+		}
+		if len(chunk) > 0 {
+			empty = false
+
+			s.pool.Broadcast(chunk)
+			s.lastBroadcast.Store(time.Now().UnixNano())
+			if pace != nil {
+				interval = pace.next(len(chunk))
+				ticker.Reset(interval)
+			}
+
+			// Wait for the ticker to tick before continuing
+			select {
+			case <-ticker.C:
+				now := time.Now()
+				if !lastTick.IsZero() {
+					s.recordLag(now.Sub(lastTick) - interval)
+				}
+				lastTick = now
+			case s.skipped = <-s.skip:
+				return errSkip
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case <-s.reload:
+			return errReload
+		case s.skipped = <-s.skip:
+			return errSkip
+		default:
+		}
+
+		if err == io.EOF {
+			if empty {
+				return errEmptyTrack
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// catchUp is what a new connection is sent before the broadcast. OGG can't
+// be decoded without the headers at the start of the track, which a
+// listener joining part way through has missed, and raw PCM needs the
+// streaming WAV header. After them comes the prebuffer, trimmed to start on
+// a frame.
+func (s *Station) catchUp(connection *Connection) []Chunk {
+	var chunks []Chunk
+	if headers := s.oggHeaders.Load(); headers != nil {
+		chunks = append(chunks, Chunk{Data: *headers})
+	}
+	if header := s.wavHeader.Load(); header != nil {
+		chunks = append(chunks, Chunk{Data: *header})
+	}
+	if prebuffer := connection.prebuffer; len(prebuffer) > 0 {
+		// A resumed listener carries on from the very byte it left off at
+		if connection.resumeAfter == 0 && (s.contentType == "audio/aac" || s.contentType == "audio/mpeg") {
+			prebuffer[0].Data = prebuffer[0].Data[max(frameStart(prebuffer[0].Data), 0):]
+		}
+		chunks = append(chunks, prebuffer...)
+		connection.prebuffer = nil
+	}
+	return chunks
+}
+
+// identityEncoding marks a response as sent as it is, whatever the client
+// accepts and whatever -header says. Audio is compressed already, and a
+// proxy that gzips it holds chunks back until it has enough to compress, so
+// listeners hear nothing. no-transform tells proxies to leave it alone.
+func identityEncoding(w http.ResponseWriter) {
+	w.Header().Set("Content-Encoding", "identity")
+	cacheControl := w.Header().Get("Cache-Control")
+	if !strings.Contains(cacheControl, "no-transform") {
+		w.Header().Set("Cache-Control", strings.TrimPrefix(cacheControl+", no-transform", ", "))
+	}
+}
+
+// flushable reports whether http.NewResponseController(w).Flush can work,
+// looking through wrappers such as the access log's the same way it does
+func flushable(w http.ResponseWriter) bool {
+	for {
+		switch writer := w.(type) {
+		case http.Flusher, interface{ FlushError() error }:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// stationQueryHandler serves /stream?station=jazz as if it were /jazz, for
+// clients that can't be given a mount, and /stream itself without one. Only
+// names and mounts made of letters, digits, dashes, underscores and dots are
+// looked up.
+func stationQueryHandler(stations []*Station, mounts map[*Station]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("station")
+		if key == "" {
+			key = "/stream"
+		} else if !validStationKey(key) {
+			http.Error(w, "Invalid station name", http.StatusBadRequest)
+			return
+		}
+		station := findStation(stations, key)
+		if station == nil {
+			http.Error(w, "Unknown station", http.StatusNotFound)
+			return
+		}
+		mounts[station](w, r)
+	}
+}
+
+// validStationKey reports whether key could be a station's name or mount
+func validStationKey(key string) bool {
+	key = strings.TrimPrefix(key, "/")
+	if key == "" || len(key) > 64 || key == "." || key == ".." {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func streamHandler(station *Station) http.HandlerFunc {
+	connPool := station.pool
+	return func(w http.ResponseWriter, r *http.Request) {
+		controller := http.NewResponseController(w)
+
+		// Without flushing, audio would sit in the response buffer instead
+		// of reaching the player, so fail loudly rather than send nothing
+		if !flushable(w) {
+			slog.Error("response can't be flushed, not streaming", "station", station.Name, "remote_addr", r.RemoteAddr, "proto", r.Proto, "writer", fmt.Sprintf("%T", w))
+			http.Error(w, "Streaming isn't supported over this connection", http.StatusInternalServerError)
+			return
+		}
+
+		ip := remoteIP(r.RemoteAddr)
+		if !station.ipLimiter.Acquire(ip) {
+			slog.Warn("client turned away", "station", station.Name, "remote_addr", r.RemoteAddr, "error", "too many streams from this address")
+			w.Header().Set("Retry-After", strconv.Itoa(RETRYAFTER))
+			http.Error(w, "Too many streams from your address", http.StatusTooManyRequests)
+			return
+		}
+		defer station.ipLimiter.Release(ip)
+
+		latency, err := requestedLatency(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		clientBuffer, prebuffer := station.latencyDepths(latency)
+		connection := &Connection{
+			bufferChannel:   make(chan Chunk, clientBuffer),
+			remoteAddr:      r.RemoteAddr,
+			userAgent:       r.UserAgent(),
+			connected:       time.Now(),
+			latency:         latency,
+			prebufferChunks: prebuffer,
+		}
+		var resumeToken string
+		if station.resume != nil {
+			resumeToken = r.URL.Query().Get("resume")
+			if seq, ok := station.resume.take(resumeToken); ok {
+				connection.resumeAfter = seq
+			} else {
+				resumeToken = station.resume.issue()
+			}
+		}
+		if err := connPool.AddConnection(connection); err != nil {
+			slog.Warn("client turned away", "station", station.Name, "remote_addr", r.RemoteAddr, "error", err)
+			w.Header().Set("Retry-After", strconv.Itoa(RETRYAFTER))
+			http.Error(w, fmt.Sprintf("%v, %d listeners connected", err, connPool.Count()), http.StatusServiceUnavailable)
+			return
+		}
+		defer connPool.DeleteConnection(connection) // Ensure connection is removed after handling
+		lastSeq := connection.resumeAfter
+		if resumeToken != "" {
+			w.Header().Set("X-Resume-Token", resumeToken)
+			defer func() { station.resume.save(resumeToken, lastSeq) }()
+		}
+		if connection.resumeAfter > 0 {
+			missed := uint64(0)
+			if prebuffer := connection.prebuffer; len(prebuffer) > 0 {
+				missed = prebuffer[0].Seq - connection.resumeAfter - 1
+			}
+			slog.Info("client resumed", "station", station.Name, "remote_addr", r.RemoteAddr, "catch_up_chunks", len(connection.prebuffer), "missed_chunks", missed)
+		}
+
+		for name, values := range station.headers {
+			w.Header()[name] = slices.Clone(values) // Shared by every request, so never appended to
+		}
+		w.Header().Add("Content-Type", station.responseContentType())
+		identityEncoding(w)
+		// HTTP/2 has no Connection header, streams share one connection
+		if r.ProtoMajor == 1 {
+			if station.noKeepalive {
+				w.Header().Set("Connection", "close")
+			} else {
+				w.Header().Add("Connection", "keep-alive")
+			}
+		}
+
+		wantsMetadata := r.Header.Get("Icy-MetaData") == "1"
+		legacy := legacyICYClient(r, station.icyAgents)
+
+		// Framed clients are custom ones that parse the stream themselves,
+		// so none of the player compatibility applies
+		framed := station.framed && r.URL.Query().Get("framed") == "1"
+		if framed {
+			wantsMetadata, legacy = false, false
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("X-Audio-Content-Type", station.responseContentType())
+		}
+
+		if wantsMetadata || legacy {
+			if wantsMetadata {
+				w.Header().Add("icy-metaint", strconv.Itoa(ICYMETAINT))
+			}
+			w.Header().Add("icy-name", station.Name)
+			if station.genre != "" {
+				w.Header().Add("icy-genre", station.genre)
+			}
+			if station.url != "" {
+				w.Header().Add("icy-url", station.url)
+			}
+		}
+		// Left out rather than guessed when the bitrate is unknown
+		if station.bitrate > 0 {
+			w.Header().Add("icy-br", strconv.Itoa((station.bitrate+500)/1000))
+		}
+
+		var out io.Writer = w
+		flush := controller.Flush // Also reports errors, unlike http.Flusher, and works over HTTP/2
+		setWriteDeadline := controller.SetWriteDeadline
+		ctx := r.Context()
+		if station.maxDuration > 0 {
+			// Hangs up with a clean end of stream, the player can reconnect
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, station.maxDuration)
+			defer cancel()
+		}
+
+		// Old hardware players want the status line Shoutcast sends, which
+		// net/http can't write, so they get the raw connection instead
+		if legacy {
+			conn, rw, err := controller.Hijack()
+			if err != nil {
+				slog.Warn("could not take over connection for ICY client, answering over HTTP", "remote_addr", r.RemoteAddr, "error", err)
+			} else {
+				defer conn.Close()
+				if err := writeICYResponse(rw.Writer, w.Header()); err != nil {
+					slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "error", err)
+					return
+				}
+				out = rw
+				flush = rw.Flush
+				setWriteDeadline = conn.SetWriteDeadline
+
+				// net/http stops watching a hijacked connection, so the
+				// request context would never see the client hang up
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				defer cancel()
+				go func() {
+					io.Copy(io.Discard, rw.Reader) // Players send nothing more, this returns once the connection is gone
+					cancel()
+				}()
+			}
+		}
+
+		// Short writes are finished before flushing, so chunks arrive whole
+		out = fullWriter{out}
+		if wantsMetadata {
+			out = newIcyWriter(out, ICYMETAINT, station.title)
+		}
+
+		slog.Info("client connected", "station", station.Name, "remote_addr", r.RemoteAddr, "user_agent", r.UserAgent(), "latency", cmp.Or(latency, "default"))
+
+		write := func(chunk Chunk) (int, error) {
+			if framed {
+				return writeFramed(out, chunk)
+			}
+			return out.Write(chunk.Data)
+		}
+
+		catchUp := station.catchUp(connection)
+		for _, chunk := range catchUp {
+			n, err := write(chunk)
+			connection.bytesSent.Add(int64(n))
+			if err != nil {
+				slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "error", err)
+				return
+			}
+			lastSeq = max(lastSeq, chunk.Seq)
+		}
+		if len(catchUp) > 0 {
+			if err := flush(); err != nil {
+				slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "error", err)
+				return
+			}
+		}
+
+		for {
+			var chunk Chunk
+			var ok bool
+			select {
+			case chunk, ok = <-connection.bufferChannel:
+			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "bytes", connection.bytesSent.Load(), "duration", time.Since(connection.connected), "reason", "max duration reached")
+					return
+				}
+				// The client hung up. Noticed straight away even while
+				// nothing is being broadcast, e.g. when paused.
+				slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "bytes", connection.bytesSent.Load(), "duration", time.Since(connection.connected), "error", ctx.Err())
+				return
+			}
+			if !ok { // Evicted for falling behind, kicked, or the server is shutting down
+				slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "bytes", connection.bytesSent.Load(), "duration", time.Since(connection.connected))
+				return
+			}
+			// A client that stopped reading but kept the socket open would
+			// otherwise block this write, and its pool slot, forever
+			if station.writeTimeout > 0 {
+				err := setWriteDeadline(time.Now().Add(station.writeTimeout))
+				if err != nil && !errors.Is(err, http.ErrNotSupported) {
+					slog.Warn("could not set write deadline", "remote_addr", r.RemoteAddr, "error", err)
+				}
+			}
+
+			n, err := write(chunk)
+			connection.bytesSent.Add(int64(n))
+			connPool.putBuffer(chunk.Data) // The chunk is ours alone, hand it back once written
+			if err == nil {
+				lastSeq = chunk.Seq
+				err = flush()
+			}
+			if err != nil {
+				slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "bytes", connection.bytesSent.Load(), "duration", time.Since(connection.connected), "error", err)
+				return
+			}
+		}
+	}
+}
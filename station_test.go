@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMain keeps the servers' logging out of the test output
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testOptions are the settings a station needs to stream in a test
+func testOptions() StationOptions {
+	return StationOptions{BufferSize: 1024, Delay: time.Millisecond, ClientBuffer: 4, HistorySize: 10, OpenAttempts: 1}
+}
+
+// writeTestFile writes data to name in a temporary directory, returning its
+// path
+func writeTestFile(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// silenceFile generates duration of silence in a temporary file called
+// name, whose extension picks the format
+func silenceFile(t testing.TB, name string, duration time.Duration) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := writeSilence(path, duration); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runStation streams station until the test ends
+func runStation(t testing.TB, station *Station) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		station.stream(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-streamed
+		station.pool.Close()
+	})
+}
+
+// serveOnce serves handler from a test server, returning a channel closed
+// once it has handled a request
+func serveOnce(t testing.TB, handler http.HandlerFunc) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	handled := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer once.Do(func() { close(handled) })
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, handled
+}
+
+// A listener that stops reading without hanging up blocks the write to it,
+// which has to give up after -write-timeout and free its place
+func TestWriteTimeout(t *testing.T) {
+	options := testOptions()
+	options.BufferSize = 64 * 1024
+	options.Bitrate = options.BufferSize * 8 * 1000 // A chunk every millisecond fills the socket fast
+	options.WriteTimeout = 100 * time.Millisecond
+	station := NewMemoryStation("test", "/stream", bytes.Repeat(silentMPEGFrame, 1000), options)
+	runStation(t, station)
+	server, handled := serveOnce(t, streamHandler(station))
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	fmt.Fprintf(conn, "GET /stream HTTP/1.1\r\nHost: test\r\n\r\n") // Then never reads
+
+	select {
+	case <-handled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handler still blocked writing to a listener that stopped reading")
+	}
+	if count := station.pool.Count(); count != 0 {
+		t.Errorf("%d listeners still in the pool", count)
+	}
+}
+
+// Shutting down stops the broadcast and closes every pool, which has to end
+// the streams open cleanly rather than leave their handlers hanging
+func TestShutdownEndsStreams(t *testing.T) {
+	options := testOptions()
+	options.Bitrate = 800_000 // About a chunk every 10ms
+	station, err := NewStation("test", "/stream", silenceFile(t, "silence.mp3", 5*time.Second), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		station.stream(ctx)
+	}()
+	handled := make(chan struct{})
+	handler := streamHandler(station)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handled)
+		handler(w, r)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadFull(resp.Body, make([]byte, 2*options.BufferSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-streamed
+	station.pool.Close()
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still running after the pool closed")
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("stream didn't end cleanly: %v", err)
+	}
+}
+
+// A source shorter than one buffer is broadcast whole every tick, on
+// repeat, rather than ending the stream after the first pass
+func TestShortSourceLoops(t *testing.T) {
+	jingle := []byte("0123456789")
+	station, err := NewStation("test", "/stream", writeTestFile(t, "jingle.mp3", jingle), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newTestConnection(16)
+	if err := station.pool.AddConnection(listener); err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+
+	for i := 0; i < 5; i++ {
+		select {
+		case chunk := <-listener.bufferChannel:
+			if !bytes.Equal(chunk.Data, jingle) {
+				t.Fatalf("chunk %d = %q, want %q", i, chunk.Data, jingle)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream stopped after %d passes", i)
+		}
+	}
+}
+
+// Once the playlist has been played, -on-eof loop starts it again, hold
+// keeps broadcasting the offline audio and exit stops the stream
+func TestOnEOF(t *testing.T) {
+	track := append(silentMPEGFrame[:4:4], "track"...)
+	tests := []struct {
+		onEOF  string
+		chunks []string // the first few broadcast
+		ends   bool
+	}{
+		{EOFLOOP, []string{"track", "track", "track"}, false},
+		{EOFHOLD, []string{"track", "offline", "offline"}, false},
+		{EOFEXIT, []string{"track"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.onEOF, func(t *testing.T) {
+			options := testOptions()
+			options.OnEOF = test.onEOF
+			options.OfflineAudio = []byte("offline")
+			station, err := NewStation("test", "/stream", writeTestFile(t, "track.mp3", track), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := newTestConnection(16)
+			if err := station.pool.AddConnection(listener); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			streamed := make(chan struct{})
+			go func() {
+				defer close(streamed)
+				station.stream(ctx)
+			}()
+
+			for i, want := range test.chunks {
+				select {
+				case chunk := <-listener.bufferChannel:
+					if got := string(bytes.TrimPrefix(chunk.Data, silentMPEGFrame[:4])); got != want {
+						t.Errorf("chunk %d = %q, want %q", i, got, want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("chunk %d never broadcast", i)
+				}
+			}
+			select {
+			case <-streamed:
+				if !test.ends {
+					t.Error("stream ended")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if test.ends {
+					t.Error("stream still running after the playlist")
+				}
+			}
+			if held := station.ended.Load(); held != (test.onEOF == EOFHOLD) {
+				t.Errorf("ended = %v", held)
+			}
+			cancel()
+			<-streamed
+		})
+	}
+}
+
+func TestEmptySourceRejected(t *testing.T) {
+	if _, err := NewStation("test", "/stream", writeTestFile(t, "empty.mp3", nil), testOptions()); err == nil {
+		t.Error("NewStation() accepted an empty file")
+	}
+}
+
+// A listener whose channel is closed under it, e.g. by /admin/kick, is
+// disconnected rather than sent empty chunks
+func TestHandlerEndsWhenChannelCloses(t *testing.T) {
+	station := newStation("test", "/stream", testOptions()) // Never broadcasts
+	server, handled := serveOnce(t, streamHandler(station))
+	go http.Get(server.URL) // The response head only comes with the first chunk
+	waitFor(t, "the listener to join", func() bool { return station.pool.Count() == 1 })
+
+	station.pool.Connections()[0].close()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handler still running with its channel closed")
+	}
+	if count := station.pool.Count(); count != 0 {
+		t.Errorf("%d listeners still in the pool", count)
+	}
+}
+
+// A listener that hangs up is noticed straight away, not at the next write,
+// which with nothing broadcast would never come
+func TestHandlerEndsWithRequest(t *testing.T) {
+	station := newStation("test", "/stream", testOptions()) // Never broadcasts
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/stream", nil).WithContext(ctx)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		streamHandler(station)(httptest.NewRecorder(), r)
+	}()
+	waitFor(t, "the listener to join", func() bool { return station.pool.Count() == 1 })
+
+	cancel()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handler still running after the request was cancelled")
+	}
+	if count := station.pool.Count(); count != 0 {
+		t.Errorf("%d listeners still in the pool", count)
+	}
+}
+
+// With -max-duration the stream ends cleanly once it's up, as if the
+// source had, and the listener leaves the pool
+func TestMaxDuration(t *testing.T) {
+	const limit = 200 * time.Millisecond
+	options := testOptions()
+	options.MaxDuration = limit
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, options)
+	runStation(t, station)
+	server, handled := serveOnce(t, streamHandler(station))
+
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Errorf("stream ended with %v, want a clean end", err)
+	}
+	if elapsed := time.Since(start); elapsed < limit || elapsed > limit+time.Second {
+		t.Errorf("stream lasted %v, want %v", elapsed, limit)
+	}
+	<-handled
+	if count := station.pool.Count(); count != 0 {
+		t.Errorf("%d listeners still in the pool", count)
+	}
+}
+
+func TestIdentityEncoding(t *testing.T) {
+	for cacheControl, want := range map[string]string{
+		"":                   "no-transform",
+		"no-cache, no-store": "no-cache, no-store, no-transform",
+		"no-transform":       "no-transform",
+	} {
+		w := httptest.NewRecorder()
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		identityEncoding(w)
+		if got := w.Header().Get("Cache-Control"); got != want {
+			t.Errorf("Cache-Control %q became %q, want %q", cacheControl, got, want)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != "identity" {
+			t.Errorf("Content-Encoding = %q, want identity", got)
+		}
+	}
+}
+
+// A client that accepts gzip still gets the audio as it is
+func TestStreamNotCompressed(t *testing.T) {
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, testOptions())
+	runStation(t, station)
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	r, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept-Encoding", "gzip") // Set by hand, so the transport doesn't decompress
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "identity" {
+		t.Errorf("Content-Encoding = %q, want identity", got)
+	}
+	start := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, start); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(start, silentMPEGFrame[:4]) {
+		t.Errorf("stream starts %x, want the MP3 as it is", start)
+	}
+}
+
+// unflushable hides every method but ResponseWriter's, like a middleware
+// wrapper that forgot to pass Flush on
+type unflushable struct{ http.ResponseWriter }
+
+// unwrapping is a wrapper that does pass Flush on, through Unwrap
+type unwrapping struct{ http.ResponseWriter }
+
+func (w unwrapping) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func TestUnflushableResponse(t *testing.T) {
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, testOptions())
+	w := httptest.NewRecorder()
+	streamHandler(station)(unflushable{w}, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if w.Code != http.StatusInternalServerError || !bytes.Contains(w.Body.Bytes(), []byte("Streaming isn't supported")) {
+		t.Errorf("status = %d: %q, want %d explaining why", w.Code, w.Body, http.StatusInternalServerError)
+	}
+	if count := station.pool.Count(); count != 0 {
+		t.Errorf("%d listeners added for a response that can't stream", count)
+	}
+}
+
+func TestFlushable(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	for name, test := range map[string]struct {
+		w    http.ResponseWriter
+		want bool
+	}{
+		"flusher":          {recorder, true},
+		"hidden":           {unflushable{recorder}, false},
+		"unwrapped":        {unwrapping{recorder}, true},
+		"unwrapped hidden": {unwrapping{unflushable{recorder}}, false},
+	} {
+		if got := flushable(test.w); got != test.want {
+			t.Errorf("flushable(%s) = %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+// Chunks arrive as they're broadcast over HTTP/2 as well as HTTP/1.1, not
+// held back until some buffer fills
+func TestStreamPacing(t *testing.T) {
+	const chunks = 8
+	for _, http2 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("http2=%v", http2), func(t *testing.T) {
+			options := testOptions()
+			options.Bitrate = 128000 // A 1KiB buffer every 64ms
+			station, err := NewStation("test", "/stream", silenceFile(t, "playing.mp3", 30*time.Second), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runStation(t, station)
+			server := httptest.NewUnstartedServer(streamHandler(station))
+			server.EnableHTTP2 = http2
+			server.StartTLS()
+			defer server.Close()
+
+			resp, err := server.Client().Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if want := map[bool]int{false: 1, true: 2}[http2]; resp.ProtoMajor != want {
+				t.Fatalf("served over %s", resp.Proto)
+			}
+
+			// The first chunk is timed from, as the station may have been
+			// part way through a buffer when the listener joined
+			buffer := make([]byte, options.BufferSize)
+			if _, err := io.ReadFull(resp.Body, buffer); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			for i := 0; i < chunks; i++ {
+				if _, err := io.ReadFull(resp.Body, buffer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := time.Duration(chunks*options.BufferSize*8) * time.Second / time.Duration(options.Bitrate)
+			if elapsed := time.Since(start); elapsed < want/2 || elapsed > 2*want {
+				t.Errorf("%d chunks took %v, want about %v", chunks, elapsed, want)
+			}
+		})
+	}
+}
+
+func TestValidStationKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"jazz":                  true,
+		"/jazz":                 true,
+		"late-night_2.aac":      true,
+		"":                      false,
+		"/":                     false,
+		"..":                    false,
+		"../etc/passwd":         false,
+		"jazz rock":             false,
+		"jazz%00":               false,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := validStationKey(key); got != want {
+			t.Errorf("validStationKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+// /stream?station= serves the station by name or mount, and /stream itself
+// without one, beside the mounts
+func TestStationQueryHandler(t *testing.T) {
+	stations := []*Station{newStation("main", "/stream", testOptions()), newStation("jazz", "/jazz", testOptions())}
+	mounts := make(map[*Station]http.HandlerFunc)
+	for _, station := range stations {
+		mounts[station] = func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, station.Name) }
+	}
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, "main"},
+		{"?station=jazz", http.StatusOK, "jazz"},
+		{"?station=/jazz", http.StatusOK, "jazz"},
+		{"?station=main", http.StatusOK, "main"},
+		{"?station=blues", http.StatusNotFound, ""},
+		{"?station=../jazz", http.StatusBadRequest, ""},
+		{"?station=jazz%20rock", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		stationQueryHandler(stations, mounts)(w, httptest.NewRequest(http.MethodGet, "/stream"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("/stream%s answered %d, want %d", test.query, w.Code, test.status)
+		} else if test.status == http.StatusOK && w.Body.String() != test.body {
+			t.Errorf("/stream%s served %q, want %q", test.query, w.Body, test.body)
+		}
+	}
+}
+
+// A station picked by query streams just as it does at its mount
+func TestStationQueryStreams(t *testing.T) {
+	jazz := NewMemoryStation("jazz", "/jazz", silentMPEGFrame, testOptions())
+	runStation(t, jazz)
+	stations := []*Station{jazz}
+	server := httptest.NewServer(stationQueryHandler(stations, map[*Station]http.HandlerFunc{jazz: streamHandler(jazz)}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream?station=jazz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	start := make([]byte, len(silentMPEGFrame))
+	if _, err := io.ReadFull(resp.Body, start); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "audio/mpeg" || !bytes.Equal(start, silentMPEGFrame) {
+		t.Errorf("streamed %s starting %x, want the jazz station", got, start[:4])
+	}
+}
+
+// Tracks are read a buffer at a time, so the memory streaming one takes is
+// the same whatever its size
+func BenchmarkStreamTrack(b *testing.B) {
+	for _, size := range []int{1 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("size=%dMiB", size>>20), func(b *testing.B) {
+			path := writeTestFile(b, "track.raw", make([]byte, size))
+			station := newStation("bench", "/bench-stream", testOptions())
+			buffer := station.pool.getBuffer()
+			ticker := time.NewTicker(time.Nanosecond)
+			defer ticker.Stop()
+			file, err := os.Open(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer file.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file.Seek(0, 0)
+				if err := station.streamTrack(context.Background(), file, buffer, ticker, time.Nanosecond, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
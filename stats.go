@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+)
+
+type Stats struct {
+	Listeners int            `json:"listeners"` // across every station
+	Uptime    float64        `json:"uptime_seconds"`
+	Stations  []StationStats `json:"stations"`
+}
+
+type StationStats struct {
+	Name           string          `json:"name"`
+	Mount          string          `json:"mount"`
+	Listeners      int             `json:"listeners"`
+	BytesBroadcast uint64          `json:"bytes_broadcast"`
+	BytesSent      int64           `json:"bytes_sent"` // to the listeners connected now
+	CurrentTrack   string          `json:"current_track"`
+	Paused         bool            `json:"paused"`
+	BroadcastLag   float64         `json:"broadcast_lag_seconds"`
+	RealTimeFactor float64         `json:"real_time_factor"` // seconds of audio broadcast per second, 0 when the bitrate is unknown
+	Variants       []VariantStats  `json:"variants,omitempty"`
+	VariantOf      string          `json:"variant_of,omitempty"` // mount of the main station
+	Buffers        BufferStats     `json:"buffers"`
+	ListenerStats  []ListenerStats `json:"listener_details,omitempty"`
+}
+
+type ListenerStats struct {
+	ID         uint64    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent"`
+	Connected  time.Time `json:"connected"`
+	Duration   float64   `json:"duration_seconds"`
+	BytesSent  int64     `json:"bytes_sent"`
+	Latency    string    `json:"latency,omitempty"` // low or high, as asked for with ?latency=
+}
+
+func (c *Connection) stats() ListenerStats {
+	return ListenerStats{
+		ID:         c.id,
+		RemoteAddr: c.remoteAddr,
+		UserAgent:  c.userAgent,
+		Connected:  c.connected,
+		Duration:   time.Since(c.connected).Seconds(),
+		BytesSent:  c.bytesSent.Load(),
+		Latency:    c.latency,
+	}
+}
+
+// statsHandler reports listener counts and totals. Individual listeners,
+// which include their addresses, are only shown to requests carrying the
+// credentials when auth is enabled.
+func statsHandler(stations []*Station, started time.Time, credentials Credentials) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		showListeners := !credentials.enabled()
+		if user, password, ok := r.BasicAuth(); ok && credentials.enabled() {
+			showListeners = credentials.matches(user, password)
+		}
+
+		stats := Stats{Uptime: time.Since(started).Seconds()}
+		for _, station := range stations {
+			connections := station.pool.Connections()
+			stationStats := StationStats{
+				Name:           station.Name,
+				Mount:          station.Mount,
+				Listeners:      len(connections),
+				BytesBroadcast: station.pool.bytesBroadcast.Load(),
+				CurrentTrack:   station.title(),
+				Paused:         station.paused.Load(),
+				BroadcastLag:   time.Duration(station.lag.Load()).Seconds(),
+				RealTimeFactor: math.Float64frombits(station.realTime.Load()),
+				Variants:       station.variantStats(),
+				Buffers:        station.pool.bufferStats(),
+			}
+			if station.variantOf != nil {
+				stationStats.VariantOf = station.variantOf.Mount
+			}
+			for _, connection := range connections {
+				sent := connection.bytesSent.Load()
+				stationStats.BytesSent += sent
+				if showListeners {
+					stationStats.ListenerStats = append(stationStats.ListenerStats, connection.stats())
+				}
+			}
+			stats.Listeners += stationStats.Listeners
+			stats.Stations = append(stats.Stations, stationStats)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			slog.Error("could not write stats", "error", err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// redirectHandler sends plain HTTP requests to the same path over HTTPS on
+// the given port
+func redirectHandler(httpsPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+
+// newAutocertManager gets and renews certificates for domains from Let's
+// Encrypt, keeping them in cacheDir so restarts don't ask for new ones and
+// run into its rate limits. Certificates are only ever requested for
+// domains, whatever name a client asks for.
+func newAutocertManager(domains []string, cacheDir, email string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port, url, want string
+	}{
+		{"443", "http://radio.example/stream", "https://radio.example/stream"},
+		{"443", "http://radio.example:80/stream?latency=low", "https://radio.example/stream?latency=low"},
+		{"8443", "http://radio.example/stream", "https://radio.example:8443/stream"},
+		{"8443", "http://[::1]:80/", "https://[::1]:8443/"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		redirectHandler(test.port)(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if got := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || got != test.want {
+			t.Errorf("%s on port %s redirected %d to %q, want %q", test.url, test.port, w.Code, got, test.want)
+		}
+	}
+}
+
+// Certificates are only asked for the domains given, the HTTP-01 challenges
+// are answered on port 80 and everything else there is redirected
+func TestAutocertManager(t *testing.T) {
+	manager := newAutocertManager([]string{"radio.example", "www.radio.example"}, t.TempDir(), "dj@radio.example")
+	for host, allowed := range map[string]bool{
+		"radio.example":     true,
+		"www.radio.example": true,
+		"other.example":     false,
+	} {
+		if err := manager.HostPolicy(context.Background(), host); (err == nil) != allowed {
+			t.Errorf("HostPolicy(%q) = %v, want allowed %v", host, err, allowed)
+		}
+	}
+	if manager.Email != "dj@radio.example" {
+		t.Errorf("Email = %q", manager.Email)
+	}
+
+	handler := manager.HTTPHandler(redirectHandler("443"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://radio.example/.well-known/acme-challenge/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown challenge answered %d, want %d", w.Code, http.StatusNotFound)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://radio.example/stream", nil))
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("plain HTTP answered %d, want a redirect", w.Code)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// variantFlags collects repeated -variant mount=source flags
+type variantFlags []string
+
+func (f *variantFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *variantFlags) Set(value string) error {
+	mount, _, ok := strings.Cut(value, "=")
+	if !ok || !strings.Contains(strings.Trim(mount, "/"), "-") {
+		return fmt.Errorf("expected mount-suffix=source, e.g. /stream-low=low.m3u, got %q", value)
+	}
+	if err := checkMount(mount, *f); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// variantParent finds the station a variant mount belongs to: the one whose
+// mount it starts with, followed by a dash. The longest match wins, so
+// /jazz-live-low belongs to /jazz-live rather than /jazz.
+func variantParent(stations []*Station, mount string) *Station {
+	var parent *Station
+	for _, station := range stations {
+		if station.variantOf != nil || !strings.HasPrefix(mount, station.Mount+"-") {
+			continue
+		}
+		if parent == nil || len(station.Mount) > len(parent.Mount) {
+			parent = station
+		}
+	}
+	return parent
+}
+
+// addVariant makes variant another rendition of s, e.g. a lower bitrate.
+// Each keeps its own stream and listeners. Started together from the same
+// shuffle seed, the two play the same tracks at the same time as long as
+// their playlists line up, and skips and pauses of s are applied to both.
+func (s *Station) addVariant(variant *Station) {
+	variant.variantOf = s
+	s.variants = append(s.variants, variant)
+}
+
+type VariantStats struct {
+	Mount       string `json:"mount"`
+	Format      string `json:"format"`
+	BitrateKbps int    `json:"bitrate_kbps"` // 0 when unknown
+}
+
+func (s *Station) variantStats() []VariantStats {
+	var variants []VariantStats
+	for _, variant := range s.variants {
+		variants = append(variants, VariantStats{
+			Mount:       variant.Mount,
+			Format:      variant.contentType,
+			BitrateKbps: (variant.bitrate + 500) / 1000,
+		})
+	}
+	return variants
+}
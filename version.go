@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Whatever is left empty is filled in from the build info Go records.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// buildInfo describes the running binary. The module version may be "(devel)"
+// for a plain go build. A VCS revision is only recorded when building inside
+// a checkout, with the time of that commit standing in for the build date,
+// so some fields may still be "unknown".
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if recorded, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = recorded.Main.Version
+		}
+		for _, setting := range recorded.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+		if commit == "" && info.Commit != "" && slices.Contains(recorded.Settings, debug.BuildSetting{Key: "vcs.modified", Value: "true"}) {
+			info.Commit += "-dirty"
+		}
+	}
+	for _, field := range []*string{&info.Version, &info.Commit, &info.BuildDate} {
+		if *field == "" {
+			*field = "unknown"
+		}
+	}
+	return info
+}
+
+// versionHandler reports which build is running
+func versionHandler(info BuildInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			slog.Error("could not write version", "error", err)
+		}
+	}
+}
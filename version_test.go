@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// setBuildVars stands in for -ldflags -X for the rest of the test
+func setBuildVars(t *testing.T, v, c, d string) {
+	saved := [3]string{version, commit, buildDate}
+	t.Cleanup(func() { version, commit, buildDate = saved[0], saved[1], saved[2] })
+	version, commit, buildDate = v, c, d
+}
+
+func TestBuildInfoFromLdflags(t *testing.T) {
+	setBuildVars(t, "1.2.0", "abc123", "2026-01-02T03:04:05Z")
+	want := BuildInfo{Version: "1.2.0", Commit: "abc123", BuildDate: "2026-01-02T03:04:05Z", GoVersion: runtime.Version()}
+	if got := buildInfo(); got != want {
+		t.Errorf("buildInfo() = %+v, want %+v", got, want)
+	}
+}
+
+// Without -ldflags every field is still filled in, from what Go recorded or
+// as unknown
+func TestBuildInfoFallback(t *testing.T) {
+	setBuildVars(t, "", "", "")
+	info := buildInfo()
+	for name, value := range map[string]string{"version": info.Version, "commit": info.Commit, "build date": info.BuildDate} {
+		if value == "" {
+			t.Errorf("%s left empty", name)
+		}
+	}
+	if info.GoVersion != runtime.Version() {
+		t.Errorf("GoVersion = %q, want %q", info.GoVersion, runtime.Version())
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	want := BuildInfo{Version: "1.2.0", Commit: "abc123", BuildDate: "unknown", GoVersion: "go1.22.5"}
+	w := httptest.NewRecorder()
+	versionHandler(want)(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var got BuildInfo
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("served %+v, want %+v", got, want)
+	}
+}
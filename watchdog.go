@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// loadFallback checks the emergency file played during dead air once, at
+// startup, rather than finding out it's missing when it's needed
+func loadFallback(path, mediaRoot string) (string, error) {
+	path, err := resolveLocalPath(mediaRoot, path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() == 0 {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return path, nil
+}
+
+// watchdog raises the alarm when nothing has been broadcast for longer than
+// deadAir, e.g. because the stream goroutine is stuck on a slow read. If
+// the station has a fallback file it is broadcast until the stream recovers.
+func (s *Station) watchdog(ctx context.Context) {
+	started := time.Now().UnixNano()
+	ticker := time.NewTicker(s.deadAir / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if s.paused.Load() {
+			// Silence is intended while paused, count it from the resume
+			started = time.Now().UnixNano()
+			continue
+		}
+
+		// Give the first track, and the first after a pause, as long as
+		// any other
+		last := s.lastBroadcast.Load()
+		silent := time.Since(time.Unix(0, max(last, started)))
+
+		if silent <= s.deadAir {
+			if s.silent.Swap(false) {
+				slog.Info("broadcast resumed", "station", s.Name)
+			}
+			continue
+		}
+		if !s.silent.Swap(true) {
+			slog.Error("dead air", "station", s.Name, "silent_for", silent.Round(time.Second), "fallback", s.fallback)
+		}
+		if s.fallback != "" {
+			s.playFallback(ctx, last)
+		}
+	}
+}
+
+// playFallback broadcasts the fallback file on repeat until the stream
+// goroutine broadcasts again, which moves lastBroadcast on from last, or
+// the station is paused
+func (s *Station) playFallback(ctx context.Context, last int64) {
+	buffer := make([]byte, s.bufferSize)
+	interval, _ := s.trackInterval(s.fallback)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for s.lastBroadcast.Load() == last && !s.paused.Load() {
+		file, _, err := openTrack(s.fallback)
+		if err != nil {
+			slog.Error("could not open fallback", "station", s.Name, "fallback", s.fallback, "error", err)
+			return
+		}
+
+		played := false
+		for s.lastBroadcast.Load() == last && !s.paused.Load() {
+			n, err := file.Read(buffer)
+			if n > 0 {
+				played = true
+				s.pool.Broadcast(buffer[:n])
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					file.Close()
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				slog.Error("could not read fallback", "station", s.Name, "fallback", s.fallback, "error", err)
+				file.Close()
+				return
+			}
+		}
+		file.Close()
+		if !played {
+			return // Only a tag and no audio, don't spin on it
+		}
+	}
+}
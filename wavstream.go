@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// WAVSTREAMSIZE stands in for the RIFF and data chunk sizes of a streaming
+// WAV header, the length of a stream that has no end isn't known. Players
+// take it to mean "read until the connection closes".
+const WAVSTREAMSIZE = 0xFFFFFFFF
+
+// streamingWAVHeader returns a WAV header for format whose data chunk runs
+// on for as long as the stream does
+func streamingWAVHeader(format wavFormat) []byte {
+	header := make([]byte, 0, 28+len(format.fmtChunk))
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, WAVSTREAMSIZE)
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(format.fmtChunk)))
+	header = append(header, format.fmtChunk...)
+	if len(format.fmtChunk)%2 == 1 {
+		header = append(header, 0) // Chunks are word aligned
+	}
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, WAVSTREAMSIZE)
+	return header
+}
+
+// storeWAVHeader keeps the streaming header for the track in file, which
+// catchUp sends every new listener before any audio. Listeners only get a
+// header once, when they connect, so a track in another format than the
+// last is played wrong by everyone already listening. file is left where it
+// was.
+func (s *Station) storeWAVHeader(file *os.File) {
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	format, err := readWAVHeader(file)
+	file.Seek(start, io.SeekStart)
+	if err != nil || format.fmtChunk == nil {
+		slog.Warn("could not read the WAV header, keeping the last one", "station", s.Name, "error", err)
+		return
+	}
+
+	if previous := s.wavFormat; previous.fmtChunk != nil && !previous.sameAs(format) {
+		slog.Warn("WAV format changes between tracks, listeners already connected will play it wrong",
+			"station", s.Name, "sample_rate", format.sampleRate, "channels", format.channels, "bits_per_sample", format.bitsPerSample)
+	}
+	s.wavFormat = format
+	header := streamingWAVHeader(format)
+	s.wavHeader.Store(&header)
+}
+
+// stripWAVHeader returns the samples of the WAV track in source, without its
+// header or any chunks after the data, which would be played as noise
+func stripWAVHeader(source io.Reader) io.Reader {
+	format, err := readWAVHeader(source)
+	if err != nil {
+		return source
+	}
+	if format.dataSize == 0 || format.dataSize == WAVSTREAMSIZE {
+		return source // Written by something that didn't know the length either
+	}
+	return io.LimitReader(source, format.dataSize)
+}
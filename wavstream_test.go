@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamingWAVHeader(t *testing.T) {
+	format, err := readWAVHeader(bytes.NewReader(wavHeader(1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := streamingWAVHeader(format)
+	if len(header) != 44 {
+		t.Errorf("header is %d bytes, want 44", len(header))
+	}
+	parsed, err := readWAVHeader(bytes.NewReader(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.dataSize != WAVSTREAMSIZE || !parsed.sameAs(format) || !bytes.Equal(parsed.fmtChunk, format.fmtChunk) {
+		t.Errorf("streaming header reads back as %+v, want %+v with a streaming size", parsed, format)
+	}
+
+	format.fmtChunk = append(format.fmtChunk, 0xAA) // An odd sized fmt chunk is padded
+	if header := streamingWAVHeader(format); len(header) != 46 || header[37] != 0 {
+		t.Errorf("header with a 17 byte fmt chunk is %d bytes, padded with %x", len(header), header[37])
+	}
+}
+
+func TestStripWAVHeader(t *testing.T) {
+	samples := []byte("0123456789")
+	tests := []struct {
+		name string
+		wav  []byte
+		want []byte
+	}{
+		{"samples only", append(wavHeader(len(samples)), samples...), samples},
+		{"chunk after the samples", bytes.Join([][]byte{wavHeader(len(samples)), samples, wavChunk("LIST", 4, []byte("INFO"))}, nil), samples},
+		{"unknown length", append(streamingWAVHeader(wavFormat{fmtChunk: wavHeader(0)[20:36]}), samples...), samples},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := io.ReadAll(stripWAVHeader(bytes.NewReader(test.wav)))
+			if err != nil || !bytes.Equal(got, test.want) {
+				t.Errorf("stripWAVHeader() read %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+// With -wav-header every listener gets one streaming header as it connects,
+// then only samples, however many tracks go by
+func TestWAVHeaderOncePerConnection(t *testing.T) {
+	var playlist []byte
+	for _, value := range []int16{1000, -1000} {
+		playlist = append(playlist, writeTestFile(t, "track.wav", pcmWAV(50*time.Millisecond, value))+"\n"...)
+	}
+	options := testOptions()
+	options.WAVHeader = true
+	station, err := NewStation("test", "/test", writeTestFile(t, "tracks.m3u", playlist), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStation(t, station)
+	waitFor(t, "the streaming header", func() bool { return station.wavHeader.Load() != nil })
+	server := httptest.NewServer(streamHandler(station))
+	defer server.Close()
+
+	for listener := 0; listener < 2; listener++ {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream := make([]byte, 44+4*silenceSampleRate*60/1000) // Through more than one track
+		_, err = io.ReadFull(resp.Body, stream)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(stream, *station.wavHeader.Load()) {
+			t.Errorf("listener %d: stream starts %q, want the streaming header", listener, stream[:12])
+		}
+		if bytes.Contains(stream[44:], []byte("RIFF")) {
+			t.Errorf("listener %d: a track's header was sent as audio", listener)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "audio/wav" {
+			t.Errorf("Content-Type = %q, want audio/wav", got)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+//go:embed web/index.html
+var webFS embed.FS
+
+var playerTemplate = template.Must(template.ParseFS(webFS, "web/index.html"))
+
+type playerStation struct {
+	Name  string
+	Mount string
+	Title string
+}
+
+// playerHandler serves a small web player with an <audio> element for each
+// station. The audio src is in the markup, so it plays with JavaScript off.
+func playerHandler(stations []*Station) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data []playerStation
+		for _, station := range stations {
+			data = append(data, playerStation{Name: station.Name, Mount: station.Mount, Title: station.title()})
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := playerTemplate.Execute(w, data); err != nil {
+			slog.Error("could not render player", "error", err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "io"
+
+// fullWriter writes every byte it's given before returning. io.Writer says a
+// short write must come with an error, but not every ResponseWriter or
+// wrapper keeps to that, and a chunk cut short without one would corrupt the
+// stream for the rest of the connection, e.g. by splitting an MP3 frame or
+// throwing ICY metadata out of step. A write that makes no progress at all
+// fails with io.ErrShortWrite rather than being retried forever.
+type fullWriter struct {
+	w io.Writer
+}
+
+func (fw fullWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := fw.w.Write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// shortWriter writes at most limit bytes at a time without an error, and
+// fails with err, if set, once it has written failAfter
+type shortWriter struct {
+	w         io.Writer
+	limit     int
+	written   int
+	failAfter int
+	err       error
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	if s.err != nil && s.written >= s.failAfter {
+		return 0, s.err
+	}
+	n, err := s.w.Write(p[:min(len(p), s.limit)])
+	s.written += n
+	return n, err
+}
+
+func TestFullWriter(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	broken := errors.New("connection reset")
+	tests := []struct {
+		name    string
+		writer  shortWriter
+		written int
+		err     error
+	}{
+		{"short writes", shortWriter{limit: 3}, len(data), nil},
+		{"no progress", shortWriter{limit: 0}, 0, io.ErrShortWrite},
+		{"fails part way", shortWriter{limit: 5, failAfter: 10, err: broken}, 10, broken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			test.writer.w = &out
+			n, err := fullWriter{&test.writer}.Write(data)
+			if n != test.written || err != test.err {
+				t.Errorf("Write() = %d, %v, want %d, %v", n, err, test.written, test.err)
+			}
+			if !bytes.Equal(out.Bytes(), data[:n]) {
+				t.Errorf("wrote %q, want %q", out.Bytes(), data[:n])
+			}
+		})
+	}
+}
+
+// shortResponse is a ResponseWriter that only takes a few bytes of each
+// write, flushing through Unwrap
+type shortResponse struct {
+	http.ResponseWriter
+	short *shortWriter
+}
+
+func (s shortResponse) Write(p []byte) (int, error) { return s.short.Write(p) }
+func (s shortResponse) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// Every chunk reaches the listener whole however little each write takes
+func TestStreamShortWrites(t *testing.T) {
+	options := testOptions()
+	options.Prebuffer = 1
+	station := newStation("test", "/stream", options)
+	handler := streamHandler(station)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(shortResponse{w, &shortWriter{w: w, limit: 7}}, r)
+	}))
+	defer server.Close()
+
+	chunks := [][]byte{bytes.Repeat([]byte("a"), 100), bytes.Repeat([]byte("b"), 50), []byte("c")}
+	station.pool.Broadcast(chunks[0]) // The prebuffer, so the response starts
+
+	client := &http.Client{Timeout: 5 * time.Second} // A truncated chunk leaves the read waiting
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for _, chunk := range chunks[1:] {
+		station.pool.Broadcast(chunk)
+	}
+
+	want := bytes.Join(chunks, nil)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("streamed %q, want %q", got, want)
+	}
+}
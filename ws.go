@@ -0,0 +1,130 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// wsHandler streams a station over a WebSocket, one binary message per
+// broadcast chunk. ?station= picks the station, the first one by default.
+// The connection joins the station's pool like any other listener.
+func wsHandler(stations []*Station, allowOrigin string) http.HandlerFunc {
+	options := &websocket.AcceptOptions{InsecureSkipVerify: allowOrigin == "*"}
+	if origin, err := url.Parse(allowOrigin); err == nil && origin.Host != "" {
+		options.OriginPatterns = []string{origin.Host}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		station := stations[0]
+		if key := r.URL.Query().Get("station"); key != "" {
+			if station = findStation(stations, key); station == nil {
+				http.Error(w, "Unknown station", http.StatusNotFound)
+				return
+			}
+		}
+		if station.onDemand {
+			http.Error(w, "On demand stations can't be streamed over WebSocket", http.StatusConflict)
+			return
+		}
+
+		ip := remoteIP(r.RemoteAddr)
+		if !station.ipLimiter.Acquire(ip) {
+			w.Header().Set("Retry-After", strconv.Itoa(RETRYAFTER))
+			http.Error(w, "Too many streams from your address", http.StatusTooManyRequests)
+			return
+		}
+		defer station.ipLimiter.Release(ip)
+
+		latency, err := requestedLatency(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		clientBuffer, prebuffer := station.latencyDepths(latency)
+		connection := &Connection{
+			bufferChannel:   make(chan Chunk, clientBuffer),
+			remoteAddr:      r.RemoteAddr,
+			userAgent:       r.UserAgent(),
+			connected:       time.Now(),
+			latency:         latency,
+			prebufferChunks: prebuffer,
+		}
+		if err := station.pool.AddConnection(connection); err != nil {
+			slog.Warn("client turned away", "station", station.Name, "remote_addr", r.RemoteAddr, "error", err)
+			w.Header().Set("Retry-After", strconv.Itoa(RETRYAFTER))
+			http.Error(w, fmt.Sprintf("%v, %d listeners connected", err, station.pool.Count()), http.StatusServiceUnavailable)
+			return
+		}
+		defer station.pool.DeleteConnection(connection)
+
+		conn, err := websocket.Accept(w, r, options)
+		if err != nil {
+			slog.Warn("could not accept WebSocket", "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
+		defer conn.CloseNow()
+
+		// Listeners only ever receive. CloseRead handles their close frame
+		// and cancels ctx when it arrives.
+		ctx := conn.CloseRead(r.Context())
+		if station.maxDuration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, station.maxDuration)
+			defer cancel()
+		}
+		slog.Info("client connected", "station", station.Name, "remote_addr", r.RemoteAddr, "user_agent", r.UserAgent(), "transport", "websocket", "latency", cmp.Or(latency, "default"))
+
+		send := func(chunk Chunk) error {
+			writeCtx := ctx
+			if station.writeTimeout > 0 {
+				var cancel context.CancelFunc
+				writeCtx, cancel = context.WithTimeout(ctx, station.writeTimeout)
+				defer cancel()
+			}
+			if err := conn.Write(writeCtx, websocket.MessageBinary, chunk.Data); err != nil {
+				return err
+			}
+			connection.bytesSent.Add(int64(len(chunk.Data)))
+			return nil
+		}
+
+		for _, chunk := range station.catchUp(connection) {
+			if err := send(chunk); err != nil {
+				slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "error", err)
+				return
+			}
+		}
+
+		for {
+			select {
+			case chunk, ok := <-connection.bufferChannel:
+				if !ok { // Evicted, kicked or shutting down
+					conn.Close(websocket.StatusGoingAway, "disconnected by the server")
+					slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "bytes", connection.bytesSent.Load(), "duration", time.Since(connection.connected))
+					return
+				}
+				err := send(chunk)
+				station.pool.putBuffer(chunk.Data)
+				if err != nil {
+					slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "bytes", connection.bytesSent.Load(), "duration", time.Since(connection.connected), "error", err)
+					return
+				}
+			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					conn.Close(websocket.StatusNormalClosure, "maximum listening time reached")
+				}
+				slog.Info("client disconnected", "station", station.Name, "remote_addr", r.RemoteAddr, "bytes", connection.bytesSent.Load(), "duration", time.Since(connection.connected))
+				return
+			}
+		}
+	}
+}
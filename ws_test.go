@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func dialWS(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(url, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestWSStreamsChunks(t *testing.T) {
+	jingle := append(silentMPEGFrame[:4:4], "jingle"...)
+	first := NewMemoryStation("first", "/first", []byte("OggS\x00"), testOptions())
+	second := NewMemoryStation("second", "/second", jingle, testOptions())
+	for _, station := range []*Station{first, second} {
+		runStation(t, station)
+	}
+	server := httptest.NewServer(wsHandler([]*Station{first, second}, ""))
+	defer server.Close()
+
+	conn := dialWS(t, server.URL+"?station=second")
+	defer conn.CloseNow()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		kind, message, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != websocket.MessageBinary || !bytes.Equal(message, jingle) {
+			t.Errorf("message %d = %v %q, want the chunk as a binary message", i, kind, message)
+		}
+	}
+	if second.pool.Count() != 1 || first.pool.Count() != 0 {
+		t.Errorf("listeners = %d and %d, want the one on the second station", first.pool.Count(), second.pool.Count())
+	}
+
+	// A close frame from the client takes it out of the pool
+	conn.Close(websocket.StatusNormalClosure, "")
+	waitFor(t, "the listener to leave", func() bool { return second.pool.Count() == 0 })
+}
+
+func TestWSUnknownStation(t *testing.T) {
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, testOptions())
+	server := httptest.NewServer(wsHandler([]*Station{station}, ""))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?station=missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// Closing the pool, e.g. to shut down, closes the WebSocket too
+func TestWSClosedByServer(t *testing.T) {
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, testOptions())
+	runStation(t, station)
+	server := httptest.NewServer(wsHandler([]*Station{station}, ""))
+	defer server.Close()
+
+	conn := dialWS(t, server.URL)
+	defer conn.CloseNow()
+	waitFor(t, "the listener to join", func() bool { return station.pool.Count() == 1 })
+	station.pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		if _, _, err := conn.Read(ctx); err != nil {
+			if status := websocket.CloseStatus(err); status != websocket.StatusGoingAway {
+				t.Errorf("closed with %v (%v), want going away", status, err)
+			}
+			return
+		}
+	}
+}
+
+// With -max-duration a WebSocket listener is sent a normal close once it's
+// up
+func TestWSMaxDuration(t *testing.T) {
+	options := testOptions()
+	options.MaxDuration = 200 * time.Millisecond
+	station := NewMemoryStation("test", "/stream", silentMPEGFrame, options)
+	runStation(t, station)
+	server := httptest.NewServer(wsHandler([]*Station{station}, ""))
+	defer server.Close()
+
+	conn := dialWS(t, server.URL)
+	defer conn.CloseNow()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	for {
+		if _, _, err := conn.Read(ctx); err != nil {
+			if status := websocket.CloseStatus(err); status != websocket.StatusNormalClosure {
+				t.Errorf("closed with %v (%v), want a normal closure", status, err)
+			}
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed < options.MaxDuration/2 {
+		t.Errorf("closed after %v, want %v", elapsed, options.MaxDuration)
+	}
+	waitFor(t, "the listener to leave", func() bool { return station.pool.Count() == 0 })
+}